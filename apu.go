@@ -57,13 +57,118 @@ func (p *Pulse) readRegister(num byte) byte {
     return 0
 }
 
+var dmcRates = [16]int{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54}
+
+// DMC plays 1-bit delta samples that it fetches from CPU memory a byte at a
+// time with DMA.
+type DMC struct {
+    irqEnabled bool
+    loop bool
+    irq bool
+    rate int
+    timer int
+    level byte
+    sampleAddr word
+    sampleLength word
+    addr word
+    remaining word
+    buffer byte
+    bufferFull bool
+    shift byte
+    bitsLeft int
+    silent bool
+}
+
+func (d *DMC) writeRegister(num byte, val byte) {
+    switch num {
+    case 0x10:
+        d.irqEnabled = val & 0x80 != 0
+        if !d.irqEnabled {
+            d.irq = false
+        }
+        d.loop = val & 0x40 != 0
+        d.rate = dmcRates[val & 0xf]
+    case 0x11:
+        d.level = val & 0x7f
+    case 0x12:
+        d.sampleAddr = 0xc000 | word(val) << 6
+    case 0x13:
+        d.sampleLength = word(val) << 4 | 1
+    }
+}
+
+func (d *DMC) restart() {
+    d.addr = d.sampleAddr
+    d.remaining = d.sampleLength
+}
+
+func (d *DMC) enable(en bool) {
+    d.irq = false
+    if !en {
+        d.remaining = 0
+    } else if d.remaining == 0 {
+        d.restart()
+    }
+}
+
+// needsFetch reports whether the sample buffer is waiting on a DMA read.
+func (d *DMC) needsFetch() bool {
+    return !d.bufferFull && d.remaining > 0
+}
+
+// fill takes the byte a DMA read fetched from d.addr.
+func (d *DMC) fill(val byte) {
+    d.buffer = val
+    d.bufferFull = true
+    d.addr++
+    if d.addr == 0 {
+        d.addr = 0x8000
+    }
+    d.remaining--
+    if d.remaining == 0 {
+        if d.loop {
+            d.restart()
+        } else if d.irqEnabled {
+            d.irq = true
+        }
+    }
+}
+
+func (d *DMC) clock(cycles int) {
+    d.timer -= cycles
+    if d.timer > 0 {
+        return
+    }
+    d.timer += d.rate
+    if !d.silent {
+        if d.shift & 1 != 0 {
+            if d.level <= 125 {
+                d.level += 2
+            }
+        } else if d.level >= 2 {
+            d.level -= 2
+        }
+    }
+    d.shift >>= 1
+    d.bitsLeft--
+    if d.bitsLeft <= 0 {
+        d.bitsLeft = 8
+        d.silent = !d.bufferFull
+        if d.bufferFull {
+            d.shift = d.buffer
+            d.bufferFull = false
+        }
+    }
+}
+
 type APU struct {
     m *Machine
     //registers
     status byte
     //channels
     p1, p2 Pulse
-    //triangle, noise, dmc
+    dmc DMC
+    //triangle, noise
     //frame counter
     frameMode bool
     oddClock bool
@@ -77,6 +182,10 @@ type APU struct {
 func makeAPU(mach *Machine) *APU {
     a := APU{}
     a.m = mach
+    a.dmc.rate = dmcRates[0]
+    a.dmc.timer = a.dmc.rate
+    a.dmc.bitsLeft = 8
+    a.dmc.silent = true
     return &a
 }
 
@@ -115,9 +224,12 @@ func (a *APU) writeRegister(num byte, val byte) {
         a.p1.writeRegister(num, val)
     case 0x4,0x5,0x6,0x7:
         a.p2.writeRegister(num, val)
+    case 0x10,0x11,0x12,0x13:
+        a.dmc.writeRegister(num, val)
     case 0x15:
         a.p1.enableLength(val & 0x1 != 0)
         a.p2.enableLength(val & 0x2 != 0)
+        a.dmc.enable(val & 0x10 != 0)
     case 0x17:
         a.frameMode = val & 0x80 != 0
         if val & 0x40 != 0 {
@@ -132,19 +244,32 @@ func (a *APU) writeRegister(num byte, val byte) {
     }
 }
 
+// peekStatus returns what reading $4015 would, without clearing the frame
+// interrupt.
+func (a *APU) peekStatus() byte {
+    status := byte(0)
+    if a.frameInterrupt {
+        status |= 1<<6
+    }
+    if a.p1.lengthNonzero() {
+        status |= 1
+    }
+    if a.p2.lengthNonzero() {
+        status |= 2
+    }
+    if a.dmc.remaining > 0 {
+        status |= 1<<4
+    }
+    if a.dmc.irq {
+        status |= 1<<7
+    }
+    return status
+}
+
 func (a *APU) readRegister(num byte) byte {
-    oldStatus := byte(0)
     switch num {
     case 0x15:
-        if a.frameInterrupt {
-            oldStatus |= 1<<6
-        }
-        if a.p1.lengthNonzero() {
-            oldStatus |= 1
-        }
-        if a.p2.lengthNonzero() {
-            oldStatus |= 2
-        }
+        oldStatus := a.peekStatus()
         a.frameInterrupt = false
         return oldStatus
     case 0x17:
@@ -168,7 +293,11 @@ func (a *APU) update(cycles int) {
         a.clockSequencer()
         a.oddClock = !a.oddClock
     }
-    if a.frameInterrupt {
+    a.dmc.clock(cycles)
+    if a.dmc.needsFetch() {
+        a.m.requestDMCDMA()
+    }
+    if a.frameInterrupt || a.dmc.irq {
         a.m.requestIrq()
     }
 }
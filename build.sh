@@ -1,5 +1,6 @@
 #!/bin/sh
 
-6g -o gones.6 instruction.go machine.go cpu.go util.go ppu.go rom.go mapper.go apu.go
+6g -o lua.6 lua/*.go
+6g -o gones.6 instruction.go machine.go cpu.go util.go ppu.go rom.go unif.go mapper.go apu.go disasm.go trace.go cdl.go profile.go expr.go debugger.go gdb.go symbols.go ppuview.go hooks.go script.go eventview.go ramsearch.go cheats.go
 6g main.go test.go
 6l -o gones main.6
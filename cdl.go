@@ -0,0 +1,81 @@
+package gones
+
+import (
+    "io"
+    "os"
+)
+
+// Flags for PRG bytes in a code/data log. Bits 2 and 3 hold which 8KB of
+// $8000-$FFFF the byte was mapped at when it was last used.
+const (
+    CDL_CODE          = 0x01
+    CDL_DATA          = 0x02
+    CDL_INDIRECT_CODE = 0x10 //the target of a JMP ($nnnn)
+    CDL_INDIRECT_DATA = 0x20 //read through a ($nn,X) or ($nn),Y pointer
+    CDL_PCM           = 0x40 //fetched as a DMC sample
+)
+
+// Flags for CHR bytes in a code/data log.
+const (
+    CDL_RENDERED = 0x01
+    CDL_READ     = 0x02 //read by the CPU through $2007
+)
+
+// A CDL records how each byte of PRG and CHR ROM has been used, keyed by
+// offset into the ROM so bank switching doesn't matter. It reads and writes
+// FCEUX's .cdl format: a byte per PRG byte, then a byte per CHR byte if the
+// cart has CHR ROM.
+type CDL struct {
+    PRG []byte
+    CHR []byte
+}
+
+// StartCDL starts logging code and data use and returns the log.
+func (m *Machine) StartCDL() *CDL {
+    c := &CDL{PRG: make([]byte, len(m.rom.prg_banks))}
+    if !m.rom.chr_ram {
+        c.CHR = make([]byte, len(m.rom.chr_banks))
+    }
+    m.cdl = c
+    return c
+}
+
+// Read loads a log saved by Write, so that logging can carry on from it.
+func (c *CDL) Read(r io.Reader) os.Error {
+    if _, err := io.ReadFull(r, c.PRG); err != nil {
+        return err
+    }
+    _, err := io.ReadFull(r, c.CHR)
+    return err
+}
+
+// Write saves the log in FCEUX's format.
+func (c *CDL) Write(w io.Writer) os.Error {
+    if _, err := w.Write(c.PRG); err != nil {
+        return err
+    }
+    _, err := w.Write(c.CHR)
+    return err
+}
+
+// logPRG marks the PRG byte the CPU sees at addr with flags.
+func (m *Machine) logPRG(addr word, flags byte) {
+    if m.cdl == nil || addr < 0x8000 {
+        return
+    }
+    i := m.rom.prgOffset(addr)
+    if i >= 0 && i < len(m.cdl.PRG) {
+        m.cdl.PRG[i] = (m.cdl.PRG[i] & ^byte(0x0c)) | flags | byte(addr>>13&3)<<2
+    }
+}
+
+// logCHR marks the CHR byte the PPU sees at addr with flags.
+func (m *Machine) logCHR(addr word, flags byte) {
+    if m.cdl == nil || m.cdl.CHR == nil {
+        return
+    }
+    i := m.rom.chrOffset(addr)
+    if i >= 0 && i < len(m.cdl.CHR) {
+        m.cdl.CHR[i] |= flags
+    }
+}
@@ -0,0 +1,386 @@
+package gones
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+const CHEAT_HELP = `Codes are Game Genie codes, 6 or 8 letters, or Pro Action Replay RAM
+freezes written AAAAVV or AAAA:VV in hex, which hold the byte at AAAA,
+$0000-$07FF, at VV.
+  cheat add code [description]  add a cheat and turn it on
+  cheat list                    list the cheats, numbered from 1
+  cheat on|off|toggle n         turn cheat n on or off; keys 1-9 toggle
+                                the first nine
+  cheat del n                   delete cheat n
+  cheat save                    save the cheats to the ROM's .cht file
+  cheat help                    show this
+.cht files are FCEUX's, so cheats carry over between the two. Each line is
+[S][C][:]AAAA:VV[:CC]:name in hex, where S makes the cheat change what's
+read from ROM, like a Game Genie code, instead of holding RAM at VV, C
+gives it a compare value and a : turns it off.
+`
+
+// GENIE_LETTERS are the Game Genie's letters, in the order of the values
+// they stand for.
+const GENIE_LETTERS = "APZLGITYEOXUKSVN"
+
+type cheat struct {
+    code        string
+    description string
+    enabled     bool
+    addr        word
+    val         byte
+    compare     int //the byte a Game Genie code replaces, or -1 for any
+    freeze      bool
+    hooks       []int
+}
+
+// decodeCheat decodes a Game Genie or Pro Action Replay code.
+func decodeCheat(code string) (*cheat, os.Error) {
+    code = strings.ToUpper(strings.Replace(code, "-", "", -1))
+    c := &cheat{code: code, compare: -1}
+    if n, ok := decodeGenie(code); ok {
+        c.addr = 0x8000 | word(n[3]&7)<<12 | word(n[5]&7)<<8 | word(n[4]&8)<<8 |
+            word(n[2]&7)<<4 | word(n[1]&8)<<4 | word(n[4]&7) | word(n[3]&8)
+        c.val = byte(n[1]&7<<4 | n[0]&8<<4 | n[0]&7)
+        if len(n) == 6 {
+            c.val |= byte(n[5] & 8)
+        } else {
+            c.val |= byte(n[7] & 8)
+            c.compare = n[7]&7<<4 | n[6]&8<<4 | n[6]&7 | n[5]&8
+        }
+        return c, nil
+    }
+    hex := strings.Replace(code, ":", "", -1)
+    if len(hex) == 6 {
+        addr, err1 := strconv.Btoui64(hex[:4], 16)
+        val, err2 := strconv.Btoui64(hex[4:], 16)
+        if err1 == nil && err2 == nil {
+            if addr >= 0x800 {
+                return nil, fmt.Errorf("%s freezes $%04X, which isn't RAM", code, addr)
+            }
+            c.addr, c.val, c.freeze = word(addr), byte(val), true
+            return c, nil
+        }
+    }
+    return nil, fmt.Errorf("%s isn't a Game Genie or Pro Action Replay code", code)
+}
+
+// encodeGenie writes a Game Genie code for a cheat on ROM, 8 letters if it
+// has a compare value. The third letter's high bit, which decoding
+// ignores, is set for 8 letter codes the way the Game Genie writes them.
+func encodeGenie(c *cheat) string {
+    a, v := int(c.addr), int(c.val)
+    n := []int{v&7 | v>>4&8, v>>4&7 | a>>4&8, a>>4&7, a>>12&7 | a&8, a&7 | a>>8&8, a>>8&7 | v&8}
+    if c.compare >= 0 {
+        cmp := c.compare
+        n[2] |= 8
+        n[5] = a>>8&7 | cmp&8
+        n = append(n, cmp&7|cmp>>4&8, cmp>>4&7|v&8)
+    }
+    b := make([]byte, len(n))
+    for i, x := range n {
+        b[i] = GENIE_LETTERS[x]
+    }
+    return string(b)
+}
+
+// parseFCEUX reads a line of an FCEUX .cht file, giving the cheat and
+// whether it's on. Substitutions are taken as Game Genie codes and the
+// rest as Pro Action Replay RAM freezes.
+func parseFCEUX(line string) (*cheat, bool, os.Error) {
+    substitute, hasCompare, on := false, false, true
+    if strings.HasPrefix(line, "S") {
+        substitute, line = true, line[1:]
+    }
+    if strings.HasPrefix(line, "C") {
+        hasCompare, line = true, line[1:]
+    }
+    if strings.HasPrefix(line, ":") {
+        on, line = false, line[1:]
+    }
+    n := 3
+    if hasCompare {
+        n = 4
+    }
+    f := strings.SplitN(line, ":", n)
+    if len(f) < n {
+        return nil, false, os.NewError("cheats are written [S][C][:]AAAA:VV[:CC]:name")
+    }
+    var nums [3]int
+    for i := 0; i < n-1; i++ {
+        x, err := strconv.Btoui64(f[i], 16)
+        if err != nil || i == 0 && x > 0xffff || i > 0 && x > 0xff {
+            return nil, false, fmt.Errorf("bad number %s", f[i])
+        }
+        nums[i] = int(x)
+    }
+    c := &cheat{addr: word(nums[0]), val: byte(nums[1]), compare: -1, description: f[n-1]}
+    if hasCompare {
+        c.compare = nums[2]
+    }
+    switch true {
+    case substitute && c.addr >= 0x8000:
+        c.code = encodeGenie(c)
+    case !substitute && !hasCompare && c.addr < 0x800:
+        c.code = fmt.Sprintf("%04X:%02X", c.addr, c.val)
+        c.freeze = true
+    default:
+        return nil, false, os.NewError("only substitutions in ROM and RAM freezes are supported")
+    }
+    return c, on, nil
+}
+
+// fceux writes the cheat as a line of an FCEUX .cht file.
+func (c *cheat) fceux() string {
+    line := ""
+    if !c.freeze {
+        line = "S"
+    }
+    if c.compare >= 0 {
+        line += "C"
+    }
+    if !c.enabled {
+        line += ":"
+    }
+    line += fmt.Sprintf("%04x:%02x", c.addr, c.val)
+    if c.compare >= 0 {
+        line += fmt.Sprintf(":%02x", c.compare)
+    }
+    return line + ":" + c.description
+}
+
+// decodeGenie turns a Game Genie code's letters into their values.
+func decodeGenie(code string) ([]int, bool) {
+    if len(code) != 6 && len(code) != 8 {
+        return nil, false
+    }
+    n := make([]int, len(code))
+    for i := 0; i < len(code); i++ {
+        if n[i] = strings.Index(GENIE_LETTERS, code[i:i+1]); n[i] < 0 {
+            return nil, false
+        }
+    }
+    return n, true
+}
+
+func (c *cheat) String() string {
+    text := fmt.Sprintf("$%04X = $%02X", c.addr, c.val)
+    if c.compare >= 0 {
+        text += fmt.Sprintf(" if $%02X", c.compare)
+    }
+    state := "off"
+    if c.enabled {
+        state = "on"
+    }
+    return strings.TrimRight(fmt.Sprintf("%-3s %-8s %-22s %s", state, c.code, text, c.description), " ")
+}
+
+// Cheats patches what the CPU reads: Game Genie codes change bytes of PRG
+// ROM, and Pro Action Replay codes freeze bytes of RAM. Like the RAM
+// search it takes commands from a channel between frames.
+type Cheats struct {
+    m        *Machine
+    commands chan string
+    out      io.Writer
+    fname    string
+    list     []*cheat
+}
+
+// StartCheats loads a ROM's cheats from fname, a .cht file, if it exists,
+// and turns on the ones marked on. Commands come from commands, which
+// the hotkeys also send to, and go to out.
+func (m *Machine) StartCheats(fname string, commands chan string, out io.Writer) (*Cheats, os.Error) {
+    m.StopCheats()
+    c := &Cheats{m: m, commands: commands, out: out, fname: fname}
+    if err := c.load(); err != nil {
+        return nil, err
+    }
+    m.cheats = c
+    return c, nil
+}
+
+// StopCheats turns the cheats off and stops taking commands.
+func (m *Machine) StopCheats() {
+    if c := m.cheats; c != nil {
+        for _, ch := range c.list {
+            c.enable(ch, false)
+        }
+        m.cheats = nil
+    }
+}
+
+// CheatFile gives the .cht file that goes with a ROM.
+func CheatFile(romname string) string {
+    return romname[:len(romname)-len(filepath.Ext(romname))] + ".cht"
+}
+
+func (c *Cheats) load() os.Error {
+    f, err := os.Open(c.fname)
+    if err != nil {
+        //no cheats yet
+        return nil
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+    for n := 1; ; n++ {
+        line, err := r.ReadString('\n')
+        if line = strings.TrimRight(line, "\r\n"); line != "" {
+            ch, on, err := parseFCEUX(line)
+            if err != nil {
+                return fmt.Errorf("%s:%d: %v", c.fname, n, err)
+            }
+            c.list = append(c.list, ch)
+            c.enable(ch, on)
+        }
+        if err == os.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c *Cheats) save() os.Error {
+    f, err := os.Create(c.fname)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    for _, ch := range c.list {
+        if _, err := fmt.Fprintln(f, ch.fceux()); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// enable turns a cheat on or off by adding or removing its hooks.
+func (c *Cheats) enable(ch *cheat, on bool) {
+    if ch.enabled == on {
+        return
+    }
+    ch.enabled = on
+    if !on {
+        for _, id := range ch.hooks {
+            c.m.RemoveHook(id)
+        }
+        ch.hooks = nil
+        return
+    }
+    m := c.m
+    mirrors := 1
+    if ch.freeze {
+        //RAM shows through at $0800, $1000 and $1800 too
+        mirrors = 4
+        m.pokeMem(ch.addr, ch.val)
+    }
+    for i := 0; i < mirrors; i++ {
+        a := uint16(ch.addr) + uint16(i*0x800)
+        ch.hooks = append(ch.hooks, m.OnRead(a, a, func(addr uint16, val byte) byte {
+            if ch.compare < 0 || int(val) == ch.compare {
+                return ch.val
+            }
+            return val
+        }))
+        if ch.freeze {
+            //keep RAM holding the value, so peeks and watches see it too
+            ch.hooks = append(ch.hooks, m.OnWrite(a, a, func(addr uint16, val byte) {
+                m.pokeMem(ch.addr, ch.val)
+            }))
+        }
+    }
+}
+
+// takeCommands runs the commands that have come in.
+func (c *Cheats) takeCommands() {
+    for done := false; !done; {
+        select {
+        case line := <-c.commands:
+            if err := c.command(strings.Fields(line)); err != nil {
+                fmt.Fprintf(c.out, "%v\n", err)
+            }
+        default:
+            done = true
+        }
+    }
+}
+
+// cheat finds cheat n, counting from 1.
+func (c *Cheats) cheat(args []string) (int, os.Error) {
+    if len(args) != 1 {
+        return 0, os.NewError("which cheat?")
+    }
+    n, err := strconv.Atoi(args[0])
+    if err != nil || n < 1 || n > len(c.list) {
+        return 0, fmt.Errorf("no cheat %s", args[0])
+    }
+    return n - 1, nil
+}
+
+func (c *Cheats) command(args []string) os.Error {
+    if len(args) < 2 || args[0] != "cheat" {
+        return os.NewError("usage: cheat add|list|on|off|toggle|del|save|help ...")
+    }
+    cmd, args := args[1], args[2:]
+    switch cmd {
+    case "add":
+        if len(args) == 0 {
+            return os.NewError("usage: cheat add code [description]")
+        }
+        ch, err := decodeCheat(args[0])
+        if err != nil {
+            return err
+        }
+        ch.description = strings.Join(args[1:], " ")
+        c.list = append(c.list, ch)
+        c.enable(ch, true)
+        fmt.Fprintf(c.out, "%d: %v\n", len(c.list), ch)
+    case "list":
+        for i, ch := range c.list {
+            fmt.Fprintf(c.out, "%d: %v\n", i+1, ch)
+        }
+    case "on", "off", "toggle":
+        i, err := c.cheat(args)
+        if err != nil {
+            return err
+        }
+        ch := c.list[i]
+        c.enable(ch, cmd == "on" || cmd == "toggle" && !ch.enabled)
+        fmt.Fprintf(c.out, "%d: %v\n", i+1, ch)
+    case "del":
+        i, err := c.cheat(args)
+        if err != nil {
+            return err
+        }
+        c.enable(c.list[i], false)
+        c.list = append(c.list[:i], c.list[i+1:]...)
+    case "save":
+        if err := c.save(); err != nil {
+            return err
+        }
+        fmt.Fprintf(c.out, "saved %d cheats to %s\n", len(c.list), c.fname)
+    case "help":
+        fmt.Fprint(c.out, CHEAT_HELP)
+    default:
+        return fmt.Errorf("unknown command cheat %s; try cheat help", cmd)
+    }
+    return nil
+}
+
+// toggle asks for cheat n, counting from 1, to be turned on or off. It's
+// safe to call from any goroutine.
+func (c *Cheats) toggle(n int) {
+    select {
+    case c.commands <- fmt.Sprintf("cheat toggle %d", n):
+    default:
+    }
+}
@@ -13,25 +13,51 @@ const (
     C   byte = 1 << 0
 )
 
+// How an instruction uses the memory operand its addressing mode points at.
+const (
+    READ_OP = iota
+    WRITE_OP
+    RMW_OP
+)
+
+// XAAMagic is ORed into A by XAA and ATX before they AND in their operands.
+// Real chips differ and even drift with temperature, so there's no right
+// value; 0xff, which leaves A alone, is an arbitrary default.
+var XAAMagic byte = 0xff
+
+// JamError is returned by Machine.Run when the CPU executes a KIL opcode.
+// Like the real chip, it stays jammed until it's reset.
+type JamError struct {
+    PC     uint16
+    Opcode byte
+}
+
+func (e *JamError) String() string {
+    return fmt.Sprintf("cpu jammed by opcode %02X at %04X", e.Opcode, e.PC)
+}
+
 type CPU struct {
     a, x, y, s, p byte
     pc            word
     cycleCount    uint64
-    prevCycles    uint64
     m             *Machine
+    magic         byte
+    jam           *JamError
 }
 
 func makeCPU(m *Machine) *CPU {
-    return &CPU{0, 0, 0, 0, 0x24, 0, 0, 0, m}
+    return &CPU{0, 0, 0, 0, 0x24, 0, 0, m, XAAMagic, nil}
 }
 
 func (c *CPU) regs() string {
-    return fmt.Sprintf("A:%2X X:%2X Y:%2X P:%2X SP:%2X ", c.a, c.x, c.y, c.p, c.s)
+    return fmt.Sprintf("A:%02X X:%02X Y:%02X P:%02X SP:%02X ", c.a, c.x, c.y, c.p, c.s)
 }
 
 func (c *CPU) reset() {
     c.s -= 3
     c.p |= 0x04
+    c.m.logPRG(0xfffc, CDL_DATA)
+    c.m.logPRG(0xfffd, CDL_DATA)
     c.pc = wordFromBytes(c.m.getMem(0xfffd), c.m.getMem(0xfffc))
     //apu stuff
 }
@@ -53,28 +79,41 @@ func (c *CPU) setNZ(val byte) {
     c.setFlag(N, val&0x80 != 0)
 }
 
+// getMem is one read cycle. The bus is sampled before the rest of the
+// machine is clocked and writes below land after it, which is the timing
+// the PPU register code is tuned for.
 func (c *CPU) getMem(addr word) byte {
+    if c.m.dmaHalt {
+        c.m.runDMA(addr)
+    }
     val := c.m.getMem(addr)
-    c.cycleCount++
+    if h := c.m.hooks; h != nil && h.addrs[addr]&BREAK_READ != 0 {
+        val = h.read(addr, val)
+        c.m.dataBus = val
+    }
+    if c.m.tracer != nil {
+        c.m.tracer.access(addr, val, false)
+    }
+    if c.m.debugger != nil {
+        c.m.debugger.access(false, addr, val, BREAK_READ)
+    }
+    c.m.tick()
     return val
 }
 
+// setMem is one write cycle.
 func (c *CPU) setMem(addr word, val byte) {
-    c.cycleCount++
+    c.m.tick()
     c.m.setMem(addr, val)
-}
-
-func (c *CPU) push2(val word) {
-    c.s -= 2
-    var ss word = 0x100
-    c.setMem(ss|word(c.s+1), byte(val&0xff))
-    c.setMem(ss|word(c.s+2), byte(val>>8))
-}
-
-func (c *CPU) pop2() word {
-    c.s += 2
-    var r word = wordFromBytes(c.getMem(word(c.s)|0x100), c.getMem(word((c.s-1)&0xff)|0x100))
-    return r
+    if h := c.m.hooks; h != nil && h.addrs[addr]&BREAK_WRITE != 0 {
+        h.write(addr, val)
+    }
+    if c.m.tracer != nil {
+        c.m.tracer.access(addr, val, true)
+    }
+    if c.m.debugger != nil {
+        c.m.debugger.access(false, addr, val, BREAK_WRITE)
+    }
 }
 
 func (c *CPU) push(val byte) {
@@ -93,43 +132,66 @@ func (c *CPU) readStack() byte {
 
 func (c *CPU) nextByte() byte {
     c.pc++
+    c.m.logPRG(c.pc-1, CDL_CODE)
     return c.getMem(c.pc - 1)
 }
 
-func (c *CPU) nextWordArgs() (word, byte, byte) {
-    lo := c.getMem(c.pc)
-    c.pc++
-    hi := c.getMem(c.pc)
-    c.pc++
-    return wordFromBytes(hi, lo), hi, lo
-}
-
-func (c *CPU) irq() {
-    c.push2(c.pc)
-    c.push(c.p)
-    c.setFlag(I, true)
-    c.pc = wordFromBytes(c.getMem(0xffff), c.getMem(0xfffe))
-    //c.cycleCount += 7
+func (c *CPU) nextWord() word {
+    lo := c.nextByte()
+    hi := c.nextByte()
+    return wordFromBytes(hi, lo)
 }
 
-func (c *CPU) nmi() {
-    c.push2(c.pc)
-    c.push(c.p)
+// interrupt pushes the return address and flags and jumps through the IRQ
+// vector, or the NMI vector if an NMI has arrived by the time the flags are
+// pushed; an NMI can hijack both BRK and IRQ this way. BRK has already spent
+// its first two cycles fetching the opcode and the padding byte; IRQ and NMI
+// spend them on dummy reads instead.
+func (c *CPU) interrupt(brk bool) {
+    if !brk {
+        c.getMem(c.pc)
+        c.getMem(c.pc)
+    }
+    c.push(byte(c.pc >> 8))
+    c.push(byte(c.pc & 0xff))
+    vector := word(0xfffe)
+    if c.m.nmiPending {
+        c.m.nmiPending = false
+        vector = 0xfffa
+    }
+    p := c.p & (^B)
+    if brk {
+        p |= B
+    }
+    c.push(p)
     c.setFlag(I, true)
-    c.pc = wordFromBytes(c.getMem(0xfffb), c.getMem(0xfffa))
-    //c.cycleCount += 7
+    c.m.logPRG(vector, CDL_DATA)
+    c.m.logPRG(vector+1, CDL_DATA)
+    lo := c.getMem(vector)
+    hi := c.getMem(vector + 1)
+    c.pc = wordFromBytes(hi, lo)
+    //the handler's first instruction always runs before another interrupt
+    c.m.nmiPolled = false
 }
 
-func (c *CPU) branch(cond bool, inst *Instruction) {
-    if cond {
-        c.getMem(c.pc)
-        inst.extra_cycles += 1
-        if inst.addr&0xff00 != c.pc&0xff00 {
-            c.getMem((inst.addr & 0xff)|(c.pc & 0xff00))
-            inst.extra_cycles += 1
+func (c *CPU) branch(cond bool) {
+    off := int8(c.nextByte())
+    if !cond {
+        return
+    }
+    target := c.pc + word(off)
+    if target&0xff00 == c.pc&0xff00 {
+        //a taken branch that stays on its page doesn't poll on its last
+        //cycle, so an IRQ that only just arrived waits another instruction
+        if c.m.irqPending && !c.m.irqPolled {
+            c.m.irqPending = false
         }
-        c.pc = inst.addr
     }
+    c.getMem(c.pc) //dummy
+    if target&0xff00 != c.pc&0xff00 {
+        c.getMem((target & 0xff) | (c.pc & 0xff00))
+    }
+    c.pc = target
 }
 
 func (c *CPU) compare(a byte, b byte) {
@@ -140,65 +202,134 @@ func (c *CPU) compare(a byte, b byte) {
     c.setFlag(C, a >= b)
 }
 
-func (c *CPU) runInstruction(inst *Instruction) int {
-    var (
-        m      byte = 0
-        a7     byte = 0
-        m7     byte = 0
-        r7     byte = 0
-        result word = 0
-    )
-    switch inst.op.op {
-    case NOP, DOP, TOP:
-    case JMP:
-        c.pc = inst.addr
-    case JSR:
-        c.push2(c.pc - 1)
-        c.pc = inst.addr
-    case RTS:
-        c.readStack()
-        c.pc = c.pop2() + 1
-        c.getMem(c.pc)
-    case RTI:
-        c.readStack()
-        c.p = (c.pop() | (1 << 5)) & (^B)
-        c.pc = c.pop2()
-        if c.getFlag(I) {
-            c.m.scheduledIRQ = -1
-        } else if c.m.irqWaiting {
-            c.m.scheduledIRQ = 1
+func (c *CPU) adc(operand byte) {
+    a7 := c.a & (1 << 7)
+    m7 := operand & (1 << 7)
+    result := word(c.a) + word(operand)
+    if c.getFlag(C) {
+        result += 1
+    }
+    c.a = byte(result & 0xff)
+    c.setFlag(C, result > 0xff)
+    c.setNZ(c.a)
+    r7 := c.a & (1 << 7)
+    c.setFlag(V, !((a7 != m7) || ((a7 == m7) && (m7 == r7))))
+}
+
+func (c *CPU) sbc(operand byte) {
+    a7 := c.a & (1 << 7)
+    m7 := operand & (1 << 7)
+    result := word(c.a) - word(operand)
+    if !c.getFlag(C) {
+        result -= 1
+    }
+    c.a = byte(result & 0xff)
+    c.setFlag(C, result < 0x100)
+    c.setNZ(c.a)
+    r7 := c.a & (1 << 7)
+    c.setFlag(V, !((a7 == m7) || ((a7 != m7) && (r7 == a7))))
+}
+
+func accessKind(o op) int {
+    switch o {
+    case STA, STX, STY, SAX, SYA, SXA, AXA, XAS:
+        return WRITE_OP
+    case ASL, LSR, ROL, ROR, INC, DEC, SLO, RLA, SRE, RRA, DCP, ISB:
+        return RMW_OP
+    }
+    return READ_OP
+}
+
+// indexed adds index to base the way the 6502 does: the first read goes to
+// the right low byte on the wrong page. Reads that didn't cross a page are
+// done then; everything else gets the address fixed up for another cycle.
+func (c *CPU) indexed(base word, index byte, kind int) (word, byte, bool) {
+    addr := base + word(index)
+    val := c.getMem((base & 0xff00) | (addr & 0xff))
+    if kind == READ_OP && base&0xff00 == addr&0xff00 {
+        return addr, val, true
+    }
+    return addr, 0, false
+}
+
+// address runs the addressing cycles of mode and returns the effective
+// address, plus the operand if indexed already had to read it.
+func (c *CPU) address(mode address_mode, kind int) (addr word, operand byte, fetched bool) {
+    switch mode {
+    case ZP, ZP_ST:
+        addr = word(c.nextByte())
+    case ZPX, ZPY:
+        base := c.nextByte()
+        c.getMem(word(base)) //dummy
+        if mode == ZPX {
+            addr = word(base + c.x)
+        } else {
+            addr = word(base + c.y)
         }
-    case BRK:
-        c.pc += 1
-        c.p |= B
-        c.irq()
-    case BCS:
-        c.branch(c.getFlag(C), inst)
-    case BCC:
-        c.branch(!c.getFlag(C), inst)
-    case BEQ:
-        c.branch(c.getFlag(Z), inst)
-    case BNE:
-        c.branch(!c.getFlag(Z), inst)
-    case BVS:
-        c.branch(c.getFlag(V), inst)
-    case BVC:
-        c.branch(!c.getFlag(V), inst)
-    case BPL:
-        c.branch(!c.getFlag(N), inst)
-    case BMI:
-        c.branch(c.getFlag(N), inst)
-    case BIT:
-        m = inst.operand
-        c.setFlag(N, m&(1<<7) != 0)
-        c.setFlag(V, m&(1<<6) != 0)
-        c.setFlag(Z, (m&c.a) == 0)
-    case CMP:
-        c.compare(c.a, inst.operand)
-    case CPY:
-        c.compare(c.y, inst.operand)
-    case CPX:
-        c.compare(c.x, inst.operand)
+    case ABS, ABS_ST:
+        addr = c.nextWord()
+    case ABSX:
+        return c.indexed(c.nextWord(), c.x, kind)
+    case ABSY:
+        return c.indexed(c.nextWord(), c.y, kind)
+    case IXID:
+        ptr := c.nextByte()
+        c.getMem(word(ptr)) //dummy
+        ptr += c.x
+        lo := c.getMem(word(ptr))
+        hi := c.getMem(word(ptr + 1))
+        addr = wordFromBytes(hi, lo)
+    case IDIX:
+        ptr := c.nextByte()
+        lo := c.getMem(word(ptr))
+        hi := c.getMem(word(ptr + 1))
+        return c.indexed(wordFromBytes(hi, lo), c.y, kind)
+    }
+    return addr, 0, false
+}
+
+// unstableStore handles the stores that AND the value with the high byte
+// of the base address plus one. When indexing crosses a page that value
+// also replaces the high byte of the address written to.
+func (c *CPU) unstableStore(o op, mode address_mode) {
+    var base word
+    var index byte
+    switch mode {
+    case ABSX:
+        base, index = c.nextWord(), c.x
+    case ABSY:
+        base, index = c.nextWord(), c.y
+    case IDIX:
+        ptr := c.nextByte()
+        lo := c.getMem(word(ptr))
+        hi := c.getMem(word(ptr + 1))
+        base, index = wordFromBytes(hi, lo), c.y
+    }
+    addr := base + word(index)
+    c.getMem((base & 0xff00) | (addr & 0xff)) //dummy
+    h := byte(base>>8) + 1
+    var val byte
+    switch o {
+    case SYA:
+        val = c.y & h
+    case SXA:
+        val = c.x & h
+    case AXA:
+        val = c.a & c.x & h
+    case XAS:
+        c.s = c.a & c.x
+        val = c.s & h
+    }
+    if base&0xff00 != addr&0xff00 {
+        addr = (word(val) << 8) | (addr & 0xff)
+    }
+    c.setMem(addr, val)
+}
+
+// execImplied runs an instruction that has no operand.
+func (c *CPU) execImplied(o op) {
+    switch o {
+    case NOP:
     case CLC:
         c.setFlag(C, false)
     case CLD:
@@ -213,145 +344,93 @@ func (c *CPU) runInstruction(inst *Instruction) int {
         c.setFlag(C, true)
     case SEI:
         c.setFlag(I, true)
+    case INX:
+        c.x += 1
+        c.setNZ(c.x)
+    case INY:
+        c.y += 1
+        c.setNZ(c.y)
+    case DEX:
+        c.x -= 1
+        c.setNZ(c.x)
+    case DEY:
+        c.y -= 1
+        c.setNZ(c.y)
+    case TSX:
+        c.x = c.s
+        c.setNZ(c.x)
+    case TXS:
+        c.s = c.x
+    case TYA:
+        c.a = c.y
+        c.setNZ(c.a)
+    case TXA:
+        c.a = c.x
+        c.setNZ(c.a)
+    case TAY:
+        c.y = c.a
+        c.setNZ(c.y)
+    case TAX:
+        c.x = c.a
+        c.setNZ(c.x)
+    default:
+        fmt.Printf("Unsupported opcode! %d", int(o))
+        os.Exit(1)
+    }
+}
+
+// execRead runs an instruction that only reads its operand.
+func (c *CPU) execRead(o op, operand byte) {
+    var result word
+    switch o {
+    case NOP, DOP, TOP:
+    case BIT:
+        c.setFlag(N, operand&(1<<7) != 0)
+        c.setFlag(V, operand&(1<<6) != 0)
+        c.setFlag(Z, (operand&c.a) == 0)
+    case CMP:
+        c.compare(c.a, operand)
+    case CPY:
+        c.compare(c.y, operand)
+    case CPX:
+        c.compare(c.x, operand)
     case LDA:
-        c.a = inst.operand
+        c.a = operand
         c.setNZ(c.a)
-    case STA:
-        c.setMem(inst.addr, c.a)
     case LDX:
-        c.x = inst.operand
+        c.x = operand
         c.setNZ(c.x)
-    case STX:
-        c.setMem(inst.addr, c.x)
     case LDY:
-        c.y = inst.operand
+        c.y = operand
         c.setNZ(c.y)
-    case STY:
-        c.setMem(inst.addr, c.y)
     case LAX:
-        c.a = inst.operand
-        c.x = inst.operand
-        c.setNZ(c.a)
-    case SAX:
-        c.setMem(inst.addr, c.a&c.x)
-    case PHP:
-        c.push(c.p | B)
-    case PLP:
-        c.readStack()
-        c.p = (c.pop() | (1 << 5)) & (^B)
-    case PLA:
-        c.readStack()
-        c.a = c.pop()
+        c.a = operand
+        c.x = operand
         c.setNZ(c.a)
-    case PHA:
-        c.push(c.a)
     case AND:
-        c.a &= inst.operand
+        c.a &= operand
         c.setNZ(c.a)
     case AAC:
-        c.a &= inst.operand
+        c.a &= operand
         c.setNZ(c.a)
         c.setFlag(C, c.a&0x80 != 0)
     case ORA:
-        c.a |= inst.operand
+        c.a |= operand
         c.setNZ(c.a)
     case EOR:
-        c.a ^= inst.operand
+        c.a ^= operand
         c.setNZ(c.a)
     case ADC:
-        a7 = c.a & (1 << 7)
-        m7 = inst.operand & (1 << 7)
-        result = word(c.a) + word(inst.operand)
-        if c.getFlag(C) {
-            result += 1
-        }
-        c.a = byte(result & 0xff)
-        c.setFlag(C, result > 0xff)
-        c.setNZ(c.a)
-        r7 = c.a & (1 << 7)
-        c.setFlag(V, !((a7 != m7) || ((a7 == m7) && (m7 == r7))))
+        c.adc(operand)
     case SBC:
-        a7 = c.a & (1 << 7)
-        m7 = inst.operand & (1 << 7)
-        result = word(c.a) - word(inst.operand)
-        if !c.getFlag(C) {
-            result -= 1
-        }
-        c.a = byte(result & 0xff)
-        c.setFlag(C, result < 0x100)
-        c.setNZ(c.a)
-        r7 = c.a & (1 << 7)
-        c.setFlag(V, !((a7 == m7) || ((a7 != m7) && (r7 == a7))))
-    case INX:
-        c.x += 1
-        c.setNZ(c.x)
-    case INY:
-        c.y += 1
-        c.setNZ(c.y)
-    case DEX:
-        c.x -= 1
-        c.setNZ(c.x)
-    case DEY:
-        c.y -= 1
-        c.setNZ(c.y)
-    case INC:
-        c.setMem(inst.addr, inst.operand)
-        inst.operand += 1
-        inst.operand &= 0xff
-        c.setNZ(inst.operand)
-        c.setMem(inst.addr, inst.operand)
-    case DEC:
-        c.setMem(inst.addr, inst.operand)
-        inst.operand -= 1
-        inst.operand &= 0xff
-        c.setNZ(inst.operand)
-        c.setMem(inst.addr, inst.operand)
-    case DCP:
-        c.setMem(inst.addr, inst.operand)
-        c.setMem(inst.addr, (inst.operand-1)&0xff)
-        c.compare(c.a, (inst.operand-1)&0xff)
-    case ISB:
-        c.setMem(inst.addr, inst.operand)
-        inst.operand = (inst.operand + 1) & 0xff
-        c.setMem(inst.addr, inst.operand)
-        a7 = c.a & (1 << 7)
-        m7 = inst.operand & (1 << 7)
-        result = word(c.a) - word(inst.operand)
-        if !c.getFlag(C) {
-            result -= 1
-        }
-        c.a = byte(result & 0xff)
-        c.setFlag(C, result < 0x100)
-        c.setNZ(c.a)
-        r7 = c.a & (1 << 7)
-        c.setFlag(V, !((a7 == m7) || ((a7 != m7) && (r7 == a7))))
-    case LSR_A:
-        c.setFlag(C, c.a&1 != 0)
-        c.a >>= 1
-        c.setNZ(c.a)
-    case LSR:
-        c.setFlag(C, inst.operand&1 != 0)
-        c.setMem(inst.addr, inst.operand) //dummy
-        inst.operand >>= 1
-        c.setMem(inst.addr, inst.operand)
-        c.setNZ(inst.operand)
-    case ASL_A:
-        c.setFlag(C, c.a&(1<<7) != 0)
-        c.a <<= 1
-        c.setNZ(c.a)
-    case ASL:
-        c.setFlag(C, inst.operand&(1<<7) != 0)
-        c.setMem(inst.addr, inst.operand) //dummy
-        inst.operand <<= 1
-        c.setMem(inst.addr, inst.operand)
-        c.setNZ(inst.operand)
+        c.sbc(operand)
     case ASR:
-        c.a &= inst.operand
+        c.a &= operand
         c.setFlag(C, c.a&1 != 0)
         c.a >>= 1
         c.setNZ(c.a)
     case ARR:
-        c.a &= inst.operand
+        c.a &= operand
         c.a >>= 1
         if c.getFlag(C) {
             c.a |= 0x80
@@ -359,139 +438,219 @@ func (c *CPU) runInstruction(inst *Instruction) int {
         c.setFlag(C, c.a&(1<<6) != 0)
         c.setFlag(V, ((c.a&(1<<5))<<1)^(c.a&(1<<6)) != 0)
         c.setNZ(c.a)
-    case TSX:
-        c.x = c.s
-        c.setNZ(c.x)
-    case TXS:
-        c.s = c.x
-    case TYA:
-        c.a = c.y
-        c.setNZ(c.a)
-    case TXA:
-        c.a = c.x
-        c.setNZ(c.a)
     case ATX:
-        c.a |= 0xff
-        c.a &= inst.operand
+        c.a = (c.a | c.magic) & operand
         c.x = c.a
         c.setNZ(c.x)
+    case XAA:
+        c.a = (c.a | c.magic) & c.x & operand
+        c.setNZ(c.a)
+    case LAR:
+        c.s &= operand
+        c.a = c.s
+        c.x = c.s
+        c.setNZ(c.a)
     case AXS:
         c.x = c.a & c.x
-        result = word(c.x) - word(inst.operand)
+        result = word(c.x) - word(operand)
         c.setFlag(C, result < 0x100)
         c.x = byte(result & 0xff)
         c.setNZ(c.x)
-    case SYA:
-        m = c.y & (inst.args[1] + 1)
-        if inst.extra_cycles == 0 {
-            c.setMem(inst.addr, m)
-        } else {
-            inst.extra_cycles = 0
-        }
-    case SXA:
-        m = c.x & (inst.args[1] + 1)
-        if inst.extra_cycles == 0 {
-            c.setMem(inst.addr, m)
-        } else {
-            inst.extra_cycles = 0
-        }
-    case ROR_A:
-        m = c.a & 1
-        c.a >>= 1
-        if c.getFlag(C) {
-            c.a |= 1 << 7
-        }
-        c.setFlag(C, m != 0)
-        c.setNZ(c.a)
-    case ROR:
-        m = inst.operand & 1
-        c.setMem(inst.addr, inst.operand) //dummy
-        inst.operand >>= 1
-        if c.getFlag(C) {
-            inst.operand |= 1 << 7
-        }
-        c.setFlag(C, m != 0)
-        c.setMem(inst.addr, inst.operand)
-        c.setNZ(inst.operand)
-    case ROL_A:
-        m = c.a & (1 << 7)
-        c.a <<= 1
+    default:
+        fmt.Printf("Unsupported opcode! %d", int(o))
+        os.Exit(1)
+    }
+}
+
+// storeValue returns what a store instruction writes.
+func (c *CPU) storeValue(o op) byte {
+    switch o {
+    case STX:
+        return c.x
+    case STY:
+        return c.y
+    case SAX:
+        return c.a & c.x
+    }
+    return c.a
+}
+
+// modify runs a read-modify-write instruction on val and returns the value
+// to write back. The accumulator forms use it too.
+func (c *CPU) modify(o op, val byte) byte {
+    m := byte(0)
+    switch o {
+    case ASL, ASL_A:
+        c.setFlag(C, val&(1<<7) != 0)
+        val <<= 1
+        c.setNZ(val)
+    case LSR, LSR_A:
+        c.setFlag(C, val&1 != 0)
+        val >>= 1
+        c.setNZ(val)
+    case ROL, ROL_A:
+        m = val & (1 << 7)
+        val <<= 1
         if c.getFlag(C) {
-            c.a |= 1
+            val |= 1
         }
         c.setFlag(C, m != 0)
-        c.setNZ(c.a)
-    case ROL:
-        m = inst.operand & (1 << 7)
-        c.setMem(inst.addr, inst.operand) //dummy
-        inst.operand <<= 1
+        c.setNZ(val)
+    case ROR, ROR_A:
+        m = val & 1
+        val >>= 1
         if c.getFlag(C) {
-            inst.operand |= 1
+            val |= 1 << 7
         }
         c.setFlag(C, m != 0)
-        c.setMem(inst.addr, inst.operand)
-        c.setNZ(inst.operand)
-    case TAY:
-        c.y = c.a
-        c.setNZ(c.y)
-    case TAX:
-        c.x = c.a
-        c.setNZ(c.x)
+        c.setNZ(val)
+    case INC:
+        val += 1
+        c.setNZ(val)
+    case DEC:
+        val -= 1
+        c.setNZ(val)
+    case DCP:
+        val -= 1
+        c.compare(c.a, val)
+    case ISB:
+        val += 1
+        c.sbc(val)
     case RLA:
-        m = inst.operand & (1 << 7)
-        c.setMem(inst.addr, inst.operand)
-        inst.operand <<= 1
-        if c.getFlag(C) {
-            inst.operand |= 1
-        }
-        c.setFlag(C, m != 0)
-        c.setMem(inst.addr, inst.operand)
-        c.a &= inst.operand
+        val = c.modify(ROL, val)
+        c.a &= val
         c.setNZ(c.a)
     case SLO:
-        c.setFlag(C, inst.operand&(1<<7) != 0)
-        c.setMem(inst.addr, inst.operand)
-        inst.operand <<= 1
-        c.setMem(inst.addr, inst.operand)
-        c.a |= inst.operand
+        val = c.modify(ASL, val)
+        c.a |= val
         c.setNZ(c.a)
     case SRE:
-        c.setFlag(C, inst.operand&1 != 0)
-        c.setMem(inst.addr, inst.operand)
-        inst.operand >>= 1
-        c.setMem(inst.addr, inst.operand)
-        c.a ^= inst.operand
+        val = c.modify(LSR, val)
+        c.a ^= val
         c.setNZ(c.a)
     case RRA:
-        m = inst.operand & 1
-        c.setMem(inst.addr, inst.operand)
-        inst.operand >>= 1
-        if c.getFlag(C) {
-            inst.operand |= 1 << 7
-        }
-        c.setMem(inst.addr, inst.operand)
-        a7 = c.a & (1 << 7)
-        m7 = inst.operand & (1 << 7)
-        result = word(c.a) + word(inst.operand)
-        if m != 0 {
-            result += 1
-        }
-        c.a = byte(result & 0xff)
-        c.setFlag(C, result > 0xff)
+        val = c.modify(ROR, val)
+        c.adc(val)
+    }
+    return val
+}
+
+// step runs the next instruction a bus cycle at a time, in the order the
+// 6502 makes its reads and writes, and returns how many cycles it took.
+func (c *CPU) step() int {
+    start := c.cycleCount
+    opcode := c.nextByte()
+    op := Opcodes[opcode]
+    switch op.op {
+    case BRK:
+        c.nextByte()
+        c.interrupt(true)
+    case JSR:
+        lo := c.nextByte()
+        c.readStack() //dummy
+        c.push(byte(c.pc >> 8))
+        c.push(byte(c.pc & 0xff))
+        c.m.logPRG(c.pc, CDL_CODE)
+        hi := c.getMem(c.pc)
+        c.pc = wordFromBytes(hi, lo)
+    case RTS:
+        c.getMem(c.pc) //dummy
+        c.readStack()  //dummy
+        lo := c.pop()
+        hi := c.pop()
+        c.pc = wordFromBytes(hi, lo)
+        c.getMem(c.pc) //dummy
+        c.pc++
+    case RTI:
+        c.getMem(c.pc) //dummy
+        c.readStack()  //dummy
+        c.p = (c.pop() | (1 << 5)) & (^B)
+        lo := c.pop()
+        hi := c.pop()
+        c.pc = wordFromBytes(hi, lo)
+    case PHA:
+        c.getMem(c.pc) //dummy
+        c.push(c.a)
+    case PHP:
+        c.getMem(c.pc) //dummy
+        c.push(c.p | B)
+    case PLA:
+        c.getMem(c.pc) //dummy
+        c.readStack()  //dummy
+        c.a = c.pop()
         c.setNZ(c.a)
-        r7 = c.a & (1 << 7)
-        c.setFlag(V, !((a7 != m7) || ((a7 == m7) && (m7 == r7))))
-    //unclear instructions
-    case XAA:
-    case AXA:
-    case XAS:
-    case LAR:
+    case PLP:
+        c.getMem(c.pc) //dummy
+        c.readStack()  //dummy
+        c.p = (c.pop() | (1 << 5)) & (^B)
+    case JMP:
+        if op.addr_mode == ABSI {
+            ptr := c.nextWord()
+            hiPtr := (ptr & 0xff00) | ((ptr + 1) & 0xff)
+            c.m.logPRG(ptr, CDL_DATA)
+            c.m.logPRG(hiPtr, CDL_DATA)
+            lo := c.getMem(ptr)
+            hi := c.getMem(hiPtr)
+            c.pc = wordFromBytes(hi, lo)
+            c.m.logPRG(c.pc, CDL_INDIRECT_CODE)
+        } else {
+            c.pc = c.nextWord()
+        }
+    case BCS:
+        c.branch(c.getFlag(C))
+    case BCC:
+        c.branch(!c.getFlag(C))
+    case BEQ:
+        c.branch(c.getFlag(Z))
+    case BNE:
+        c.branch(!c.getFlag(Z))
+    case BVS:
+        c.branch(c.getFlag(V))
+    case BVC:
+        c.branch(!c.getFlag(V))
+    case BPL:
+        c.branch(!c.getFlag(N))
+    case BMI:
+        c.branch(c.getFlag(N))
+    case SYA, SXA, AXA, XAS:
+        c.unstableStore(op.op, op.addr_mode)
+    case KIL:
+        c.getMem(c.pc) //dummy
+        c.jam = &JamError{uint16(c.pc - 1), opcode}
     default:
-        fmt.Printf("Unsupported opcode! %d", int(inst.op.op))
-        os.Exit(1);
+        switch op.addr_mode {
+        case IMP:
+            c.getMem(c.pc) //dummy
+            c.execImplied(op.op)
+        case A:
+            c.getMem(c.pc) //dummy
+            c.a = c.modify(op.op, c.a)
+        case IMM:
+            c.execRead(op.op, c.nextByte())
+        default:
+            kind := accessKind(op.op)
+            addr, val, fetched := c.address(op.addr_mode, kind)
+            if kind != WRITE_OP && c.m.cdl != nil {
+                flags := byte(CDL_DATA)
+                if op.addr_mode == IXID || op.addr_mode == IDIX {
+                    flags |= CDL_INDIRECT_DATA
+                }
+                c.m.logPRG(addr, flags)
+            }
+            switch kind {
+            case READ_OP:
+                if !fetched {
+                    val = c.getMem(addr)
+                }
+                c.execRead(op.op, val)
+            case WRITE_OP:
+                c.setMem(addr, c.storeValue(op.op))
+            case RMW_OP:
+                val = c.getMem(addr)
+                c.setMem(addr, val) //dummy
+                c.setMem(addr, c.modify(op.op, val))
+            }
+        }
     }
-    //c.cycleCount += uint64(inst.op.cycles + inst.extra_cycles)
-    instCycles := int(c.cycleCount - c.prevCycles)
-    c.prevCycles = c.cycleCount
-    return instCycles
+    return int(c.cycleCount - start)
 }
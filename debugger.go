@@ -0,0 +1,579 @@
+package gones
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Kinds of breakpoint, which can be ORed together.
+const (
+    BREAK_EXEC  = 1
+    BREAK_READ  = 2
+    BREAK_WRITE = 4
+)
+
+const DEBUGGER_HELP = `Addresses, bytes and register values are hex, counts and scanlines are
+decimal, and in conditions hex is written $ff or 0xff. With symbols loaded,
+a name can stand for an address anywhere; write $ in front of hex that
+could be taken for one.
+  b [bank:]addr [if cond]       break when the CPU reaches addr; a name in
+                                PRG ROM breaks in its own bank only
+  w r|w|rw [ppu:]lo[-hi] [if cond]
+                                break after a read or write; conditions can
+                                use addr and value
+  bl                            list breakpoints
+  del n, dis n, en n            delete, disable or enable breakpoint n
+  c                             continue
+  s [n]                         step n instructions
+  n                             step over a JSR
+  out                           run until the current subroutine returns
+  sl n                          run to scanline n (-1 or 261 is pre-render)
+  p                             pause (while running)
+  r                             show registers
+  set a|x|y|s|p|pc value        change a register
+  m [ppu:]addr [len]            dump memory
+  e [ppu:]addr byte...          edit memory; CPU writes have their usual
+                                effects on registers
+  d [addr] [n]                  disassemble n instructions
+  An empty line repeats the last command.
+`
+
+type breakpoint struct {
+    id      int
+    kind    int
+    ppu     bool
+    lo, hi  word
+    bank    int //-1 for any bank
+    offset  int //PRG ROM offset to break at instead of lo, or -1
+    cond    expr
+    text    string
+    enabled bool
+}
+
+// A Debugger is a console for stopping and inspecting a running machine.
+// It reads commands a line at a time from a channel and runs them on the
+// emulation goroutine between instructions, so it never sees the machine
+// half way through anything. A command that arrives while the machine is
+// running pauses it first. Other front ends, like the GDB server, get the
+// same treatment through do.
+type Debugger struct {
+    m        *Machine
+    commands chan string
+    calls    chan func() bool
+    call     func() bool //a call that paused the machine, to run once stopped
+    onStop   func(reason string)
+    out      io.Writer
+    breaks   []*breakpoint
+    nextID   int
+    last     string //the last command, which an empty line repeats
+    pending  string //a command that paused the machine, to run once stopped
+    hit      string //why a watchpoint wants to stop, set during an instruction
+    hitAddr  word
+    hitKind  int
+    //how to run until the next stop
+    steps    int //stop after this many more instructions
+    overPC   int //stop here once S is back to overS, or -1
+    overS    byte
+    outS     int //stop once an RTS or RTI takes S above this, or -1
+    scanline int //stop on reaching this scanline, or -1
+    lastSL   int
+    lastOp   byte
+}
+
+// StartDebugger attaches a debugger that reads commands from commands, if
+// it isn't nil, and writes to out. The machine stops before its next
+// instruction, which is its first if Run hasn't been called yet.
+func (m *Machine) StartDebugger(commands chan string, out io.Writer) *Debugger {
+    d := &Debugger{m: m, commands: commands, calls: make(chan func() bool), out: out, nextID: 1}
+    d.run()
+    d.hit = "attached"
+    m.debugger = d
+    return d
+}
+
+// Pause stops the machine before its next instruction.
+func (d *Debugger) Pause() {
+    go func() {
+        select {
+        case d.calls <- func() bool { return false }:
+        case <-d.m.done:
+        }
+    }()
+}
+
+// do runs f on the emulation goroutine with the machine stopped, pausing it
+// if it's running, and waits for it. f returns whether to carry on running.
+// do returns false without running f if Run has returned, as it does when
+// the CPU jams.
+func (d *Debugger) do(f func() bool) bool {
+    done := make(chan bool)
+    select {
+    case d.calls <- func() bool {
+        resume := f()
+        done <- true
+        return resume
+    }:
+    case <-d.m.done:
+        return false
+    }
+    <-done
+    return true
+}
+
+// run clears whatever the last run command asked for.
+func (d *Debugger) run() {
+    d.steps = 0
+    d.overPC = -1
+    d.outS = -1
+    d.scanline = -1
+}
+
+// check runs before each instruction and stops if something wants to.
+func (d *Debugger) check() {
+    m := d.m
+    c := m.cpu
+    reason := d.hit
+    d.hit = ""
+    select {
+    case line := <-d.commands:
+        reason = "paused"
+        if l := strings.TrimSpace(line); l != "p" && l != "" {
+            d.pending = line
+        }
+    case f := <-d.calls:
+        reason = "paused"
+        d.call = f
+    default:
+    }
+    sl, _ := m.ppu.position()
+    switch true {
+    case reason != "":
+    case d.steps > 0:
+        d.steps--
+        if d.steps == 0 {
+            reason = "step"
+        }
+    case d.overPC >= 0 && int(c.pc) == d.overPC && c.s >= d.overS:
+        reason = "step over"
+    case d.outS >= 0 && (d.lastOp == 0x60 || d.lastOp == 0x40) && int(c.s) > d.outS:
+        reason = "step out"
+    case d.scanline >= 0 && sl == d.scanline && d.lastSL != d.scanline:
+        reason = fmt.Sprintf("scanline %d", sl)
+    }
+    if reason == "" {
+        bank := int(m.bankPC(c.pc) >> 16)
+        offset := -1
+        if c.pc >= 0x8000 {
+            offset = m.rom.prgOffset(c.pc)
+        }
+        for _, b := range d.breaks {
+            at := c.pc >= b.lo && c.pc <= b.hi && (b.bank < 0 || b.bank == bank)
+            if b.offset >= 0 {
+                at = b.offset == offset
+            }
+            if b.enabled && b.kind&BREAK_EXEC != 0 && at && d.test(b, int(c.pc), 0) {
+                reason = fmt.Sprintf("breakpoint %d", b.id)
+                break
+            }
+        }
+    }
+    if reason != "" {
+        d.stop(reason)
+    }
+    d.lastSL = sl
+    d.lastOp = m.peekMem(c.pc)
+}
+
+func (d *Debugger) test(b *breakpoint, addr int, value int) bool {
+    return b.cond == nil || b.cond(&exprEnv{d.m, addr, value}) != 0
+}
+
+// access is told about every CPU memory access and every PPU access through
+// $2007, and sets off matching watchpoints once the instruction finishes.
+func (d *Debugger) access(ppu bool, addr word, val byte, kind int) {
+    for _, b := range d.breaks {
+        if b.enabled && b.kind&kind != 0 && b.ppu == ppu && addr >= b.lo && addr <= b.hi &&
+            d.test(b, int(addr), int(val)) {
+            what := "read"
+            if kind == BREAK_WRITE {
+                what = "write"
+            }
+            space := ""
+            if ppu {
+                space = "ppu:"
+            }
+            d.hit = fmt.Sprintf("watchpoint %d: %s %s%04X = %02X", b.id, what, space, addr, val)
+            d.hitAddr, d.hitKind = addr, kind
+            return
+        }
+    }
+}
+
+// stop runs commands and calls until one of them sets the machine going
+// again.
+func (d *Debugger) stop(reason string) {
+    d.run()
+    fmt.Fprintf(d.out, "%s\n%s%s%s\n", reason, d.label(d.m.cpu.pc), d.m.traceLine(true), d.source(d.m.cpu.pc))
+    if d.onStop != nil {
+        d.onStop(reason)
+    }
+    prompt := true
+    for true {
+        line := d.pending
+        d.pending = ""
+        f := d.call
+        d.call = nil
+        if line == "" && f == nil {
+            if prompt && d.commands != nil {
+                fmt.Fprintf(d.out, "> ")
+            }
+            prompt = false
+            select {
+            case line = <-d.commands:
+            case f = <-d.calls:
+            }
+        }
+        if f != nil {
+            if f() {
+                break
+            }
+            continue
+        }
+        prompt = true
+        line = strings.TrimSpace(line)
+        if line == "" {
+            line = d.last
+        }
+        d.last = line
+        resume, err := d.exec(line)
+        if err != nil {
+            fmt.Fprintf(d.out, "%v\n", err)
+        }
+        if resume {
+            break
+        }
+    }
+}
+
+// label gives a line naming pc, if it has a name.
+func (d *Debugger) label(pc word) string {
+    if name, ok := d.m.symbolAt(pc); ok {
+        return name + ":\n"
+    }
+    return ""
+}
+
+// source gives a comment with the source line of the code at pc, if it's
+// known.
+func (d *Debugger) source(pc word) string {
+    if l, ok := d.m.sourceAt(d.m.bankPC(pc)); ok {
+        return "  ; " + l.String()
+    }
+    return ""
+}
+
+// parseAddr parses a hex address or a symbol's name, with an optional ppu:
+// in front. Hex can have a $ in front, which also stops it being taken for
+// a name. A name in PRG ROM gives where its bank is mapped now.
+func (m *Machine) parseAddr(s string) (word, bool, os.Error) {
+    ppu := strings.HasPrefix(strings.ToLower(s), "ppu:")
+    if ppu {
+        s = s[4:]
+    }
+    if sym, ok := m.lookup(s); ok && !ppu {
+        if addr, ok := m.symbolAddr(sym); ok {
+            return addr, false, nil
+        }
+        return 0, false, fmt.Errorf("%s's bank isn't mapped", s)
+    }
+    n, err := parseHex(s)
+    return word(n), ppu, err
+}
+
+// lookup finds a symbol by name, unless s is written as hex with a $.
+func (m *Machine) lookup(s string) (*symbol, bool) {
+    if m.symbols == nil || strings.HasPrefix(s, "$") {
+        return nil, false
+    }
+    return m.symbols.lookup(s)
+}
+
+func parseHex(s string) (int, os.Error) {
+    if strings.HasPrefix(s, "$") {
+        s = s[1:]
+    }
+    n, err := strconv.Btoui64(s, 16)
+    if err != nil || n > 0xffff {
+        return 0, fmt.Errorf("bad number %s", s)
+    }
+    return int(n), nil
+}
+
+// parseCondition splits an "if cond" off the end of a command's arguments.
+func parseCondition(args []string, syms *Symbols) ([]string, expr, string, os.Error) {
+    for i, a := range args {
+        if a == "if" {
+            text := strings.Join(args[i+1:], " ")
+            cond, err := parseExpr(text, syms)
+            return args[:i], cond, text, err
+        }
+    }
+    return args, nil, "", nil
+}
+
+// findBreakpoint finds breakpoint n.
+func (d *Debugger) findBreakpoint(arg string) (*breakpoint, os.Error) {
+    id, err := strconv.Atoi(arg)
+    if err == nil {
+        for _, b := range d.breaks {
+            if b.id == id {
+                return b, nil
+            }
+        }
+    }
+    return nil, fmt.Errorf("no breakpoint %s", arg)
+}
+
+func (d *Debugger) addBreakpoint(b *breakpoint) {
+    b.id = d.nextID
+    b.enabled = true
+    d.nextID++
+    d.breaks = append(d.breaks, b)
+    fmt.Fprintf(d.out, "breakpoint %d: %s\n", b.id, b.text)
+}
+
+// exec runs a command, returning whether the machine should carry on.
+func (d *Debugger) exec(line string) (bool, os.Error) {
+    m := d.m
+    c := m.cpu
+    f := strings.Fields(line)
+    if len(f) == 0 {
+        return false, nil
+    }
+    args, cond, condText, err := parseCondition(f[1:], m.symbols)
+    if err != nil {
+        return false, err
+    }
+    if cond != nil && f[0] != "b" && f[0] != "break" && f[0] != "w" && f[0] != "watch" {
+        return false, fmt.Errorf("%s doesn't take a condition (%s)", f[0], condText)
+    }
+    switch f[0] {
+    case "h", "help":
+        fmt.Fprint(d.out, DEBUGGER_HELP)
+    case "b", "break":
+        if len(args) != 1 {
+            return false, os.NewError("usage: b [bank:]addr [if cond]")
+        }
+        b := &breakpoint{kind: BREAK_EXEC, bank: -1, offset: -1, cond: cond, text: line}
+        a := args[0]
+        if sym, ok := d.m.lookup(a); ok && sym.offset >= 0 {
+            b.offset = sym.offset
+            d.addBreakpoint(b)
+            break
+        }
+        if i := strings.Index(a, ":"); i >= 0 {
+            if b.bank, err = parseHex(a[:i]); err != nil {
+                return false, err
+            }
+            a = a[i+1:]
+        }
+        if b.lo, _, err = d.m.parseAddr(a); err != nil {
+            return false, err
+        }
+        b.hi = b.lo
+        d.addBreakpoint(b)
+    case "w", "watch":
+        if len(args) != 2 {
+            return false, os.NewError("usage: w r|w|rw [ppu:]lo[-hi] [if cond]")
+        }
+        b := &breakpoint{bank: -1, offset: -1, cond: cond, text: line}
+        switch args[0] {
+        case "r":
+            b.kind = BREAK_READ
+        case "w":
+            b.kind = BREAK_WRITE
+        case "rw":
+            b.kind = BREAK_READ | BREAK_WRITE
+        default:
+            return false, fmt.Errorf("watch r, w or rw, not %s", args[0])
+        }
+        r := strings.Split(args[1], "-")
+        if b.lo, b.ppu, err = d.m.parseAddr(r[0]); err != nil {
+            return false, err
+        }
+        b.hi = b.lo
+        if len(r) > 1 {
+            if b.hi, _, err = d.m.parseAddr(r[1]); err != nil {
+                return false, err
+            }
+        }
+        d.addBreakpoint(b)
+    case "bl":
+        for _, b := range d.breaks {
+            state := ""
+            if !b.enabled {
+                state = " (disabled)"
+            }
+            fmt.Fprintf(d.out, "%d: %s%s\n", b.id, b.text, state)
+        }
+    case "del", "dis", "en":
+        if len(args) != 1 {
+            return false, fmt.Errorf("usage: %s n", f[0])
+        }
+        b, err := d.findBreakpoint(args[0])
+        if err != nil {
+            return false, err
+        }
+        switch f[0] {
+        case "del":
+            for i, o := range d.breaks {
+                if o == b {
+                    d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+                    break
+                }
+            }
+        case "dis":
+            b.enabled = false
+        case "en":
+            b.enabled = true
+        }
+    case "c", "continue":
+        return true, nil
+    case "s", "step":
+        d.steps = 1
+        if len(args) > 0 {
+            if d.steps, err = strconv.Atoi(args[0]); err != nil || d.steps < 1 {
+                d.steps = 0
+                return false, fmt.Errorf("bad count %s", args[0])
+            }
+        }
+        return true, nil
+    case "n", "next":
+        if m.peekMem(c.pc) == 0x20 {
+            d.overPC = int(c.pc + 3)
+            d.overS = c.s
+        } else {
+            d.steps = 1
+        }
+        return true, nil
+    case "out":
+        d.outS = int(c.s)
+        return true, nil
+    case "sl":
+        if len(args) != 1 {
+            return false, os.NewError("usage: sl n")
+        }
+        if d.scanline, err = strconv.Atoi(args[0]); err != nil || d.scanline < -1 || d.scanline > 261 {
+            d.scanline = -1
+            return false, fmt.Errorf("bad scanline %s", args[0])
+        }
+        if d.scanline == -1 {
+            d.scanline = 261
+        }
+        return true, nil
+    case "r", "regs":
+        sl, dot := m.ppu.position()
+        fmt.Fprintf(d.out, "PC:%04X %sNV-BDIZC:%08b\n", c.pc, c.regs(), c.p)
+        fmt.Fprintf(d.out, "scanline %d dot %d frame %d cycle %d bank %02X\n", sl, dot,
+            m.ppu.frameCounter, c.cycleCount, m.bankPC(c.pc)>>16)
+    case "set":
+        if len(args) != 2 {
+            return false, os.NewError("usage: set a|x|y|s|p|pc value")
+        }
+        n, err := parseHex(args[1])
+        if err != nil {
+            return false, err
+        }
+        switch args[0] {
+        case "a":
+            c.a = byte(n)
+        case "x":
+            c.x = byte(n)
+        case "y":
+            c.y = byte(n)
+        case "s":
+            c.s = byte(n)
+        case "p":
+            c.p = byte(n)
+        case "pc":
+            c.pc = word(n)
+        default:
+            return false, fmt.Errorf("no register %s", args[0])
+        }
+    case "m", "mem":
+        if len(args) < 1 {
+            return false, os.NewError("usage: m [ppu:]addr [len]")
+        }
+        addr, ppu, err := d.m.parseAddr(args[0])
+        if err != nil {
+            return false, err
+        }
+        n := 64
+        if len(args) > 1 {
+            if n, err = strconv.Atoi(args[1]); err != nil {
+                return false, err
+            }
+        }
+        for i := 0; i < n; i++ {
+            a := addr + word(i)
+            if i%16 == 0 {
+                fmt.Fprintf(d.out, "%04X:", a)
+            }
+            if ppu {
+                fmt.Fprintf(d.out, " %02X", m.ppu.peekMem(a))
+            } else {
+                fmt.Fprintf(d.out, " %02X", m.peekMem(a))
+            }
+            if i%16 == 15 || i == n-1 {
+                fmt.Fprintf(d.out, "\n")
+            }
+        }
+    case "e", "edit":
+        if len(args) < 2 {
+            return false, os.NewError("usage: e [ppu:]addr byte...")
+        }
+        addr, ppu, err := d.m.parseAddr(args[0])
+        if err != nil {
+            return false, err
+        }
+        for i, s := range args[1:] {
+            n, err := parseHex(s)
+            if err != nil || n > 0xff {
+                return false, fmt.Errorf("bad byte %s", s)
+            }
+            if ppu {
+                if err := m.ppu.pokeMem(addr+word(i), byte(n)); err != nil {
+                    return false, err
+                }
+            } else {
+                m.setMem(addr+word(i), byte(n))
+            }
+        }
+    case "d", "disasm":
+        pc := c.pc
+        n := 10
+        if len(args) > 0 {
+            if pc, _, err = d.m.parseAddr(args[0]); err != nil {
+                return false, err
+            }
+        }
+        if len(args) > 1 {
+            if n, err = strconv.Atoi(args[1]); err != nil {
+                return false, err
+            }
+        }
+        for i := 0; i < n; i++ {
+            in := c.decode(pc)
+            text := strings.TrimRight(in.listing(in.TextWith(m.operandNames())), " ")
+            fmt.Fprintf(d.out, "%s%04X  %s%s\n", d.label(pc), pc, text, d.source(pc))
+            pc += word(in.Len())
+        }
+    case "p", "pause":
+    default:
+        return false, fmt.Errorf("unknown command %s, try help", f[0])
+    }
+    return false, nil
+}
@@ -0,0 +1,125 @@
+package gones
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// Decode decodes the instruction at addr in code, which is mapped starting at
+// base. Bytes past the end of code read as 0.
+func Decode(code []byte, base uint16, addr uint16) Instruction {
+    return decodeInstruction(func(a word) byte {
+        i := int(a) - int(base)
+        if i < 0 || i >= len(code) {
+            return 0
+        }
+        return code[i]
+    }, word(addr))
+}
+
+// A Disassembler lists a bank of code as it would be mapped into the CPU's
+// address space.
+type Disassembler struct {
+    code   []byte
+    base   uint16
+    bank   int
+    labels map[uint16]string
+    syms   *Symbols
+    offset int //of code in PRG ROM
+}
+
+// NewDisassembler returns a disassembler for code, which is bank number bank
+// mapped at base. If the bank holds the interrupt vectors, their targets are
+// labelled nmi, reset and irq.
+func NewDisassembler(code []byte, base uint16, bank int) *Disassembler {
+    d := &Disassembler{code, base, bank, make(map[uint16]string), nil, 0}
+    if int(base)+len(code) == 0x10000 && len(code) >= 6 {
+        names := []string{"nmi", "reset", "irq"}
+        for i, name := range names {
+            v := len(code) - 6 + 2*i
+            d.Label(uint16(code[v+1])<<8|uint16(code[v]), name)
+        }
+    }
+    return d
+}
+
+// Label names addr in the listing.
+func (d *Disassembler) Label(addr uint16, name string) {
+    d.labels[addr] = name
+}
+
+// UseSymbols labels the listing with the names in s and adds source lines.
+// offset is where the code starts in PRG ROM. Operands outside the bank are
+// only named if they aren't in PRG ROM either, since there's no telling
+// which bank they'd be in.
+func (d *Disassembler) UseSymbols(s *Symbols, offset int) {
+    d.syms = s
+    d.offset = offset
+    for i := range d.code {
+        if sym, ok := s.rom[offset+i]; ok {
+            d.Label(d.base+uint16(i), sym.name)
+        } else if sym, ok := s.ram[int(d.base)+i]; ok {
+            //named by CPU address, in whatever bank
+            d.Label(d.base+uint16(i), sym.name)
+        }
+    }
+}
+
+// name names an operand, for Instruction.TextWith.
+func (d *Disassembler) name(addr uint16) (string, bool) {
+    if name, ok := d.labels[addr]; ok && d.contains(addr) {
+        return name, true
+    }
+    if sym, ok := d.syms.ram[int(addr)]; ok && addr < 0x8000 {
+        return sym.name, true
+    }
+    return "", false
+}
+
+func (d *Disassembler) contains(addr uint16) bool {
+    return addr >= d.base && int(addr) < int(d.base)+len(d.code)
+}
+
+// Write lists the bank to w a line per instruction, in the same format as
+// the -d trace. Branch and jump targets in the bank that don't have a name
+// yet are labelled with their address. With symbols, operands are written
+// as names and lines end with their source line.
+func (d *Disassembler) Write(w io.Writer) os.Error {
+    end := int(d.base) + len(d.code)
+    for pc := int(d.base); pc < end; {
+        inst := Decode(d.code, d.base, uint16(pc))
+        if target, ok := inst.Target(); ok && d.contains(target) {
+            if _, named := d.labels[target]; !named {
+                d.Label(target, fmt.Sprintf("L%04X", target))
+            }
+        }
+        pc += inst.Len()
+    }
+    if _, err := fmt.Fprintf(w, "; bank %d at $%04X\n", d.bank, d.base); err != nil {
+        return err
+    }
+    for pc := int(d.base); pc < end; {
+        if name, ok := d.labels[uint16(pc)]; ok {
+            if _, err := fmt.Fprintf(w, "%s:\n", name); err != nil {
+                return err
+            }
+        }
+        inst := Decode(d.code, d.base, uint16(pc))
+        line := ""
+        if d.syms == nil {
+            line = strings.TrimRight(inst.String(), " ")
+        } else {
+            line = strings.TrimRight(inst.listing(inst.TextWith(func(addr uint16) (string, bool) { return d.name(addr) })), " ")
+            if l, ok := d.syms.lines[d.offset+pc-int(d.base)]; ok {
+                line += "  ; " + l.String()
+            }
+        }
+        if _, err := fmt.Fprintf(w, "%X  %s\n", pc, line); err != nil {
+            return err
+        }
+        pc += inst.Len()
+    }
+    return nil
+}
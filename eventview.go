@@ -0,0 +1,230 @@
+package gones
+
+import (
+    "bytes"
+    "fmt"
+    "http"
+    "image"
+    "io"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// Kinds of event.
+const (
+    EVENT_WRITE = iota
+    EVENT_NMI
+    EVENT_IRQ
+)
+
+type event struct {
+    kind          int
+    scanline, dot int
+    addr          word
+    val           byte
+}
+
+// eventFrame is one frame's events and the picture the frame drew.
+type eventFrame struct {
+    events []event
+    screen []int
+    frame  uint64
+}
+
+// An EventViewer records when in each frame the CPU writes the PPU, APU
+// and mapper registers and takes NMIs and IRQs, and draws them on the
+// frame's 341 dots by 262 scanlines, which shows where raster effects land.
+type EventViewer struct {
+    lock   sync.Mutex
+    m      *Machine
+    hooks  []int
+    events []event
+    screen []int //the last picture drawn
+    last   *eventFrame
+}
+
+// StartEventViewer starts recording events. Frames start at dot 0 of the
+// pre-render line, so the viewers show the pre-render line at the top.
+func (m *Machine) StartEventViewer() *EventViewer {
+    m.StopEventViewer()
+    v := &EventViewer{m: m, screen: make([]int, 256*240), last: new(eventFrame)}
+    record := func(addr uint16, val byte) { v.record(EVENT_WRITE, word(addr), val) }
+    v.hooks = []int{
+        m.OnWrite(0x2000, 0x3fff, record),
+        m.OnWrite(0x4000, 0x4017, record),
+        //PRG RAM at $6000 isn't registers
+        m.OnWrite(0x4020, 0x5fff, record),
+        m.OnWrite(0x8000, 0xffff, record),
+        m.OnNMI(func() { v.record(EVENT_NMI, 0, 0) }),
+        m.OnIRQ(func() { v.record(EVENT_IRQ, 0, 0) }),
+        m.OnFrameDraw(func(screen []int) { copy(v.screen, screen) }),
+        m.OnScanline(-1, 0, func() { v.endFrame() }),
+    }
+    m.events = v
+    return v
+}
+
+// StopEventViewer stops recording events.
+func (m *Machine) StopEventViewer() {
+    if m.events != nil {
+        for _, id := range m.events.hooks {
+            m.RemoveHook(id)
+        }
+        m.events = nil
+    }
+}
+
+func (v *EventViewer) record(kind int, addr word, val byte) {
+    sl, dot := v.m.ppu.position()
+    v.events = append(v.events, event{kind, sl, dot, addr, val})
+}
+
+// endFrame hands the frame's events over to the viewers.
+func (v *EventViewer) endFrame() {
+    f := &eventFrame{v.events, make([]int, len(v.screen)), v.m.ppu.frameCounter}
+    copy(f.screen, v.screen)
+    v.events = nil
+    v.lock.Lock()
+    v.last = f
+    v.lock.Unlock()
+}
+
+func (v *EventViewer) frame() *eventFrame {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    return v.last
+}
+
+// eventRow gives the row of the grid a scanline is drawn on.
+func eventRow(scanline int) int {
+    if scanline == 261 {
+        return 0
+    }
+    return scanline + 1
+}
+
+// eventName names what an event was, and gives the colour it's drawn in.
+func eventName(e event) (string, int) {
+    switch true {
+    case e.kind == EVENT_NMI:
+        return "NMI", 0xffffff
+    case e.kind == EVENT_IRQ:
+        return "IRQ", 0xf9feac
+    case e.addr < 0x4000:
+        names := []string{"PPUCTRL", "PPUMASK", "PPUSTATUS", "OAMADDR", "OAMDATA", "PPUSCROLL", "PPUADDR", "PPUDATA"}
+        colors := []int{0xff5e5e, 0x8e33ff, 0xffffff, 0xff84e0, 0xfaff39, 0x2eff28, 0x3d2dff, 0xff060d}
+        return names[e.addr&7], colors[e.addr&7]
+    case e.addr == 0x4014:
+        return "OAMDMA", 0xff8224
+    case e.addr == 0x4016:
+        return "JOY", 0x8f8f8f
+    case e.addr < 0x4018:
+        return "APU", 0x00c8c8
+    }
+    return "mapper", 0xc4d600
+}
+
+// Image draws the last whole frame's events on a 341x262 grid, a dot to a
+// pixel, with the pre-render line at the top. The picture the frame drew
+// is dimmed behind the visible part.
+func (v *EventViewer) Image() image.Image {
+    f := v.frame()
+    img := image.NewRGBA(341, 262)
+    for y := 0; y < 262; y++ {
+        for x := 0; x < 341; x++ {
+            c := 0x202020
+            if y >= 1 && y <= 240 && x >= 1 && x <= 256 && f.screen != nil {
+                c = f.screen[(y-1)*256+x-1] >> 1 & 0x7f7f7f
+            }
+            img.Set(x, y, intToColor(c))
+        }
+    }
+    for _, e := range f.events {
+        _, c := eventName(e)
+        x, y := e.dot, eventRow(e.scanline)
+        for j := y - 1; j <= y+1; j++ {
+            for i := x - 1; i <= x+1; i++ {
+                if i >= 0 && i < 341 && j >= 0 && j < 262 {
+                    img.Set(i, j, intToColor(c))
+                }
+            }
+        }
+    }
+    return img
+}
+
+// WriteEvents lists the last whole frame's events in the order they
+// happened.
+func (v *EventViewer) WriteEvents(w io.Writer) os.Error {
+    f := v.frame()
+    if _, err := fmt.Fprintf(w, "frame %d, %d events\n SL  DOT  event\n", f.frame, len(f.events)); err != nil {
+        return err
+    }
+    for _, e := range f.events {
+        name, _ := eventName(e)
+        text := name
+        if e.kind == EVENT_WRITE {
+            text = fmt.Sprintf("$%04X = $%02X  %s", e.addr, e.val, name)
+        }
+        if _, err := fmt.Fprintf(w, "%3d  %3d  %s\n", e.scanline, e.dot, text); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Save writes events.png and events.txt to dir.
+func (v *EventViewer) Save(dir string) os.Error {
+    if err := savePNG(filepath.Join(dir, "events.png"), v.Image()); err != nil {
+        return err
+    }
+    f, err := os.Create(filepath.Join(dir, "events.txt"))
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return v.WriteEvents(f)
+}
+
+const EVENT_VIEWER_PAGE = `<img src="events.png" width="682" height="524">
+<p>%s</p>
+<pre>%s</pre>
+`
+
+// page serves the viewer as events.png and events.txt, and a page showing
+// both with a legend.
+func (v *EventViewer) page() *viewPage {
+    return &viewPage{
+        title: "gones events",
+        body: func(r *http.Request) string {
+            legend := ""
+            kinds := []event{{kind: EVENT_NMI}, {kind: EVENT_IRQ}, {addr: 0x2000}, {addr: 0x2001}, {addr: 0x2003},
+                {addr: 0x2004}, {addr: 0x2005}, {addr: 0x2006}, {addr: 0x2007}, {addr: 0x4000}, {addr: 0x4014},
+                {addr: 0x4016}, {addr: 0x8000}}
+            for _, e := range kinds {
+                name, c := eventName(e)
+                legend += fmt.Sprintf(`<span style="background:#%06x">&nbsp;&nbsp;&nbsp;</span> %s `, c, name)
+            }
+            var list bytes.Buffer
+            v.WriteEvents(&list)
+            return fmt.Sprintf(EVENT_VIEWER_PAGE, legend, list.String())
+        },
+        images: map[string]func(r *http.Request) image.Image{
+            "events.png": func(r *http.Request) image.Image { return v.Image() },
+        },
+        texts: map[string]func(w io.Writer) os.Error{
+            "events.txt": func(w io.Writer) os.Error { return v.WriteEvents(w) },
+        },
+    }
+}
+
+// ServeEventViewer starts recording events, if that isn't happening, and
+// serves the viewer over HTTP on addr.
+func (m *Machine) ServeEventViewer(addr string) os.Error {
+    v := m.events
+    if v == nil {
+        v = m.StartEventViewer()
+    }
+    return v.page().serve(addr)
+}
@@ -0,0 +1,295 @@
+package gones
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// exprEnv is what an expression is evaluated against. addr and value are
+// the address and byte of the memory access that set off a watchpoint.
+type exprEnv struct {
+    m     *Machine
+    addr  int
+    value int
+}
+
+// An expr is a compiled expression over registers, memory and machine
+// state, like "a == $10 && [$0300] & 1 != 0". Numbers are decimal unless
+// written $ff or 0xff, [n] is the CPU byte at n, ppu[n] the PPU byte, and
+// comparisons and logical operators give 1 or 0, as in C. Symbols' names
+// stand for their addresses.
+type expr func(e *exprEnv) int
+
+// exprNames are the variables an expression can use.
+var exprNames = map[string]expr{
+    "a":        func(e *exprEnv) int { return int(e.m.cpu.a) },
+    "x":        func(e *exprEnv) int { return int(e.m.cpu.x) },
+    "y":        func(e *exprEnv) int { return int(e.m.cpu.y) },
+    "s":        func(e *exprEnv) int { return int(e.m.cpu.s) },
+    "p":        func(e *exprEnv) int { return int(e.m.cpu.p) },
+    "pc":       func(e *exprEnv) int { return int(e.m.cpu.pc) },
+    "n":        func(e *exprEnv) int { return flagValue(e, N) },
+    "v":        func(e *exprEnv) int { return flagValue(e, V) },
+    "d":        func(e *exprEnv) int { return flagValue(e, D) },
+    "i":        func(e *exprEnv) int { return flagValue(e, I) },
+    "z":        func(e *exprEnv) int { return flagValue(e, Z) },
+    "c":        func(e *exprEnv) int { return flagValue(e, C) },
+    "addr":     func(e *exprEnv) int { return e.addr },
+    "value":    func(e *exprEnv) int { return e.value },
+    "scanline": func(e *exprEnv) int { sl, _ := e.m.ppu.position(); return sl },
+    "dot":      func(e *exprEnv) int { _, dot := e.m.ppu.position(); return dot },
+    "frame":    func(e *exprEnv) int { return int(e.m.ppu.frameCounter) },
+    "cycles":   func(e *exprEnv) int { return int(e.m.cpu.cycleCount) },
+}
+
+func flagValue(e *exprEnv, flag byte) int {
+    if e.m.cpu.getFlag(flag) {
+        return 1
+    }
+    return 0
+}
+
+// Binary operators by precedence, loosest first.
+var exprLevels = [][]string{
+    {"||"},
+    {"&&"},
+    {"==", "!=", "<=", ">=", "<", ">"},
+    {"|"},
+    {"^"},
+    {"&"},
+    {"<<", ">>"},
+    {"+", "-"},
+    {"*", "/", "%"},
+}
+
+type exprParser struct {
+    s    string
+    pos  int
+    syms *Symbols
+}
+
+// parseExpr compiles s. syms can be nil.
+func parseExpr(s string, syms *Symbols) (expr, os.Error) {
+    p := &exprParser{s: s, syms: syms}
+    e, err := p.binary(0)
+    if err != nil {
+        return nil, err
+    }
+    p.space()
+    if p.pos < len(p.s) {
+        return nil, fmt.Errorf("unexpected %q in %q", p.s[p.pos:], s)
+    }
+    return e, nil
+}
+
+func (p *exprParser) space() {
+    for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+        p.pos++
+    }
+}
+
+// operator returns which of ops comes next, if any, and skips over it. A
+// lone | or & isn't taken for the start of || or &&.
+func (p *exprParser) operator(ops []string) string {
+    p.space()
+    rest := p.s[p.pos:]
+    for _, op := range ops {
+        if !strings.HasPrefix(rest, op) {
+            continue
+        }
+        if len(op) == 1 && len(rest) > 1 && strings.IndexAny(op, "|&<>") >= 0 && rest[1] == op[0] {
+            continue
+        }
+        p.pos += len(op)
+        return op
+    }
+    return ""
+}
+
+func (p *exprParser) binary(level int) (expr, os.Error) {
+    if level == len(exprLevels) {
+        return p.unary()
+    }
+    l, err := p.binary(level + 1)
+    if err != nil {
+        return nil, err
+    }
+    for true {
+        op := p.operator(exprLevels[level])
+        if op == "" {
+            return l, nil
+        }
+        r, err := p.binary(level + 1)
+        if err != nil {
+            return nil, err
+        }
+        l = binaryExpr(op, l, r)
+    }
+    return l, nil
+}
+
+func truth(b bool) int {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func binaryExpr(op string, l expr, r expr) expr {
+    switch op {
+    case "||":
+        return func(e *exprEnv) int { return truth(l(e) != 0 || r(e) != 0) }
+    case "&&":
+        return func(e *exprEnv) int { return truth(l(e) != 0 && r(e) != 0) }
+    case "==":
+        return func(e *exprEnv) int { return truth(l(e) == r(e)) }
+    case "!=":
+        return func(e *exprEnv) int { return truth(l(e) != r(e)) }
+    case "<=":
+        return func(e *exprEnv) int { return truth(l(e) <= r(e)) }
+    case ">=":
+        return func(e *exprEnv) int { return truth(l(e) >= r(e)) }
+    case "<":
+        return func(e *exprEnv) int { return truth(l(e) < r(e)) }
+    case ">":
+        return func(e *exprEnv) int { return truth(l(e) > r(e)) }
+    case "|":
+        return func(e *exprEnv) int { return l(e) | r(e) }
+    case "^":
+        return func(e *exprEnv) int { return l(e) ^ r(e) }
+    case "&":
+        return func(e *exprEnv) int { return l(e) & r(e) }
+    case "<<":
+        return func(e *exprEnv) int { return l(e) << uint(r(e)) }
+    case ">>":
+        return func(e *exprEnv) int { return l(e) >> uint(r(e)) }
+    case "+":
+        return func(e *exprEnv) int { return l(e) + r(e) }
+    case "-":
+        return func(e *exprEnv) int { return l(e) - r(e) }
+    case "*":
+        return func(e *exprEnv) int { return l(e) * r(e) }
+    case "/":
+        return func(e *exprEnv) int {
+            if d := r(e); d != 0 {
+                return l(e) / d
+            }
+            return 0
+        }
+    case "%":
+        return func(e *exprEnv) int {
+            if d := r(e); d != 0 {
+                return l(e) % d
+            }
+            return 0
+        }
+    }
+    return nil
+}
+
+func (p *exprParser) unary() (expr, os.Error) {
+    p.space()
+    if p.pos == len(p.s) {
+        return nil, fmt.Errorf("expression %q ends early", p.s)
+    }
+    switch p.s[p.pos] {
+    case '!', '-', '~':
+        op := p.s[p.pos]
+        p.pos++
+        x, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        switch op {
+        case '!':
+            return func(e *exprEnv) int { return truth(x(e) == 0) }, nil
+        case '-':
+            return func(e *exprEnv) int { return -x(e) }, nil
+        }
+        return func(e *exprEnv) int { return ^x(e) }, nil
+    case '(':
+        p.pos++
+        x, err := p.binary(0)
+        if err != nil {
+            return nil, err
+        }
+        if err = p.expect(')'); err != nil {
+            return nil, err
+        }
+        return x, nil
+    case '[':
+        p.pos++
+        return p.memory(func(e *exprEnv, addr int) int { return int(e.m.peekMem(word(addr))) })
+    }
+    return p.primary()
+}
+
+// memory parses the rest of a [n] or ppu[n] memory reference.
+func (p *exprParser) memory(read func(e *exprEnv, addr int) int) (expr, os.Error) {
+    x, err := p.binary(0)
+    if err != nil {
+        return nil, err
+    }
+    if err = p.expect(']'); err != nil {
+        return nil, err
+    }
+    return func(e *exprEnv) int { return read(e, x(e)&0xffff) }, nil
+}
+
+func (p *exprParser) expect(c byte) os.Error {
+    p.space()
+    if p.pos == len(p.s) || p.s[p.pos] != c {
+        return fmt.Errorf("missing %c in %q", c, p.s)
+    }
+    p.pos++
+    return nil
+}
+
+func (p *exprParser) primary() (expr, os.Error) {
+    start := p.pos
+    for p.pos < len(p.s) && isWordChar(p.s[p.pos]) {
+        p.pos++
+    }
+    tok := p.s[start:p.pos]
+    switch true {
+    case tok == "":
+        return nil, fmt.Errorf("unexpected %q in %q", p.s[start:], p.s)
+    case tok[0] == '$' || strings.HasPrefix(tok, "0x"):
+        digits := tok[1:]
+        if tok[0] == '0' {
+            digits = tok[2:]
+        }
+        n, err := strconv.Btoui64(digits, 16)
+        if err != nil {
+            return nil, fmt.Errorf("bad number %s", tok)
+        }
+        v := int(n)
+        return func(e *exprEnv) int { return v }, nil
+    case tok[0] >= '0' && tok[0] <= '9':
+        v, err := strconv.Atoi(tok)
+        if err != nil {
+            return nil, fmt.Errorf("bad number %s", tok)
+        }
+        return func(e *exprEnv) int { return v }, nil
+    case strings.ToLower(tok) == "ppu":
+        if err := p.expect('['); err != nil {
+            return nil, err
+        }
+        return p.memory(func(e *exprEnv, addr int) int { return int(e.m.ppu.peekMem(word(addr))) })
+    }
+    if v, ok := exprNames[strings.ToLower(tok)]; ok {
+        return v, nil
+    }
+    if p.syms != nil {
+        if sym, ok := p.syms.lookup(tok); ok {
+            return func(e *exprEnv) int { addr, _ := e.m.symbolAddr(sym); return int(addr) }, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown name %s", tok)
+}
+
+func isWordChar(c byte) bool {
+    return c == '$' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
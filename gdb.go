@@ -0,0 +1,517 @@
+package gones
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// GDB_TARGET describes the registers to GDB, in the order the g packet
+// sends them. PC is little endian, like everything else in the protocol.
+const GDB_TARGET = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.gones.6502">
+    <reg name="a" bitsize="8" type="uint8" regnum="0"/>
+    <reg name="x" bitsize="8" type="uint8"/>
+    <reg name="y" bitsize="8" type="uint8"/>
+    <reg name="p" bitsize="8" type="uint8"/>
+    <reg name="sp" bitsize="8" type="uint8"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+// ServeGDB listens on addr, like "localhost:2159", for a debugger speaking
+// GDB's remote serial protocol, and serves one at a time. Attaching stops
+// the machine and detaching lets it go again. Breakpoints and stops are
+// shared with the debugger console if there is one; if not, one is started
+// with its output going to stdout, and the machine runs until a client
+// attaches.
+func (m *Machine) ServeGDB(addr string) os.Error {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    d := m.debugger
+    if d == nil {
+        d = m.StartDebugger(nil, os.Stdout)
+        d.hit = ""
+    }
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            g := &gdbConn{d: d, conn: conn, ack: true, stops: make(chan string, 1)}
+            g.serve()
+            conn.Close()
+        }
+    }()
+    return nil
+}
+
+// A gdbConn is one GDB session.
+type gdbConn struct {
+    d       *Debugger
+    conn    net.Conn
+    ack     bool        //acknowledge packets, until the client asks us not to
+    stops   chan string //stop replies from the emulation goroutine
+    running bool
+}
+
+// readPackets reads packets from the client, checking and acknowledging
+// them. A Ctrl-C to interrupt the target comes through as "\x03".
+func (g *gdbConn) readPackets(packets chan string) {
+    r := bufio.NewReader(g.conn)
+    defer close(packets)
+    for {
+        c, err := r.ReadByte()
+        if err != nil {
+            return
+        }
+        switch c {
+        case 0x03:
+            packets <- "\x03"
+        case '$':
+            data, err := r.ReadString('#')
+            if err != nil {
+                return
+            }
+            data = data[:len(data)-1]
+            sum := make([]byte, 2)
+            if sum[0], err = r.ReadByte(); err != nil {
+                return
+            }
+            if sum[1], err = r.ReadByte(); err != nil {
+                return
+            }
+            want, err := strconv.Btoui64(string(sum), 16)
+            if err != nil || byte(want) != gdbChecksum(data) {
+                g.conn.Write([]byte("-"))
+                continue
+            }
+            if g.ack {
+                g.conn.Write([]byte("+"))
+            }
+            packets <- gdbUnescape(data)
+        }
+    }
+}
+
+func gdbChecksum(data string) byte {
+    sum := byte(0)
+    for i := 0; i < len(data); i++ {
+        sum += data[i]
+    }
+    return sum
+}
+
+// gdbUnescape undoes the }-escaping of binary data in packets.
+func gdbUnescape(data string) string {
+    if strings.Index(data, "}") < 0 {
+        return data
+    }
+    b := make([]byte, 0, len(data))
+    for i := 0; i < len(data); i++ {
+        if data[i] == '}' && i+1 < len(data) {
+            i++
+            b = append(b, data[i]^0x20)
+        } else {
+            b = append(b, data[i])
+        }
+    }
+    return string(b)
+}
+
+func (g *gdbConn) send(data string) {
+    g.conn.Write([]byte(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data))))
+}
+
+// stopReply turns why the debugger stopped into a stop reply packet.
+func (g *gdbConn) stopReply(reason string) string {
+    d := g.d
+    switch true {
+    case reason == "paused":
+        return "S02" //SIGINT
+    case strings.HasPrefix(reason, "watchpoint"):
+        kind := "watch"
+        if d.hitKind == BREAK_READ {
+            kind = "rwatch"
+        }
+        return fmt.Sprintf("T05%s:%04x;", kind, d.hitAddr)
+    }
+    return "S05" //SIGTRAP
+}
+
+func (g *gdbConn) serve() {
+    d := g.d
+    //attach, stopping the machine
+    d.do(func() bool {
+        d.onStop = func(reason string) {
+            select {
+            case g.stops <- g.stopReply(reason):
+            default:
+            }
+        }
+        return false
+    })
+    packets := make(chan string)
+    go g.readPackets(packets)
+    jammed := d.m.done
+    for {
+        select {
+        case p, ok := <-packets:
+            if !ok {
+                g.detach()
+                return
+            }
+            if p == "\x03" {
+                if g.running {
+                    d.Pause()
+                }
+                continue
+            }
+            if g.running {
+                continue
+            }
+            reply, done := g.handle(p)
+            if reply != "\x00" {
+                g.send(reply)
+            }
+            if done {
+                g.detach()
+                return
+            }
+        case reply := <-g.stops:
+            if g.running {
+                g.running = false
+                g.send(reply)
+            }
+        case <-jammed:
+            //Run has returned, so tell a client waiting for a stop that
+            //the target died of an illegal instruction
+            jammed = nil
+            if g.running {
+                g.running = false
+                g.send("X04")
+            }
+        }
+    }
+}
+
+// detach lets the machine run free of this session.
+func (g *gdbConn) detach() {
+    g.d.do(func() bool {
+        g.d.onStop = nil
+        return true
+    })
+}
+
+// resume sets the machine going, with f setting up how far. It returns
+// false if the machine has stopped for good.
+func (g *gdbConn) resume(f func()) bool {
+    select {
+    case <-g.stops:
+    default:
+    }
+    g.running = g.d.do(func() bool {
+        f()
+        return true
+    })
+    return g.running
+}
+
+// gdbHex parses a hex number from a packet.
+func gdbHex(s string) (int, os.Error) {
+    n, err := strconv.Btoui64(s, 16)
+    if err != nil || n > 0xffff {
+        return 0, fmt.Errorf("bad number %s", s)
+    }
+    return int(n), nil
+}
+
+// gdbLittle parses a register value, which is sent as little endian hex
+// bytes.
+func gdbLittle(s string) (int, os.Error) {
+    if len(s) == 0 || len(s) > 4 || len(s)%2 != 0 {
+        return 0, fmt.Errorf("bad register value %s", s)
+    }
+    v := 0
+    for i := 0; i < len(s); i += 2 {
+        b, err := strconv.Btoui64(s[i:i+2], 16)
+        if err != nil {
+            return 0, err
+        }
+        v |= int(b) << uint(4*i)
+    }
+    return v, nil
+}
+
+// handle answers a packet. A reply of "\x00" means none, and done ends the
+// session.
+func (g *gdbConn) handle(p string) (reply string, done bool) {
+    d := g.d
+    m := d.m
+    c := m.cpu
+    if len(p) == 0 {
+        return "", false
+    }
+    switch p[0] {
+    case '?':
+        return "S05", false
+    case 'g':
+        if !d.do(func() bool {
+            reply = fmt.Sprintf("%02x%02x%02x%02x%02x%02x%02x", c.a, c.x, c.y, c.p, c.s, byte(c.pc), byte(c.pc>>8))
+            return false
+        }) {
+            return "E01", false
+        }
+        return reply, false
+    case 'G':
+        if len(p) != 15 {
+            return "E01", false
+        }
+        var regs [7]byte
+        for i := range regs {
+            n, err := strconv.Btoui64(p[1+2*i:3+2*i], 16)
+            if err != nil {
+                return "E01", false
+            }
+            regs[i] = byte(n)
+        }
+        if !d.do(func() bool {
+            c.a, c.x, c.y, c.p, c.s = regs[0], regs[1], regs[2], regs[3], regs[4]
+            c.pc = word(regs[5]) | word(regs[6])<<8
+            return false
+        }) {
+            return "E01", false
+        }
+        return "OK", false
+    case 'p':
+        n, err := gdbHex(p[1:])
+        if err != nil || n > 5 {
+            return "E01", false
+        }
+        if !d.do(func() bool {
+            regs := []byte{c.a, c.x, c.y, c.p, c.s}
+            if n == 5 {
+                reply = fmt.Sprintf("%02x%02x", byte(c.pc), byte(c.pc>>8))
+            } else {
+                reply = fmt.Sprintf("%02x", regs[n])
+            }
+            return false
+        }) {
+            return "E01", false
+        }
+        return reply, false
+    case 'P':
+        f := strings.Split(p[1:], "=")
+        if len(f) != 2 {
+            return "E01", false
+        }
+        n, err := gdbHex(f[0])
+        if err != nil || n > 5 {
+            return "E01", false
+        }
+        v, err := gdbLittle(f[1])
+        if err != nil {
+            return "E01", false
+        }
+        if !d.do(func() bool {
+            switch n {
+            case 0:
+                c.a = byte(v)
+            case 1:
+                c.x = byte(v)
+            case 2:
+                c.y = byte(v)
+            case 3:
+                c.p = byte(v)
+            case 4:
+                c.s = byte(v)
+            case 5:
+                c.pc = word(v)
+            }
+            return false
+        }) {
+            return "E01", false
+        }
+        return "OK", false
+    case 'm':
+        f := strings.Split(p[1:], ",")
+        if len(f) != 2 {
+            return "E01", false
+        }
+        addr, err := gdbHex(f[0])
+        if err != nil {
+            return "E01", false
+        }
+        n, err := gdbHex(f[1])
+        if err != nil {
+            return "E01", false
+        }
+        if !d.do(func() bool {
+            b := make([]string, n)
+            for i := range b {
+                b[i] = fmt.Sprintf("%02x", m.peekMem(word(addr+i)))
+            }
+            reply = strings.Join(b, "")
+            return false
+        }) {
+            return "E01", false
+        }
+        return reply, false
+    case 'M':
+        f := strings.Split(p[1:], ":")
+        if len(f) != 2 {
+            return "E01", false
+        }
+        r := strings.Split(f[0], ",")
+        if len(r) != 2 {
+            return "E01", false
+        }
+        addr, err := gdbHex(r[0])
+        if err != nil {
+            return "E01", false
+        }
+        n, err := gdbHex(r[1])
+        if err != nil || len(f[1]) != 2*n {
+            return "E01", false
+        }
+        data := make([]byte, n)
+        for i := range data {
+            b, err := strconv.Btoui64(f[1][2*i:2*i+2], 16)
+            if err != nil {
+                return "E01", false
+            }
+            data[i] = byte(b)
+        }
+        reply := "OK"
+        if !d.do(func() bool {
+            for i, b := range data {
+                if m.pokeMem(word(addr+i), b) != nil {
+                    reply = "E01"
+                }
+            }
+            return false
+        }) {
+            return "E01", false
+        }
+        return reply, false
+    case 'Z', 'z':
+        return g.breakpoint(p), false
+    case 'c':
+        if !g.resume(func() {}) {
+            return "E01", false
+        }
+        return "\x00", false
+    case 's':
+        if !g.resume(func() { d.steps = 1 }) {
+            return "E01", false
+        }
+        return "\x00", false
+    case 'D':
+        g.send("OK")
+        return "\x00", true
+    case 'k':
+        return "\x00", true
+    case 'H':
+        return "OK", false
+    case 'T':
+        return "OK", false
+    case 'q':
+        return g.query(p), false
+    case 'Q':
+        if p == "QStartNoAckMode" {
+            g.send("OK")
+            g.ack = false
+            return "\x00", false
+        }
+    }
+    return "", false
+}
+
+// breakpoint handles Z and z, which set and clear breakpoints (0 and 1)
+// and write, read and access watchpoints (2, 3 and 4).
+func (g *gdbConn) breakpoint(p string) string {
+    f := strings.Split(p[1:], ",")
+    if len(f) < 3 {
+        return "E01"
+    }
+    kinds := []int{BREAK_EXEC, BREAK_EXEC, BREAK_WRITE, BREAK_READ, BREAK_READ | BREAK_WRITE}
+    t, err := strconv.Atoi(f[0])
+    if err != nil || t < 0 || t >= len(kinds) {
+        return ""
+    }
+    addr, err := gdbHex(f[1])
+    if err != nil {
+        return "E01"
+    }
+    n, err := gdbHex(f[2])
+    if err != nil {
+        return "E01"
+    }
+    kind, lo, hi := kinds[t], word(addr), word(addr)
+    if kind != BREAK_EXEC && n > 1 {
+        hi = word(addr + n - 1)
+    }
+    d := g.d
+    if !d.do(func() bool {
+        if p[0] == 'Z' {
+            d.addBreakpoint(&breakpoint{kind: kind, lo: lo, hi: hi, bank: -1, offset: -1, text: "gdb " + p})
+            return false
+        }
+        for i, b := range d.breaks {
+            if b.kind == kind && b.lo == lo && b.hi == hi && strings.HasPrefix(b.text, "gdb ") {
+                d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+                break
+            }
+        }
+        return false
+    }) {
+        return "E01"
+    }
+    return "OK"
+}
+
+// query answers the q packets GDB needs to get going.
+func (g *gdbConn) query(p string) string {
+    switch true {
+    case strings.HasPrefix(p, "qSupported"):
+        return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+"
+    case p == "qAttached":
+        return "1"
+    case p == "qC":
+        return "QC1"
+    case p == "qfThreadInfo":
+        return "m1"
+    case p == "qsThreadInfo":
+        return "l"
+    case strings.HasPrefix(p, "qXfer:features:read:target.xml:"):
+        r := strings.Split(p[len("qXfer:features:read:target.xml:"):], ",")
+        if len(r) != 2 {
+            return "E01"
+        }
+        off, err := strconv.Btoui64(r[0], 16)
+        if err != nil {
+            return "E01"
+        }
+        n, err := strconv.Btoui64(r[1], 16)
+        if err != nil {
+            return "E01"
+        }
+        if off >= uint64(len(GDB_TARGET)) {
+            return "l"
+        }
+        if off+n >= uint64(len(GDB_TARGET)) {
+            return "l" + GDB_TARGET[off:]
+        }
+        return "m" + GDB_TARGET[off:off+n]
+    }
+    return ""
+}
@@ -0,0 +1,223 @@
+package gones
+
+// Kinds of hook.
+const (
+    HOOK_FRAME_START = iota
+    HOOK_FRAME_END
+    HOOK_FRAME_DRAW
+    HOOK_SCANLINE
+    HOOK_NMI
+    HOOK_IRQ
+    HOOK_READ
+    HOOK_WRITE
+    HOOK_EXEC
+    HOOK_PPU_WRITE
+    HOOK_KINDS
+)
+
+type hook struct {
+    id, kind int
+    lo, hi   word //addresses for reads, writes and execution
+    dot      int  //scanline*341+dot for scanline hooks
+    event    func()
+    draw     func(screen []int)
+    read     func(addr uint16, val byte) byte
+    write    func(addr uint16, val byte)
+    exec     func(pc uint16)
+    ppu      func(reg int, val byte)
+}
+
+// hooks holds the callbacks the machine makes as it runs. The machine only
+// has one while there are hooks, so without any the cost is a nil check.
+type hooks struct {
+    all     []*hook
+    byKind  [HOOK_KINDS][]*hook
+    addrs   [0x10000]byte //BREAK_READ|BREAK_WRITE|BREAK_EXEC for hooked addresses
+    lastDot int
+}
+
+// Hooks are called on the emulation goroutine, so they can look at and
+// change the machine freely. They must be added and removed there too:
+// before Run, from another hook or from a debugger call. Each returns an
+// id for RemoveHook.
+
+// OnFrameStart calls f as the PPU starts the pre-render line.
+func (m *Machine) OnFrameStart(f func()) int {
+    return m.addHook(&hook{kind: HOOK_FRAME_START, event: f})
+}
+
+// OnFrameEnd calls f as a finished frame goes to the screen, towards the
+// end of vblank.
+func (m *Machine) OnFrameEnd(f func()) int {
+    return m.addHook(&hook{kind: HOOK_FRAME_END, event: f})
+}
+
+// OnFrameDraw calls f with a finished frame, a 256x240 array of 0xRRGGBB
+// pixels, just before it goes to the screen. f can draw on it.
+func (m *Machine) OnFrameDraw(f func(screen []int)) int {
+    return m.addHook(&hook{kind: HOOK_FRAME_DRAW, draw: f})
+}
+
+// OnScanline calls f once a frame, when the PPU reaches dot on scanline.
+// Scanline 261, or -1, is the pre-render line.
+func (m *Machine) OnScanline(scanline int, dot int, f func()) int {
+    if scanline < 0 {
+        scanline += 262
+    }
+    return m.addHook(&hook{kind: HOOK_SCANLINE, dot: scanline*341 + dot, event: f})
+}
+
+// OnNMI calls f when the CPU takes an NMI, with PC at the handler.
+func (m *Machine) OnNMI(f func()) int {
+    return m.addHook(&hook{kind: HOOK_NMI, event: f})
+}
+
+// OnIRQ calls f when the CPU takes an IRQ, with PC at the handler. BRK
+// doesn't count.
+func (m *Machine) OnIRQ(f func()) int {
+    return m.addHook(&hook{kind: HOOK_IRQ, event: f})
+}
+
+// OnRead calls f when the CPU reads an address from lo to hi. The CPU gets
+// whatever f returns instead of the value read.
+func (m *Machine) OnRead(lo uint16, hi uint16, f func(addr uint16, val byte) byte) int {
+    return m.addHook(&hook{kind: HOOK_READ, lo: word(lo), hi: word(hi), read: f})
+}
+
+// OnWrite calls f after the CPU writes an address from lo to hi.
+func (m *Machine) OnWrite(lo uint16, hi uint16, f func(addr uint16, val byte)) int {
+    return m.addHook(&hook{kind: HOOK_WRITE, lo: word(lo), hi: word(hi), write: f})
+}
+
+// OnExec calls f before the CPU runs an instruction from lo to hi.
+func (m *Machine) OnExec(lo uint16, hi uint16, f func(pc uint16)) int {
+    return m.addHook(&hook{kind: HOOK_EXEC, lo: word(lo), hi: word(hi), exec: f})
+}
+
+// OnPPUWrite calls f after a write to PPU register reg, 0-7, which
+// includes the writes sprite DMA makes to $2004.
+func (m *Machine) OnPPUWrite(f func(reg int, val byte)) int {
+    return m.addHook(&hook{kind: HOOK_PPU_WRITE, ppu: f})
+}
+
+// RemoveHook removes the hook with id.
+func (m *Machine) RemoveHook(id int) {
+    h := m.hooks
+    if h == nil {
+        return
+    }
+    var all []*hook
+    for _, k := range h.all {
+        if k.id != id {
+            all = append(all, k)
+        }
+    }
+    h.all = all
+    m.rebuildHooks()
+}
+
+func (m *Machine) addHook(k *hook) int {
+    h := m.hooks
+    if h == nil {
+        h = new(hooks)
+    }
+    m.lastHookID++
+    k.id = m.lastHookID
+    h.all = append(h.all, k)
+    if k.kind == HOOK_SCANLINE {
+        sl, dot := m.ppu.position()
+        h.lastDot = sl*341 + dot
+    }
+    m.hooks = h
+    m.rebuildHooks()
+    return k.id
+}
+
+// rebuildHooks sorts the hooks by kind after one is added or removed. The
+// lists are made afresh, so a hook that's running while they change
+// carries on over the old ones.
+func (m *Machine) rebuildHooks() {
+    h := m.hooks
+    if len(h.all) == 0 {
+        m.hooks = nil
+        return
+    }
+    var byKind [HOOK_KINDS][]*hook
+    for i := range h.addrs {
+        h.addrs[i] = 0
+    }
+    bits := map[int]byte{HOOK_READ: BREAK_READ, HOOK_WRITE: BREAK_WRITE, HOOK_EXEC: BREAK_EXEC}
+    for _, k := range h.all {
+        byKind[k.kind] = append(byKind[k.kind], k)
+        if bit, ok := bits[k.kind]; ok {
+            for a := int(k.lo); a <= int(k.hi); a++ {
+                h.addrs[a] |= bit
+            }
+        }
+    }
+    h.byKind = byKind
+}
+
+func (h *hooks) event(kind int) {
+    for _, k := range h.byKind[kind] {
+        k.event()
+    }
+}
+
+func (h *hooks) frameDraw(screen []int) {
+    for _, k := range h.byKind[HOOK_FRAME_DRAW] {
+        k.draw(screen)
+    }
+}
+
+func (h *hooks) read(addr word, val byte) byte {
+    for _, k := range h.byKind[HOOK_READ] {
+        if addr >= k.lo && addr <= k.hi {
+            val = k.read(uint16(addr), val)
+        }
+    }
+    return val
+}
+
+func (h *hooks) write(addr word, val byte) {
+    for _, k := range h.byKind[HOOK_WRITE] {
+        if addr >= k.lo && addr <= k.hi {
+            k.write(uint16(addr), val)
+        }
+    }
+}
+
+func (h *hooks) exec(pc word) {
+    for _, k := range h.byKind[HOOK_EXEC] {
+        if pc >= k.lo && pc <= k.hi {
+            k.exec(uint16(pc))
+        }
+    }
+}
+
+func (h *hooks) ppuWrite(reg int, val byte) {
+    for _, k := range h.byKind[HOOK_PPU_WRITE] {
+        k.ppu(reg, val)
+    }
+}
+
+// inNMI says whether an interrupt that's just been taken was an NMI, which
+// is the only way to be sure once an NMI can hijack an IRQ or BRK.
+func (m *Machine) inNMI() bool {
+    return m.cpu.pc == word(m.peekMem(0xfffa))|word(m.peekMem(0xfffb))<<8
+}
+
+// dots calls the scanline hooks the PPU has passed since the last call.
+// The renderer runs in chunks, so where it's got to is worked out from the
+// CPU's cycle count.
+func (h *hooks) dots(p *PPU) {
+    sl, dot := p.position()
+    now := sl*341 + dot
+    last := h.lastDot
+    h.lastDot = now
+    for _, k := range h.byKind[HOOK_SCANLINE] {
+        if last <= now && k.dot > last && k.dot <= now || last > now && (k.dot > last || k.dot <= now) {
+            k.event()
+        }
+    }
+}
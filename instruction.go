@@ -398,10 +398,24 @@ var Opcodes = [0x100]Opcode{
     makeOpcodeF(ISB, ABSX, 7, 0),
 }
 
+// init marks the opcodes that aren't in the 6502 datasheet. NOP and SBC have
+// official opcodes too, so those go by number.
+func init() {
+    for i := range Opcodes {
+        switch Opcodes[i].op {
+        case NOP:
+            Opcodes[i].illegal = i != 0xea
+        case SBC:
+            Opcodes[i].illegal = i == 0xeb
+        case SLO, RLA, SRE, RRA, SAX, LAX, DCP, ISB, DOP, AAC, ASR, ARR, ATX, AXS, TOP, SYA, KIL, XAA, AXA, XAS, SXA, LAR:
+            Opcodes[i].illegal = true
+        }
+    }
+}
+
 type Instruction struct {
     op           Opcode
     opcode       byte
-    extra_cycles int
     addr         word
     operand      byte
     args         [2]byte
@@ -412,147 +426,132 @@ func (o Opcode) String() string {
     return opnames[o.op]
 }
 
-func (i Instruction) String() string {
+// Text returns the instruction in assembler syntax, like "LDA ($10),Y".
+func (i Instruction) Text() string {
+    return i.TextWith(nil)
+}
+
+// TextWith is Text with the operand address written as the name that name
+// returns for it, if it returns one. name can be nil.
+func (i Instruction) TextWith(name func(addr uint16) (string, bool)) string {
+    addr := func(format string) string {
+        if name != nil {
+            if s, ok := name(uint16(i.addr)); ok {
+                return s
+            }
+        }
+        return fmt.Sprintf(format, i.addr)
+    }
     args := ""
     switch i.op.addr_mode {
     case IMM:
-        args = fmt.Sprintf("#$%02X                       ", i.operand)
-    case REL:
-        args = fmt.Sprintf("$%04X                      ", i.addr)
+        args = fmt.Sprintf("#$%02X", i.operand)
+    case REL, ABS, ABS_ST:
+        args = addr("$%04X")
     case ZP, ZP_ST:
-        args = fmt.Sprintf("$%02X                        ", i.addr)
-    case ABS, ABS_ST:
-        args = fmt.Sprintf("$%04X                      ", i.addr)
+        args = addr("$%02X")
+    case ZPX:
+        args = addr("$%02X") + ",X"
+    case ZPY:
+        args = addr("$%02X") + ",Y"
+    case ABSX:
+        args = addr("$%04X") + ",X"
+    case ABSY:
+        args = addr("$%04X") + ",Y"
+    case ABSI:
+        args = "(" + addr("$%04X") + ")"
+    case IXID:
+        args = "(" + addr("$%02X") + ",X)"
+    case IDIX:
+        args = "(" + addr("$%02X") + "),Y"
     case A:
-        args = "A                          "
+        args = "A"
     default:
-        args = "                           "
+        return i.op.String()
     }
+    return i.op.String() + " " + args
+}
+
+// Bytes returns the instruction's opcode and operand bytes.
+func (i Instruction) Bytes() []byte {
+    return append([]byte{i.opcode}, i.args[:i.arglen]...)
+}
+
+func (i Instruction) String() string {
+    return i.listing(i.Text())
+}
+
+// listing lays out the instruction's bytes and text in nestest.log's
+// columns.
+func (i Instruction) listing(text string) string {
     c := ' '
     if i.op.illegal {
         c = '*'
     }
     switch i.arglen {
     case 0:
-        return fmt.Sprintf("%02X       %c%v %s", i.opcode, c, i.op, args)
+        return fmt.Sprintf("%02X       %c%-31s", i.opcode, c, text)
     case 1:
-        return fmt.Sprintf("%02X %02X    %c%v %s", i.opcode, i.args[0], c, i.op, args)
+        return fmt.Sprintf("%02X %02X    %c%-31s", i.opcode, i.args[0], c, text)
     case 2:
-        return fmt.Sprintf("%02X %02X %02X %c%v %s", i.opcode, i.args[0], i.args[1], c, i.op, args)
+        return fmt.Sprintf("%02X %02X %02X %c%-31s", i.opcode, i.args[0], i.args[1], c, text)
     default:
         return ""
     }
     return ""
 }
 
-func (c *CPU) nextInstruction() Instruction {
-    opcode := c.nextByte()
-    extra_cycles := 0
+// Len returns how many bytes the instruction takes up.
+func (i Instruction) Len() int {
+    return 1 + i.arglen
+}
+
+// Target returns the address a branch, JSR or absolute JMP goes to.
+func (i Instruction) Target() (uint16, bool) {
+    switch true {
+    case i.op.addr_mode == REL:
+        return uint16(i.addr), true
+    case i.op.op == JSR, i.op.op == JMP && i.op.addr_mode == ABS:
+        return uint16(i.addr), true
+    }
+    return 0, false
+}
+
+// decode reads the instruction at pc without running it or touching
+// anything with side effects, for the -d dump.
+func (c *CPU) decode(pc word) Instruction {
+    return decodeInstruction(func(addr word) byte { return c.m.peekMem(addr) }, pc)
+}
+
+// decodeInstruction decodes the instruction at pc, fetching its bytes with
+// read.
+func decodeInstruction(read func(word) byte, pc word) Instruction {
+    opcode := read(pc)
     op := Opcodes[opcode]
     args := [2]byte{0, 0}
     arglen := 0
     var operand byte = 0
     var addr word = 0
-    var i_addr word = 0
     switch op.addr_mode {
-    case IMM:
-        operand = c.nextByte()
-        args[0] = operand
-        arglen = 1
-    case ZP:
-        addr = word(c.nextByte())
-        operand = c.getMem(addr)
-        args[0] = byte(addr)
-        arglen = 1
-    case ZP_ST:
-        addr = word(c.nextByte())
-        args[0] = byte(addr)
-        arglen = 1
-    case ABS:
-        addr, args[1], args[0] = c.nextWordArgs()
-        if op.op != JMP {
-            operand = c.getMem(addr)
-        }
-        arglen = 2
-    case ABS_ST:
-        addr, args[1], args[0] = c.nextWordArgs()
-        arglen = 2
-    case ABSI:
-        i_addr, args[1], args[0] = c.nextWordArgs()
-        addr = wordFromBytes(c.getMem((i_addr+1)&0xff+(i_addr&0xff00)), (c.getMem(i_addr)))
-        arglen = 2
-    case ABSY:
-        i_addr, args[1], args[0] = c.nextWordArgs()
-        addr = i_addr + word(c.y)&0xffff
-        operand = c.getMem((i_addr&0xff00)|(addr&0xff))
-        if !op.store {
-            if i_addr&0xff00 != addr&0xff00 || op.extra_page_cross == 0 {
-                operand = c.getMem(addr)
-                extra_cycles += op.extra_page_cross
-            }
-        }
-        arglen = 2
-    case ABSX:
-        i_addr, args[1], args[0] = c.nextWordArgs()
-        addr = (i_addr+word(c.x)) & 0xffff
-        operand = c.getMem((i_addr&0xff00)|(addr&0xff))
-        if !op.store {
-            if i_addr&0xff00 != addr&0xff00 || op.extra_page_cross == 0 {
-                operand = c.getMem(addr)
-                extra_cycles += op.extra_page_cross
-            }
-        }
-        arglen = 2
-    case REL:
-        off := int8(c.nextByte())
-        addr = word(off) + c.pc
-        args[0] = byte(off)
-        arglen = 1
-    case IXID:
-        args[0] = c.nextByte()
-        c.getMem(word(args[0])) //dummy
-        i_addr = word((args[0] + c.x) & 0xff)
-        addr = wordFromBytes(c.getMem((i_addr+1)&0xff), c.getMem(i_addr))
-        if !op.store {
-            operand = c.getMem(addr)
-        }
-        arglen = 1
-    case IDIX:
-        args[0] = c.nextByte()
-        addr = wordFromBytes(c.getMem(word(args[0]+1&0xff)),
-            c.getMem(word(args[0])))
-        addr += word(c.y)
-        addr &= 0xffff
-        //fetch from same page
-        operand = c.getMem(((addr-word(c.y))&0xff00)|(addr&0xff))
-        if (addr&0xff00 != (addr-word(c.y))&0xff00 ||
-            op.extra_page_cross == 0) && !op.store {
-            //fetch correct address
-            operand = c.getMem(addr)
-            extra_cycles += op.extra_page_cross
-        }
-        arglen = 1
-    case ZPX:
-        args[0] = c.nextByte()
-        c.getMem(word(args[0])) //dummy
-        addr = word((args[0] + c.x) & 0xff)
-        if !op.store {
-            operand = c.getMem(addr)
-        }
-        arglen = 1
-    case ZPY:
-        args[0] = c.nextByte()
-        addr = word((args[0] + c.y) & 0xff)
-        c.getMem(word(args[0])) //dummy
-        if !op.store {
-            operand = c.getMem(addr)
-        }
-        arglen = 1
     case IMP, A:
-        //dummy read
-        c.getMem(c.pc+1)
-    default:
         arglen = 0
+    case ABS, ABS_ST, ABSI, ABSX, ABSY:
+        arglen = 2
+    default:
+        arglen = 1
+    }
+    for i := 0; i < arglen; i++ {
+        args[i] = read(pc + 1 + word(i))
+    }
+    switch op.addr_mode {
+    case IMM:
+        operand = args[0]
+    case REL:
+        addr = pc + 2 + word(int8(args[0]))
+    case ZP, ZP_ST, ZPX, ZPY, IXID, IDIX:
+        addr = word(args[0])
+    case ABS, ABS_ST, ABSI, ABSX, ABSY:
+        addr = wordFromBytes(args[1], args[0])
     }
-    return Instruction{op, opcode, extra_cycles, addr, operand, args, arglen}
+    return Instruction{op, opcode, addr, operand, args, arglen}
 }
@@ -0,0 +1,172 @@
+package lua
+
+import (
+    "os"
+    "runtime"
+)
+
+// A Coroutine runs a function on a goroutine of its own, which only runs
+// while whoever resumed it waits, so the interpreter is never used by two
+// goroutines at once.
+type Coroutine struct {
+    fn      Value
+    status  string //suspended, running, normal or dead
+    started bool
+    closed  bool
+    depth   int
+    resume  chan []Value
+    yield   chan coResult
+}
+
+type coResult struct {
+    vals []Value
+    err  *Error
+    done bool
+}
+
+// NewCoroutine makes a coroutine that calls fn when it's first resumed.
+func (L *State) NewCoroutine(fn Value) *Coroutine {
+    return &Coroutine{fn: fn, status: "suspended", resume: make(chan []Value), yield: make(chan coResult)}
+}
+
+// Running gives the coroutine that's running, or nil outside of them.
+func (L *State) Running() *Coroutine {
+    return L.co
+}
+
+// Dead says whether the coroutine's function has returned or raised an
+// error.
+func (co *Coroutine) Dead() bool {
+    return co.status == "dead"
+}
+
+// Resume runs co until it yields or finishes, giving the values it yields
+// or returns, or the error it raises.
+func (L *State) Resume(co *Coroutine, args ...Value) ([]Value, os.Error) {
+    switch co.status {
+    case "dead":
+        return nil, &Error{"cannot resume dead coroutine"}
+    case "running", "normal":
+        return nil, &Error{"cannot resume non-suspended coroutine"}
+    }
+    prev, depth := L.co, L.depth
+    if prev != nil {
+        prev.status = "normal"
+    }
+    L.co, L.depth, co.status = co, co.depth, "running"
+    if !co.started {
+        co.started = true
+        L.track(co)
+        go co.run(L, args)
+    } else {
+        co.resume <- args
+    }
+    r := <-co.yield
+    co.depth, co.status = L.depth, "suspended"
+    L.co, L.depth = prev, depth
+    if prev != nil {
+        prev.status = "running"
+    }
+    if r.done || co.closed {
+        co.status = "dead"
+    }
+    if r.err != nil {
+        return nil, r.err
+    }
+    return r.vals, nil
+}
+
+func (co *Coroutine) run(L *State, args []Value) {
+    defer func() {
+        if r := recover(); r != nil {
+            co.yield <- coResult{err: L.toError(r), done: true}
+        }
+    }()
+    vals := L.call(co.fn, args)
+    co.yield <- coResult{vals: vals, done: true}
+}
+
+// Yield suspends the running coroutine, giving vals to Resume, and gives
+// back the values it's next resumed with.
+func (L *State) Yield(vals []Value) []Value {
+    co := L.co
+    if co == nil {
+        L.Error("attempt to yield from outside a coroutine")
+    }
+    co.yield <- coResult{vals: vals}
+    args, ok := <-co.resume
+    if !ok {
+        //the state was closed, so the coroutine won't be resumed
+        runtime.Goexit()
+    }
+    return args
+}
+
+// track adds a coroutine that's starting to the ones Close ends, leaving
+// out those that have finished.
+func (L *State) track(co *Coroutine) {
+    var started []*Coroutine
+    for _, c := range L.started {
+        if c.status != "dead" {
+            started = append(started, c)
+        }
+    }
+    L.started = append(started, co)
+}
+
+// Close ends the coroutines that haven't finished, so their goroutines
+// don't wait forever to be resumed. None can be resumed afterwards.
+func (L *State) Close() {
+    for _, co := range L.started {
+        if co.status != "dead" {
+            co.status, co.closed = "dead", true
+            close(co.resume)
+        }
+    }
+    L.started = nil
+}
+
+func openCoroutine(L *State) {
+    L.Library("coroutine", map[string]func(L *State, args []Value) []Value{
+        "create": func(L *State, args []Value) []Value {
+            return values(L.NewCoroutine(L.CheckFunction(args, 1, false)))
+        },
+        "resume": func(L *State, args []Value) []Value {
+            co, ok := Arg(args, 1).(*Coroutine)
+            if !ok {
+                L.TypeError(args, 1, "coroutine")
+            }
+            vals, err := L.Resume(co, args[1:]...)
+            if err != nil {
+                return values(false, err.(*Error).Value)
+            }
+            return append([]Value{true}, vals...)
+        },
+        "yield": func(L *State, args []Value) []Value {
+            return L.Yield(args)
+        },
+        "status": func(L *State, args []Value) []Value {
+            co, ok := Arg(args, 1).(*Coroutine)
+            if !ok {
+                L.TypeError(args, 1, "coroutine")
+            }
+            return values(co.status)
+        },
+        "running": func(L *State, args []Value) []Value {
+            if L.co == nil {
+                return values(nil)
+            }
+            return values(L.co)
+        },
+        "wrap": func(L *State, args []Value) []Value {
+            co := L.NewCoroutine(L.CheckFunction(args, 1, false))
+            return values(&GoFunction{"wrap", func(L *State, args []Value) []Value {
+                vals, err := L.Resume(co, args...)
+                if err != nil {
+                    panic(err)
+                }
+                return vals
+            }})
+        },
+    })
+}
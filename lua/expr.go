@@ -0,0 +1,580 @@
+package lua
+
+import (
+    "os"
+)
+
+// An exp is a compiled expression. Calls and ... can give any number of
+// values, with multi; names, fields and indexes can be assigned to, with
+// set.
+type exp struct {
+    get   func(f *frame) Value
+    multi func(f *frame) []Value
+    set   func(f *frame, v Value)
+    what  string //how errors name it, like "global 'x'"
+    call  bool
+    value Value //the value of a constant
+    konst bool
+}
+
+func constant(v Value) *exp {
+    return &exp{get: func(f *frame) Value { return v }, value: v, konst: true}
+}
+
+// evalList works out a list of expressions, the last one giving all its
+// values.
+func evalList(f *frame, es []*exp) []Value {
+    if len(es) == 0 {
+        return nil
+    }
+    last := es[len(es)-1]
+    if last.multi == nil {
+        vals := make([]Value, len(es))
+        for i, e := range es {
+            vals[i] = e.get(f)
+        }
+        return vals
+    }
+    vals := make([]Value, len(es)-1, len(es)+3)
+    for i, e := range es[:len(es)-1] {
+        vals[i] = e.get(f)
+    }
+    return append(vals, last.multi(f)...)
+}
+
+func (p *parser) exprList() ([]*exp, os.Error) {
+    var es []*exp
+    for {
+        e, err := p.expr()
+        if err != nil {
+            return nil, err
+        }
+        es = append(es, e)
+        if !p.is(",") {
+            return es, nil
+        }
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+    }
+    return es, nil
+}
+
+func (p *parser) expr() (*exp, os.Error) {
+    return p.subexpr(0)
+}
+
+// Binary operators' priorities on the left and right; .. and ^ group to
+// the right.
+var priority = map[string][2]int{
+    "or": {1, 1}, "and": {2, 2},
+    "<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+    "..": {5, 4}, "+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+    "^": {10, 9},
+}
+
+const UNARY_PRIORITY = 8
+
+// binaryOp gives the binary operator that's next, if any.
+func (p *parser) binaryOp() string {
+    if p.tok.kind != TOK_OP && p.tok.kind != TOK_KEYWORD {
+        return ""
+    }
+    if _, ok := priority[p.tok.text]; ok {
+        return p.tok.text
+    }
+    return ""
+}
+
+// subexpr compiles operators that bind tighter than limit.
+func (p *parser) subexpr(limit int) (*exp, os.Error) {
+    var e *exp
+    var err os.Error
+    line := p.tok.line
+    if p.is("not") || p.is("-") || p.is("#") {
+        op := p.tok.text
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+        if e, err = p.subexpr(UNARY_PRIORITY); err != nil {
+            return nil, err
+        }
+        e = p.unary(op, e, line)
+    } else if e, err = p.simple(); err != nil {
+        return nil, err
+    }
+    for op := p.binaryOp(); op != "" && priority[op][0] > limit; op = p.binaryOp() {
+        line := p.tok.line
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+        r, err := p.subexpr(priority[op][1])
+        if err != nil {
+            return nil, err
+        }
+        e = p.binary(op, e, r, line)
+    }
+    return e, nil
+}
+
+func (p *parser) simple() (*exp, os.Error) {
+    t := p.tok
+    switch true {
+    case t.kind == TOK_NUMBER:
+        return constant(t.num), p.next()
+    case t.kind == TOK_STRING:
+        return constant(t.text), p.next()
+    case p.is("nil"):
+        return constant(nil), p.next()
+    case p.is("true"):
+        return constant(true), p.next()
+    case p.is("false"):
+        return constant(false), p.next()
+    case p.is("..."):
+        if !p.fs.varargs {
+            return nil, p.error("cannot use '...' outside a vararg function near '...'")
+        }
+        return &exp{
+            get:   func(f *frame) Value { return first(f.varargs) },
+            multi: func(f *frame) []Value { return f.varargs },
+        }, p.next()
+    case p.is("{"):
+        return p.table()
+    case p.is("function"):
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        return p.body(false, t.line)
+    }
+    return p.suffixed()
+}
+
+// variable compiles a name as a local, upvalue or global.
+func (p *parser) variable(name string) *exp {
+    kind, i := p.fs.resolve(name)
+    what := kind + " '" + name + "'"
+    switch kind {
+    case "local":
+        return &exp{
+            get:  func(f *frame) Value { return *f.slots[i] },
+            set:  func(f *frame, v Value) { *f.slots[i] = v },
+            what: what,
+        }
+    case "upvalue":
+        return &exp{
+            get:  func(f *frame) Value { return *f.up[i] },
+            set:  func(f *frame, v Value) { *f.up[i] = v },
+            what: what,
+        }
+    }
+    return &exp{
+        get: func(f *frame) Value {
+            g := f.L.Globals
+            if v := g.GetString(name); v != nil || g.meta == nil {
+                return v
+            }
+            return f.L.Index(g, name)
+        },
+        set: func(f *frame, v Value) {
+            if g := f.L.Globals; g.meta == nil {
+                g.Set(name, v)
+            } else {
+                f.L.SetIndex(g, name, v)
+            }
+        },
+        what: what,
+    }
+}
+
+// primary compiles a name or an expression in brackets.
+func (p *parser) primary() (*exp, os.Error) {
+    if p.tok.kind == TOK_NAME {
+        name := p.tok.text
+        return p.variable(name), p.next()
+    }
+    if !p.is("(") {
+        return nil, p.error("unexpected symbol near '%s'", p.near())
+    }
+    line := p.tok.line
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    e, err := p.expr()
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match(")", "(", line); err != nil {
+        return nil, err
+    }
+    //brackets cut a call down to one value
+    return &exp{get: e.get, what: e.what}, nil
+}
+
+// suffixed compiles a primary expression followed by fields, indexes and
+// calls.
+func (p *parser) suffixed() (*exp, os.Error) {
+    e, err := p.primary()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        line := p.tok.line
+        switch true {
+        case p.is("."):
+            if err = p.next(); err != nil {
+                return nil, err
+            }
+            name, err := p.name()
+            if err != nil {
+                return nil, err
+            }
+            e = p.index(e, constant(name), "field '"+name+"'", line)
+        case p.is("["):
+            if err = p.next(); err != nil {
+                return nil, err
+            }
+            k, err := p.expr()
+            if err != nil {
+                return nil, err
+            }
+            if err = p.expect("]"); err != nil {
+                return nil, err
+            }
+            what := "field '?'"
+            if s, ok := k.value.(string); ok && k.konst {
+                what = "field '" + s + "'"
+            }
+            e = p.index(e, k, what, line)
+        case p.is(":"):
+            if err = p.next(); err != nil {
+                return nil, err
+            }
+            name, err := p.name()
+            if err != nil {
+                return nil, err
+            }
+            args, err := p.args()
+            if err != nil {
+                return nil, err
+            }
+            e = p.methodCall(e, name, args, line)
+        case p.is("(") || p.is("{") || p.tok.kind == TOK_STRING:
+            args, err := p.args()
+            if err != nil {
+                return nil, err
+            }
+            e = p.callExp(e, args, line)
+        default:
+            return e, nil
+        }
+    }
+    return e, nil
+}
+
+// args compiles a call's arguments: a list in brackets, a table or a
+// string.
+func (p *parser) args() ([]*exp, os.Error) {
+    switch true {
+    case p.tok.kind == TOK_STRING:
+        s := p.tok.text
+        return []*exp{constant(s)}, p.next()
+    case p.is("{"):
+        t, err := p.table()
+        if err != nil {
+            return nil, err
+        }
+        return []*exp{t}, nil
+    }
+    line := p.tok.line
+    if err := p.expect("("); err != nil {
+        return nil, err
+    }
+    if p.is(")") {
+        return nil, p.next()
+    }
+    es, err := p.exprList()
+    if err != nil {
+        return nil, err
+    }
+    return es, p.match(")", "(", line)
+}
+
+// index compiles o[k].
+func (p *parser) index(o *exp, k *exp, what string, line int) *exp {
+    where := p.where(line)
+    obj, key := o.get, k.get
+    return &exp{
+        get: func(f *frame) Value {
+            v, k := obj(f), key(f)
+            if t, ok := v.(*Table); ok {
+                if r := t.Get(k); r != nil || t.meta == nil {
+                    return r
+                }
+            } else if _, ok := v.(string); !ok {
+                f.L.errorAt(where, "attempt to index %s (a %s value)", o.what, TypeName(v))
+            }
+            f.L.where = where
+            return f.L.Index(v, k)
+        },
+        set: func(f *frame, val Value) {
+            v, k := obj(f), key(f)
+            f.L.where = where
+            if t, ok := v.(*Table); ok && t.meta == nil {
+                t.Set(f.L.key(k), val)
+                return
+            }
+            if _, ok := v.(*Table); !ok {
+                f.L.errorAt(where, "attempt to index %s (a %s value)", o.what, TypeName(v))
+            }
+            f.L.SetIndex(v, k, val)
+        },
+        what: what,
+    }
+}
+
+// callExp compiles fn(args).
+func (p *parser) callExp(fn *exp, args []*exp, line int) *exp {
+    where := p.where(line)
+    get := fn.get
+    m := func(f *frame) []Value {
+        v := get(f)
+        vals := evalList(f, args)
+        f.L.where = where
+        switch v.(type) {
+        case *Function, *GoFunction:
+        default:
+            if f.L.metamethod(v, "__call") == nil {
+                f.L.errorAt(where, "attempt to call %s (a %s value)", fn.what, TypeName(v))
+            }
+        }
+        return f.L.call(v, vals)
+    }
+    return &exp{get: func(f *frame) Value { return first(m(f)) }, multi: m, call: true}
+}
+
+// methodCall compiles o:name(args), which passes o as the first argument.
+func (p *parser) methodCall(o *exp, name string, args []*exp, line int) *exp {
+    where := p.where(line)
+    obj := o.get
+    m := func(f *frame) []Value {
+        v := obj(f)
+        f.L.where = where
+        switch v.(type) {
+        case *Table, string:
+        default:
+            f.L.errorAt(where, "attempt to index %s (a %s value)", o.what, TypeName(v))
+        }
+        fn := f.L.Index(v, name)
+        vals := append([]Value{v}, evalList(f, args)...)
+        f.L.where = where
+        switch fn.(type) {
+        case *Function, *GoFunction:
+        default:
+            if f.L.metamethod(fn, "__call") == nil {
+                f.L.errorAt(where, "attempt to call method '%s' (a %s value)", name, TypeName(fn))
+            }
+        }
+        return f.L.call(fn, vals)
+    }
+    return &exp{get: func(f *frame) Value { return first(m(f)) }, multi: m, call: true}
+}
+
+// table compiles a table constructor.
+func (p *parser) table() (*exp, os.Error) {
+    line := p.tok.line
+    if err := p.expect("{"); err != nil {
+        return nil, err
+    }
+    var keys, vals []*exp //keys are nil for positional fields
+    for !p.is("}") {
+        switch true {
+        case p.is("["):
+            if err := p.next(); err != nil {
+                return nil, err
+            }
+            k, err := p.expr()
+            if err != nil {
+                return nil, err
+            }
+            if err = p.expect("]"); err != nil {
+                return nil, err
+            }
+            if err = p.expect("="); err != nil {
+                return nil, err
+            }
+            v, err := p.expr()
+            if err != nil {
+                return nil, err
+            }
+            keys, vals = append(keys, k), append(vals, v)
+        case p.tok.kind == TOK_NAME:
+            //name = value, unless it's an expression starting with a name
+            save, lex := p.tok, *p.lex
+            name := p.tok.text
+            if err := p.next(); err != nil {
+                return nil, err
+            }
+            if p.is("=") {
+                if err := p.next(); err != nil {
+                    return nil, err
+                }
+                v, err := p.expr()
+                if err != nil {
+                    return nil, err
+                }
+                keys, vals = append(keys, constant(name)), append(vals, v)
+                break
+            }
+            p.tok, *p.lex = save, lex
+            fallthrough
+        default:
+            v, err := p.expr()
+            if err != nil {
+                return nil, err
+            }
+            keys, vals = append(keys, nil), append(vals, v)
+        }
+        if !p.is(",") && !p.is(";") {
+            break
+        }
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+    }
+    if err := p.match("}", "{", line); err != nil {
+        return nil, err
+    }
+    where := p.where(line)
+    return &exp{get: func(f *frame) Value {
+        t := NewTable()
+        n := 0
+        for i, v := range vals {
+            if keys[i] != nil {
+                k := keys[i].get(f)
+                f.L.where = where
+                if val := v.get(f); val != nil {
+                    t.Set(f.L.key(k), val)
+                }
+                continue
+            }
+            if i == len(vals)-1 && v.multi != nil {
+                for _, val := range v.multi(f) {
+                    n++
+                    t.Set(float64(n), val)
+                }
+                continue
+            }
+            n++
+            t.Set(float64(n), v.get(f))
+        }
+        return t
+    }}, nil
+}
+
+// unary compiles not, - and #.
+func (p *parser) unary(op string, e *exp, line int) *exp {
+    where := p.where(line)
+    x := e.get
+    switch op {
+    case "not":
+        return &exp{get: func(f *frame) Value { return !Truth(x(f)) }}
+    case "-":
+        if n, ok := e.value.(float64); ok && e.konst {
+            return constant(-n)
+        }
+        return &exp{get: func(f *frame) Value {
+            v := x(f)
+            if n, ok := v.(float64); ok {
+                return -n
+            }
+            f.L.where = where
+            return f.L.arith(OP_UNM, v, v)
+        }}
+    }
+    return &exp{get: func(f *frame) Value {
+        v := x(f)
+        if t, ok := v.(*Table); ok && t.meta == nil {
+            return float64(t.Len())
+        }
+        f.L.where = where
+        return f.L.Len(v)
+    }}
+}
+
+var arithOps = map[string]int{"+": OP_ADD, "-": OP_SUB, "*": OP_MUL, "/": OP_DIV, "%": OP_MOD, "^": OP_POW}
+
+// binary compiles a binary operator.
+func (p *parser) binary(op string, l *exp, r *exp, line int) *exp {
+    where := p.where(line)
+    a, b := l.get, r.get
+    var get func(f *frame) Value
+    switch op {
+    case "and":
+        get = func(f *frame) Value {
+            if v := a(f); !Truth(v) {
+                return v
+            }
+            return b(f)
+        }
+    case "or":
+        get = func(f *frame) Value {
+            if v := a(f); Truth(v) {
+                return v
+            }
+            return b(f)
+        }
+    case "==", "~=":
+        eq := op == "=="
+        get = func(f *frame) Value {
+            x, y := a(f), b(f)
+            if RawEqual(x, y) {
+                return eq
+            }
+            if _, ok := x.(*Table); !ok {
+                return !eq
+            }
+            f.L.where = where
+            return f.L.Equal(x, y) == eq
+        }
+    case "<", "<=", ">", ">=":
+        swap := op[0] == '>'
+        orEqual := len(op) == 2
+        get = func(f *frame) Value {
+            x, y := a(f), b(f)
+            if swap {
+                x, y = y, x
+            }
+            if n, ok := x.(float64); ok {
+                if m, ok := y.(float64); ok {
+                    return n < m || orEqual && n == m
+                }
+            }
+            f.L.where = where
+            return f.L.Less(x, y, orEqual)
+        }
+    case "..":
+        get = func(f *frame) Value {
+            x, y := a(f), b(f)
+            if s, ok := x.(string); ok {
+                if t, ok := y.(string); ok {
+                    return s + t
+                }
+            }
+            f.L.where = where
+            return f.L.Concat(x, y)
+        }
+    default:
+        n := arithOps[op]
+        get = func(f *frame) Value {
+            x, y := a(f), b(f)
+            if i, ok := x.(float64); ok {
+                if j, ok := y.(float64); ok {
+                    return arithNumbers(n, i, j)
+                }
+            }
+            f.L.where = where
+            return f.L.arith(n, x, y)
+        }
+    }
+    return &exp{get: get}
+}
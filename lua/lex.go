@@ -0,0 +1,249 @@
+package lua
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Kinds of token. Operators and punctuation are their own text.
+const (
+    TOK_EOF = iota
+    TOK_NAME
+    TOK_NUMBER
+    TOK_STRING
+    TOK_KEYWORD
+    TOK_OP
+)
+
+var keywords = map[string]bool{
+    "and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+    "false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+    "nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+    "true": true, "until": true, "while": true,
+}
+
+// ops are the operators, longest first so ... isn't read as .. and .
+var ops = []string{"...", "..", "==", "~=", "<=", ">=", "+", "-", "*", "/", "%", "^", "#",
+    "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", "."}
+
+type token struct {
+    kind int
+    text string //the name, keyword, operator or string's contents
+    num  float64
+    line int
+}
+
+type lexer struct {
+    src  string
+    name string
+    pos  int
+    line int
+}
+
+// A SyntaxError is a chunk that doesn't compile.
+type SyntaxError struct {
+    Name string
+    Line int
+    Msg  string
+}
+
+func (e *SyntaxError) String() string {
+    return fmt.Sprintf("%s:%d: %s", e.Name, e.Line, e.Msg)
+}
+
+func newLexer(src string, name string) *lexer {
+    return &lexer{src: src, name: name, line: 1}
+}
+
+func (l *lexer) error(format string, args ...interface{}) os.Error {
+    return &SyntaxError{l.name, l.line, fmt.Sprintf(format, args...)}
+}
+
+// skip skips spaces and comments.
+func (l *lexer) skip() os.Error {
+    for l.pos < len(l.src) {
+        c := l.src[l.pos]
+        switch true {
+        case c == '\n':
+            l.line++
+            l.pos++
+        case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+            l.pos++
+        case strings.HasPrefix(l.src[l.pos:], "--"):
+            l.pos += 2
+            if level := l.longBracket(); level >= 0 {
+                if _, err := l.longString(level); err != nil {
+                    return err
+                }
+                continue
+            }
+            for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+                l.pos++
+            }
+        default:
+            return nil
+        }
+    }
+    return nil
+}
+
+// longBracket gives the level of a [[ or [==[ at pos, or -1.
+func (l *lexer) longBracket() int {
+    if l.pos >= len(l.src) || l.src[l.pos] != '[' {
+        return -1
+    }
+    i := l.pos + 1
+    for i < len(l.src) && l.src[i] == '=' {
+        i++
+    }
+    if i < len(l.src) && l.src[i] == '[' {
+        return i - l.pos - 1
+    }
+    return -1
+}
+
+// longString reads a [[string]] of a level, from its opening bracket.
+func (l *lexer) longString(level int) (string, os.Error) {
+    l.pos += level + 2
+    if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+        l.pos++
+    }
+    if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+        //a newline straight after the bracket isn't part of the string
+        l.line++
+        l.pos++
+    }
+    closing := "]" + strings.Repeat("=", level) + "]"
+    end := strings.Index(l.src[l.pos:], closing)
+    if end < 0 {
+        return "", l.error("unfinished long string")
+    }
+    s := l.src[l.pos : l.pos+end]
+    l.line += strings.Count(s, "\n")
+    l.pos += end + len(closing)
+    return s, nil
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+    return c == '_' || isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// next reads a token.
+func (l *lexer) next() (token, os.Error) {
+    if err := l.skip(); err != nil {
+        return token{}, err
+    }
+    t := token{line: l.line}
+    if l.pos == len(l.src) {
+        return t, nil
+    }
+    c := l.src[l.pos]
+    switch true {
+    case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+        start := l.pos
+        for l.pos < len(l.src) && (isNameChar(l.src[l.pos]) || l.src[l.pos] == '.' ||
+            (l.src[l.pos] == '-' || l.src[l.pos] == '+') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+            l.pos++
+        }
+        n, ok := parseNumber(l.src[start:l.pos])
+        if !ok {
+            return t, l.error("malformed number near '%s'", l.src[start:l.pos])
+        }
+        t.kind, t.num = TOK_NUMBER, n
+    case isNameChar(c):
+        start := l.pos
+        for l.pos < len(l.src) && isNameChar(l.src[l.pos]) {
+            l.pos++
+        }
+        t.kind, t.text = TOK_NAME, l.src[start:l.pos]
+        if keywords[t.text] {
+            t.kind = TOK_KEYWORD
+        }
+    case c == '"' || c == '\'':
+        s, err := l.quoted(c)
+        if err != nil {
+            return t, err
+        }
+        t.kind, t.text = TOK_STRING, s
+    case c == '[' && l.longBracket() >= 0:
+        s, err := l.longString(l.longBracket())
+        if err != nil {
+            return t, err
+        }
+        t.kind, t.text = TOK_STRING, s
+    default:
+        for _, op := range ops {
+            if strings.HasPrefix(l.src[l.pos:], op) {
+                l.pos += len(op)
+                t.kind, t.text = TOK_OP, op
+                return t, nil
+            }
+        }
+        return t, l.error("unexpected symbol near '%c'", c)
+    }
+    return t, nil
+}
+
+// quoted reads a string in quotes, with its escapes.
+func (l *lexer) quoted(quote byte) (string, os.Error) {
+    var b []byte
+    for l.pos++; ; l.pos++ {
+        if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+            return "", l.error("unfinished string")
+        }
+        c := l.src[l.pos]
+        if c == quote {
+            l.pos++
+            return string(b), nil
+        }
+        if c != '\\' {
+            b = append(b, c)
+            continue
+        }
+        if l.pos++; l.pos >= len(l.src) {
+            return "", l.error("unfinished string")
+        }
+        c = l.src[l.pos]
+        switch c {
+        case 'a':
+            b = append(b, '\a')
+        case 'b':
+            b = append(b, '\b')
+        case 'f':
+            b = append(b, '\f')
+        case 'n':
+            b = append(b, '\n')
+        case 'r':
+            b = append(b, '\r')
+        case 't':
+            b = append(b, '\t')
+        case 'v':
+            b = append(b, '\v')
+        case '\n':
+            l.line++
+            b = append(b, '\n')
+        default:
+            if !isDigit(c) {
+                //\\, \", \' and anything else stand for themselves
+                b = append(b, c)
+                continue
+            }
+            n := 0
+            for i := 0; i < 3 && l.pos < len(l.src) && isDigit(l.src[l.pos]); i++ {
+                n = n*10 + int(l.src[l.pos]-'0')
+                l.pos++
+            }
+            l.pos--
+            if n > 255 {
+                return "", l.error("escape sequence too large")
+            }
+            b = append(b, byte(n))
+        }
+    }
+    return "", nil
+}
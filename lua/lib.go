@@ -0,0 +1,559 @@
+package lua
+
+import (
+    "math"
+    "os"
+    "rand"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Arg gives argument i, counting from 1, or nil.
+func Arg(args []Value, i int) Value {
+    if i > len(args) {
+        return nil
+    }
+    return args[i-1]
+}
+
+// ArgError raises the error for a bad argument to the Go function being
+// called.
+func (L *State) ArgError(i int, msg string) {
+    L.Error("bad argument #%d to '%s' (%s)", i, L.fname, msg)
+}
+
+// TypeError raises the error for an argument of the wrong type.
+func (L *State) TypeError(args []Value, i int, want string) {
+    got := "no value"
+    if i <= len(args) {
+        got = TypeName(args[i-1])
+    }
+    L.ArgError(i, want+" expected, got "+got)
+}
+
+// CheckNumber gives argument i as a number, raising an error if it isn't
+// one.
+func (L *State) CheckNumber(args []Value, i int) float64 {
+    n, ok := ToNumber(Arg(args, i))
+    if !ok {
+        L.TypeError(args, i, "number")
+    }
+    return n
+}
+
+// CheckInt gives argument i as a whole number.
+func (L *State) CheckInt(args []Value, i int) int {
+    return int(L.CheckNumber(args, i))
+}
+
+// OptInt gives argument i as a whole number, or def if it's nil.
+func (L *State) OptInt(args []Value, i int, def int) int {
+    if Arg(args, i) == nil {
+        return def
+    }
+    return L.CheckInt(args, i)
+}
+
+// CheckString gives argument i as a string, converting numbers.
+func (L *State) CheckString(args []Value, i int) string {
+    switch v := Arg(args, i).(type) {
+    case string:
+        return v
+    case float64:
+        return NumberString(v)
+    }
+    L.TypeError(args, i, "string")
+    return ""
+}
+
+// OptString gives argument i as a string, or def if it's nil.
+func (L *State) OptString(args []Value, i int, def string) string {
+    if Arg(args, i) == nil {
+        return def
+    }
+    return L.CheckString(args, i)
+}
+
+// CheckTable gives argument i as a table.
+func (L *State) CheckTable(args []Value, i int) *Table {
+    t, ok := Arg(args, i).(*Table)
+    if !ok {
+        L.TypeError(args, i, "table")
+    }
+    return t
+}
+
+// CheckFunction checks argument i is a function, or nil if nilOK.
+func (L *State) CheckFunction(args []Value, i int, nilOK bool) Value {
+    switch v := Arg(args, i).(type) {
+    case *Function, *GoFunction:
+        return v
+    case nil:
+        if nilOK {
+            return nil
+        }
+    }
+    L.TypeError(args, i, "function")
+    return nil
+}
+
+// Library makes a table of Go functions and sets it as a global, unless
+// name is empty.
+func (L *State) Library(name string, fns map[string]func(L *State, args []Value) []Value) *Table {
+    t := NewTable()
+    for n, fn := range fns {
+        t.Set(n, &GoFunction{n, fn})
+    }
+    if name != "" {
+        L.Globals.Set(name, t)
+    }
+    return t
+}
+
+func values(vals ...Value) []Value {
+    return vals
+}
+
+func openBase(L *State) {
+    g := L.Globals
+    g.Set("_G", g)
+    g.Set("_VERSION", "Lua 5.1")
+    for n, fn := range map[string]func(L *State, args []Value) []Value{
+        "assert": func(L *State, args []Value) []Value {
+            if !Truth(Arg(args, 1)) {
+                if len(args) > 1 {
+                    panic(&Error{Value: args[1]})
+                }
+                L.Error("assertion failed!")
+            }
+            return args
+        },
+        "error": func(L *State, args []Value) []Value {
+            v := Arg(args, 1)
+            if s, ok := v.(string); ok && L.OptInt(args, 2, 1) > 0 {
+                v = L.where + s
+            }
+            panic(&Error{Value: v})
+        },
+        "pcall": func(L *State, args []Value) []Value {
+            if len(args) == 0 {
+                L.ArgError(1, "value expected")
+            }
+            rets, err := L.Call(args[0], args[1:]...)
+            if err != nil {
+                return values(false, err.(*Error).Value)
+            }
+            return append([]Value{true}, rets...)
+        },
+        "xpcall": func(L *State, args []Value) []Value {
+            rets, err := L.Call(Arg(args, 1))
+            if err != nil {
+                return append([]Value{false}, L.call(Arg(args, 2), []Value{err.(*Error).Value})...)
+            }
+            return append([]Value{true}, rets...)
+        },
+        "print": func(L *State, args []Value) []Value {
+            s := make([]string, len(args))
+            for i, v := range args {
+                s[i] = L.ToStringMeta(v)
+            }
+            L.Out.Write([]byte(strings.Join(s, "\t") + "\n"))
+            return nil
+        },
+        "type": func(L *State, args []Value) []Value {
+            if len(args) == 0 {
+                L.ArgError(1, "value expected")
+            }
+            return values(TypeName(args[0]))
+        },
+        "tostring": func(L *State, args []Value) []Value {
+            return values(L.ToStringMeta(Arg(args, 1)))
+        },
+        "tonumber": func(L *State, args []Value) []Value {
+            base := L.OptInt(args, 2, 10)
+            if base == 10 {
+                if n, ok := ToNumber(Arg(args, 1)); ok {
+                    return values(n)
+                }
+                return values(nil)
+            }
+            s := strings.ToLower(strings.TrimSpace(L.CheckString(args, 1)))
+            if n, err := strconv.Btoui64(s, base); err == nil {
+                return values(float64(n))
+            }
+            return values(nil)
+        },
+        "ipairs": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            return values(&GoFunction{"ipairs_iterator", func(L *State, args []Value) []Value {
+                i := L.CheckInt(args, 2) + 1
+                if v := t.Get(float64(i)); v != nil {
+                    return values(float64(i), v)
+                }
+                return values(nil)
+            }}, t, 0.0)
+        },
+        "pairs": func(L *State, args []Value) []Value {
+            return values(g.Get("next"), L.CheckTable(args, 1), nil)
+        },
+        "next": func(L *State, args []Value) []Value {
+            k, v, ok := L.CheckTable(args, 1).Next(Arg(args, 2))
+            if !ok {
+                L.Error("invalid key to 'next'")
+            }
+            if k == nil {
+                return values(nil)
+            }
+            return values(k, v)
+        },
+        "select": func(L *State, args []Value) []Value {
+            if s, ok := Arg(args, 1).(string); ok && s == "#" {
+                return values(float64(len(args) - 1))
+            }
+            n := L.CheckInt(args, 1)
+            if n < 0 {
+                n += len(args)
+            }
+            if n < 1 {
+                L.ArgError(1, "index out of range")
+            }
+            if n >= len(args) {
+                return nil
+            }
+            return args[n:]
+        },
+        "unpack": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            i, j := L.OptInt(args, 2, 1), L.OptInt(args, 3, t.Len())
+            var vals []Value
+            for ; i <= j; i++ {
+                vals = append(vals, t.Get(float64(i)))
+            }
+            return vals
+        },
+        "rawget": func(L *State, args []Value) []Value {
+            return values(L.CheckTable(args, 1).Get(Arg(args, 2)))
+        },
+        "rawset": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            t.Set(L.key(Arg(args, 2)), Arg(args, 3))
+            return values(t)
+        },
+        "rawequal": func(L *State, args []Value) []Value {
+            return values(RawEqual(Arg(args, 1), Arg(args, 2)))
+        },
+        "setmetatable": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            switch m := Arg(args, 2).(type) {
+            case nil:
+                t.meta = nil
+            case *Table:
+                t.meta = m
+            default:
+                L.TypeError(args, 2, "nil or table")
+            }
+            return values(t)
+        },
+        "getmetatable": func(L *State, args []Value) []Value {
+            var meta *Table
+            switch v := Arg(args, 1).(type) {
+            case *Table:
+                meta = v.meta
+            case string:
+                meta = L.strmeta
+            }
+            if meta == nil {
+                return values(nil)
+            }
+            if protected := meta.GetString("__metatable"); protected != nil {
+                return values(protected)
+            }
+            return values(meta)
+        },
+        "loadstring": func(L *State, args []Value) []Value {
+            s := L.CheckString(args, 1)
+            name := s
+            if i := strings.Index(name, "\n"); i >= 0 {
+                name = name[:i] + "..."
+            }
+            fn, err := L.Load(s, L.OptString(args, 2, `[string "`+name+`"]`))
+            if err != nil {
+                return values(nil, err.String())
+            }
+            return values(fn)
+        },
+        "dofile": func(L *State, args []Value) []Value {
+            fn, err := L.LoadFile(L.CheckString(args, 1))
+            if err != nil {
+                L.Error("%v", err)
+            }
+            return L.call(fn, nil)
+        },
+        "collectgarbage": func(L *State, args []Value) []Value {
+            //Go collects the garbage
+            return values(0.0)
+        },
+    } {
+        L.Register(g, n, fn)
+    }
+}
+
+func openTable(L *State) {
+    L.Library("table", map[string]func(L *State, args []Value) []Value{
+        "insert": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            n := t.Len()
+            switch len(args) {
+            case 2:
+                t.Set(float64(n+1), args[1])
+            case 3:
+                pos := L.CheckInt(args, 2)
+                for i := n; i >= pos; i-- {
+                    t.Set(float64(i+1), t.Get(float64(i)))
+                }
+                t.Set(L.key(float64(pos)), args[2])
+            default:
+                L.Error("wrong number of arguments to 'insert'")
+            }
+            return nil
+        },
+        "remove": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            n := t.Len()
+            pos := L.OptInt(args, 2, n)
+            if n == 0 {
+                return nil
+            }
+            v := t.Get(float64(pos))
+            for i := pos; i < n; i++ {
+                t.Set(float64(i), t.Get(float64(i+1)))
+            }
+            t.Set(float64(n), nil)
+            return values(v)
+        },
+        "concat": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            sep := L.OptString(args, 2, "")
+            i, j := L.OptInt(args, 3, 1), L.OptInt(args, 4, t.Len())
+            var s []string
+            for ; i <= j; i++ {
+                v, ok := concatString(t.Get(float64(i)))
+                if !ok {
+                    L.Error("invalid value (at index %d) in table for 'concat'", i)
+                }
+                s = append(s, v)
+            }
+            return values(strings.Join(s, sep))
+        },
+        "getn": func(L *State, args []Value) []Value {
+            return values(float64(L.CheckTable(args, 1).Len()))
+        },
+        "maxn": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            max := 0.0
+            for k, _, _ := t.Next(nil); k != nil; k, _, _ = t.Next(k) {
+                if n, ok := k.(float64); ok && n > max {
+                    max = n
+                }
+            }
+            return values(max)
+        },
+        "sort": func(L *State, args []Value) []Value {
+            t := L.CheckTable(args, 1)
+            s := &sorter{L, make([]Value, t.Len()), L.CheckFunction(args, 2, true)}
+            for i := range s.vals {
+                s.vals[i] = t.Get(float64(i + 1))
+            }
+            sort.Sort(s)
+            for i, v := range s.vals {
+                t.Set(float64(i+1), v)
+            }
+            return nil
+        },
+    })
+}
+
+type sorter struct {
+    L    *State
+    vals []Value
+    less Value
+}
+
+func (s *sorter) Len() int {
+    return len(s.vals)
+}
+
+func (s *sorter) Less(i int, j int) bool {
+    if s.less == nil {
+        return s.L.Less(s.vals[i], s.vals[j], false)
+    }
+    return Truth(first(s.L.call(s.less, []Value{s.vals[i], s.vals[j]})))
+}
+
+func (s *sorter) Swap(i int, j int) {
+    s.vals[i], s.vals[j] = s.vals[j], s.vals[i]
+}
+
+// math1 wraps a one argument math function.
+func math1(fn func(float64) float64) func(L *State, args []Value) []Value {
+    return func(L *State, args []Value) []Value {
+        return values(fn(L.CheckNumber(args, 1)))
+    }
+}
+
+func openMath(L *State) {
+    t := L.Library("math", map[string]func(L *State, args []Value) []Value{
+        "abs":   math1(math.Fabs),
+        "ceil":  math1(math.Ceil),
+        "floor": math1(math.Floor),
+        "sqrt":  math1(math.Sqrt),
+        "sin":   math1(math.Sin),
+        "cos":   math1(math.Cos),
+        "tan":   math1(math.Tan),
+        "asin":  math1(math.Asin),
+        "acos":  math1(math.Acos),
+        "atan":  math1(math.Atan),
+        "exp":   math1(math.Exp),
+        "log":   math1(math.Log),
+        "log10": math1(math.Log10),
+        "deg":   math1(func(x float64) float64 { return x * 180 / math.Pi }),
+        "rad":   math1(func(x float64) float64 { return x * math.Pi / 180 }),
+        "atan2": func(L *State, args []Value) []Value {
+            return values(math.Atan2(L.CheckNumber(args, 1), L.CheckNumber(args, 2)))
+        },
+        "pow": func(L *State, args []Value) []Value {
+            return values(math.Pow(L.CheckNumber(args, 1), L.CheckNumber(args, 2)))
+        },
+        "fmod": func(L *State, args []Value) []Value {
+            return values(math.Fmod(L.CheckNumber(args, 1), L.CheckNumber(args, 2)))
+        },
+        "modf": func(L *State, args []Value) []Value {
+            i, frac := math.Modf(L.CheckNumber(args, 1))
+            return values(i, frac)
+        },
+        "max": func(L *State, args []Value) []Value {
+            max := L.CheckNumber(args, 1)
+            for i := 2; i <= len(args); i++ {
+                max = math.Fmax(max, L.CheckNumber(args, i))
+            }
+            return values(max)
+        },
+        "min": func(L *State, args []Value) []Value {
+            min := L.CheckNumber(args, 1)
+            for i := 2; i <= len(args); i++ {
+                min = math.Fmin(min, L.CheckNumber(args, i))
+            }
+            return values(min)
+        },
+        "random": func(L *State, args []Value) []Value {
+            switch len(args) {
+            case 0:
+                return values(rand.Float64())
+            case 1:
+                n := L.CheckInt(args, 1)
+                if n < 1 {
+                    L.ArgError(1, "interval is empty")
+                }
+                return values(float64(rand.Intn(n) + 1))
+            }
+            lo, hi := L.CheckInt(args, 1), L.CheckInt(args, 2)
+            if lo > hi {
+                L.ArgError(2, "interval is empty")
+            }
+            return values(float64(lo + rand.Intn(hi-lo+1)))
+        },
+        "randomseed": func(L *State, args []Value) []Value {
+            rand.Seed(int64(L.CheckNumber(args, 1)))
+            return nil
+        },
+    })
+    t.Set("pi", math.Pi)
+    t.Set("huge", math.Inf(1))
+}
+
+// bits gives argument i as the 32 bits the bit library works on.
+func (L *State) bits(args []Value, i int) uint32 {
+    return uint32(int64(L.CheckNumber(args, i)))
+}
+
+func bitResult(b uint32) []Value {
+    return values(float64(int32(b)))
+}
+
+// bitFold wraps and, or and xor, which take any number of arguments.
+func bitFold(fn func(a uint32, b uint32) uint32) func(L *State, args []Value) []Value {
+    return func(L *State, args []Value) []Value {
+        b := L.bits(args, 1)
+        for i := 2; i <= len(args); i++ {
+            b = fn(b, L.bits(args, i))
+        }
+        return bitResult(b)
+    }
+}
+
+// openBit loads LuaBitOp's bit library, which FCEUX has too.
+func openBit(L *State) {
+    L.Library("bit", map[string]func(L *State, args []Value) []Value{
+        "tobit": func(L *State, args []Value) []Value { return bitResult(L.bits(args, 1)) },
+        "bnot":  func(L *State, args []Value) []Value { return bitResult(^L.bits(args, 1)) },
+        "band":  bitFold(func(a uint32, b uint32) uint32 { return a & b }),
+        "bor":   bitFold(func(a uint32, b uint32) uint32 { return a | b }),
+        "bxor":  bitFold(func(a uint32, b uint32) uint32 { return a ^ b }),
+        "lshift": func(L *State, args []Value) []Value {
+            return bitResult(L.bits(args, 1) << (L.bits(args, 2) & 31))
+        },
+        "rshift": func(L *State, args []Value) []Value {
+            return bitResult(L.bits(args, 1) >> (L.bits(args, 2) & 31))
+        },
+        "arshift": func(L *State, args []Value) []Value {
+            return bitResult(uint32(int32(L.bits(args, 1)) >> (L.bits(args, 2) & 31)))
+        },
+        "rol": func(L *State, args []Value) []Value {
+            b, n := L.bits(args, 1), L.bits(args, 2)&31
+            return bitResult(b<<n | b>>(32-n))
+        },
+        "ror": func(L *State, args []Value) []Value {
+            b, n := L.bits(args, 1), L.bits(args, 2)&31
+            return bitResult(b>>n | b<<(32-n))
+        },
+        "tohex": func(L *State, args []Value) []Value {
+            b, n := L.bits(args, 1), L.OptInt(args, 2, 8)
+            digits := "0123456789abcdef"
+            if n < 0 {
+                n, digits = -n, "0123456789ABCDEF"
+            }
+            if n > 8 {
+                n = 8
+            }
+            s := make([]byte, n)
+            for i := n - 1; i >= 0; i-- {
+                s[i] = digits[b&15]
+                b >>= 4
+            }
+            return values(string(s))
+        },
+    })
+}
+
+func openOS(L *State) {
+    start := time.Nanoseconds()
+    L.Library("os", map[string]func(L *State, args []Value) []Value{
+        "time": func(L *State, args []Value) []Value {
+            return values(float64(time.Nanoseconds() / 1e9))
+        },
+        "clock": func(L *State, args []Value) []Value {
+            return values(float64(time.Nanoseconds()-start) / 1e9)
+        },
+        "difftime": func(L *State, args []Value) []Value {
+            return values(L.CheckNumber(args, 1) - L.CheckNumber(args, 2))
+        },
+        "getenv": func(L *State, args []Value) []Value {
+            if v := os.Getenv(L.CheckString(args, 1)); v != "" {
+                return values(v)
+            }
+            return values(nil)
+        },
+    })
+}
@@ -0,0 +1,423 @@
+// Package lua is a Lua 5.1 interpreter, for scripts that drive the
+// emulator. Chunks are compiled to Go closures, the way gones compiles its
+// debugger expressions, and run on the goroutine that calls them; Go
+// functions are called with their arguments in a slice.
+//
+// It leaves out goto, string.dump, io, most of os and the debug library.
+// Coroutines are goroutines taking turns.
+package lua
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "math"
+    "os"
+)
+
+// MAX_DEPTH is how deeply calls can nest before it's a stack overflow.
+const MAX_DEPTH = 200
+
+// A State is an interpreter, with its globals.
+type State struct {
+    Globals  *Table
+    Out      io.Writer //where print goes
+    MaxSteps int       //loop iterations and calls allowed before Steps is reset, or 0 for any number
+    Steps    int
+    where    string //the file and line of the call being made, for errors
+    fname    string //the Go function being called, for errors
+    depth    int
+    strings  *Table //the string library, which strings index
+    strmeta  *Table //strings' metatable
+    co       *Coroutine
+    started  []*Coroutine //coroutines with goroutines, which Close ends
+}
+
+// An Error is a Lua error, with the value it was raised with. Those
+// raised with strings have the file and line they happened at in front.
+type Error struct {
+    Value Value
+}
+
+func (e *Error) String() string {
+    if s, ok := e.Value.(string); ok {
+        return s
+    }
+    if f, ok := e.Value.(float64); ok {
+        return NumberString(f)
+    }
+    return fmt.Sprintf("error object is a %s value", TypeName(e.Value))
+}
+
+// NewState makes an interpreter with the standard library loaded.
+func NewState() *State {
+    L := &State{Globals: NewTable(), Out: os.Stdout}
+    openBase(L)
+    openString(L)
+    openTable(L)
+    openMath(L)
+    openBit(L)
+    openOS(L)
+    openCoroutine(L)
+    return L
+}
+
+// Error raises a Lua error from a Go function, giving where it was called
+// from.
+func (L *State) Error(format string, args ...interface{}) {
+    panic(&Error{Value: L.where + fmt.Sprintf(format, args...)})
+}
+
+// errorAt raises an error from compiled code, at a line of a chunk.
+func (L *State) errorAt(where string, format string, args ...interface{}) {
+    panic(&Error{Value: where + fmt.Sprintf(format, args...)})
+}
+
+// Register sets t[name] to a Go function.
+func (L *State) Register(t *Table, name string, fn func(L *State, args []Value) []Value) {
+    t.Set(name, &GoFunction{name, fn})
+}
+
+// Load compiles a chunk, naming it name in errors.
+func (L *State) Load(src string, name string) (*Function, os.Error) {
+    p := &parser{L: L, lex: newLexer(src, name)}
+    proto, err := p.chunk()
+    if err != nil {
+        return nil, err
+    }
+    return &Function{proto: proto}, nil
+}
+
+// LoadFile compiles a file.
+func (L *State) LoadFile(fname string) (*Function, os.Error) {
+    f, err := os.Open(fname)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var b bytes.Buffer
+    if _, err = b.ReadFrom(f); err != nil {
+        return nil, err
+    }
+    src := b.String()
+    if len(src) > 0 && src[0] == '#' {
+        //skip a #! line
+        for i := 0; i < len(src) && src[i] != '\n'; i++ {
+            src = src[:i] + " " + src[i+1:]
+        }
+    }
+    return L.Load(src, fname)
+}
+
+// Call calls fn, returning the error it raises, if any.
+func (L *State) Call(fn Value, args ...Value) (rets []Value, err os.Error) {
+    depth, where := L.depth, L.where
+    defer func() {
+        if r := recover(); r != nil {
+            e := L.toError(r)
+            L.depth, L.where = depth, where
+            rets, err = nil, e
+        }
+    }()
+    return L.call(fn, args), nil
+}
+
+// toError turns what was panicked with into a Lua error, so that a Go
+// runtime error, from a bug in the interpreter or a Go function, fails the
+// script rather than the program.
+func (L *State) toError(r interface{}) *Error {
+    if e, ok := r.(*Error); ok {
+        return e
+    }
+    return &Error{Value: fmt.Sprintf("%s%v", L.where, r)}
+}
+
+// call calls a function, or a value with a __call metamethod.
+func (L *State) call(fn Value, args []Value) []Value {
+    switch f := fn.(type) {
+    case *Function:
+        return L.callLua(f, args)
+    case *GoFunction:
+        L.fname = f.Name
+        return f.Fn(L, args)
+    }
+    if h := L.metamethod(fn, "__call"); h != nil {
+        return L.call(h, append([]Value{fn}, args...))
+    }
+    L.Error("attempt to call a %s value", TypeName(fn))
+    return nil
+}
+
+func (L *State) callLua(fn *Function, args []Value) []Value {
+    p := fn.proto
+    if L.depth++; L.depth > MAX_DEPTH {
+        L.Error("stack overflow")
+    }
+    L.step(L.where)
+    f := &frame{L: L, slots: make([]*Value, p.slots), up: fn.up}
+    for i := 0; i < p.params; i++ {
+        var v Value
+        if i < len(args) {
+            v = args[i]
+        }
+        f.slots[i] = &v
+    }
+    if p.varargs && len(args) > p.params {
+        f.varargs = args[p.params:]
+    }
+    p.body(f)
+    L.depth--
+    return f.ret
+}
+
+// step counts a loop iteration or call against MaxSteps, blaming where
+// if there are too many.
+func (L *State) step(where string) {
+    if L.Steps++; L.MaxSteps > 0 && L.Steps > L.MaxSteps {
+        L.Steps = 0
+        L.errorAt(where, "script ran too long")
+    }
+}
+
+// metamethod gives v's metatable's entry for event, or nil.
+func (L *State) metamethod(v Value, event string) Value {
+    var meta *Table
+    switch v := v.(type) {
+    case *Table:
+        meta = v.meta
+    case string:
+        meta = L.strmeta
+    }
+    if meta == nil {
+        return nil
+    }
+    return meta.GetString(event)
+}
+
+// Index reads v[k], with metamethods.
+func (L *State) Index(v Value, k Value) Value {
+    for loop := 0; loop < 100; loop++ {
+        var h Value
+        switch t := v.(type) {
+        case *Table:
+            if r := t.Get(k); r != nil || t.meta == nil {
+                return r
+            }
+            if h = t.meta.GetString("__index"); h == nil {
+                return nil
+            }
+        case string:
+            h = L.strings
+        default:
+            L.Error("attempt to index a %s value", TypeName(v))
+        }
+        switch h.(type) {
+        case *Function, *GoFunction:
+            return first(L.call(h, []Value{v, k}))
+        }
+        v = h
+    }
+    L.Error("loop in gettable")
+    return nil
+}
+
+// SetIndex sets v[k], with metamethods.
+func (L *State) SetIndex(v Value, k Value, val Value) {
+    for loop := 0; loop < 100; loop++ {
+        t, ok := v.(*Table)
+        if !ok {
+            h := L.metamethod(v, "__newindex")
+            if h == nil {
+                L.Error("attempt to index a %s value", TypeName(v))
+            }
+            v = h
+            continue
+        }
+        if t.meta == nil || t.Get(k) != nil {
+            t.Set(L.key(k), val)
+            return
+        }
+        h := t.meta.GetString("__newindex")
+        switch h.(type) {
+        case nil:
+            t.Set(L.key(k), val)
+            return
+        case *Function, *GoFunction:
+            L.call(h, []Value{v, k, val})
+            return
+        }
+        v = h
+    }
+    L.Error("loop in settable")
+}
+
+// Arithmetic operators, for arith.
+const (
+    OP_ADD = iota
+    OP_SUB
+    OP_MUL
+    OP_DIV
+    OP_MOD
+    OP_POW
+    OP_UNM
+)
+
+var arithEvents = []string{"__add", "__sub", "__mul", "__div", "__mod", "__pow", "__unm"}
+
+// arith does arithmetic on values that aren't both numbers already.
+func (L *State) arith(op int, a Value, b Value) Value {
+    x, ok1 := ToNumber(a)
+    y, ok2 := ToNumber(b)
+    if ok1 && ok2 {
+        return arithNumbers(op, x, y)
+    }
+    h := L.metamethod(a, arithEvents[op])
+    if h == nil {
+        h = L.metamethod(b, arithEvents[op])
+    }
+    if h == nil {
+        bad := a
+        if ok1 {
+            bad = b
+        }
+        L.Error("attempt to perform arithmetic on a %s value", TypeName(bad))
+    }
+    return first(L.call(h, []Value{a, b}))
+}
+
+func arithNumbers(op int, x float64, y float64) float64 {
+    switch op {
+    case OP_ADD:
+        return x + y
+    case OP_SUB:
+        return x - y
+    case OP_MUL:
+        return x * y
+    case OP_DIV:
+        return x / y
+    case OP_MOD:
+        return x - math.Floor(x/y)*y
+    case OP_POW:
+        return math.Pow(x, y)
+    }
+    return -x
+}
+
+// Equal compares values with __eq.
+func (L *State) Equal(a Value, b Value) bool {
+    if RawEqual(a, b) {
+        return true
+    }
+    ta, ok1 := a.(*Table)
+    tb, ok2 := b.(*Table)
+    if !ok1 || !ok2 || ta.meta == nil || tb.meta == nil {
+        return false
+    }
+    h := ta.meta.GetString("__eq")
+    if h == nil || !RawEqual(h, tb.meta.GetString("__eq")) {
+        return false
+    }
+    return Truth(first(L.call(h, []Value{a, b})))
+}
+
+// Less compares values as < does, or <= with orEqual.
+func (L *State) Less(a Value, b Value, orEqual bool) bool {
+    switch x := a.(type) {
+    case float64:
+        if y, ok := b.(float64); ok {
+            return x < y || orEqual && x == y
+        }
+    case string:
+        if y, ok := b.(string); ok {
+            return x < y || orEqual && x == y
+        }
+    }
+    event := "__lt"
+    if orEqual {
+        event = "__le"
+    }
+    if TypeName(a) == TypeName(b) {
+        h := L.metamethod(a, event)
+        if h == nil {
+            h = L.metamethod(b, event)
+        }
+        if h != nil {
+            return Truth(first(L.call(h, []Value{a, b})))
+        }
+        if orEqual {
+            //a <= b is not b < a
+            if h = L.metamethod(a, "__lt"); h != nil {
+                return !Truth(first(L.call(h, []Value{b, a})))
+            }
+        }
+    }
+    if TypeName(a) == TypeName(b) {
+        L.Error("attempt to compare two %s values", TypeName(a))
+    }
+    L.Error("attempt to compare %s with %s", TypeName(a), TypeName(b))
+    return false
+}
+
+// Concat joins values as .. does.
+func (L *State) Concat(a Value, b Value) Value {
+    sa, ok1 := concatString(a)
+    sb, ok2 := concatString(b)
+    if ok1 && ok2 {
+        return sa + sb
+    }
+    h := L.metamethod(a, "__concat")
+    if h == nil {
+        h = L.metamethod(b, "__concat")
+    }
+    if h == nil {
+        bad := a
+        if ok1 {
+            bad = b
+        }
+        L.Error("attempt to concatenate a %s value", TypeName(bad))
+    }
+    return first(L.call(h, []Value{a, b}))
+}
+
+func concatString(v Value) (string, bool) {
+    switch v := v.(type) {
+    case string:
+        return v, true
+    case float64:
+        return NumberString(v), true
+    }
+    return "", false
+}
+
+// Len gives #v.
+func (L *State) Len(v Value) Value {
+    switch v := v.(type) {
+    case string:
+        return float64(len(v))
+    case *Table:
+        if h := L.metamethod(v, "__len"); h != nil {
+            return first(L.call(h, []Value{v}))
+        }
+        return float64(v.Len())
+    }
+    L.Error("attempt to get length of a %s value", TypeName(v))
+    return nil
+}
+
+// ToStringMeta converts v to a string as tostring does, with __tostring.
+func (L *State) ToStringMeta(v Value) string {
+    if h := L.metamethod(v, "__tostring"); h != nil {
+        if s, ok := first(L.call(h, []Value{v})).(string); ok {
+            return s
+        }
+        L.Error("'__tostring' must return a string")
+    }
+    return ToString(v)
+}
+
+func first(vals []Value) Value {
+    if len(vals) == 0 {
+        return nil
+    }
+    return vals[0]
+}
@@ -0,0 +1,797 @@
+package lua
+
+import (
+    "fmt"
+    "os"
+)
+
+// What a statement did, for the blocks and loops around it.
+const (
+    FLOW_NORMAL = iota
+    FLOW_BREAK
+    FLOW_RETURN
+)
+
+type stmt func(f *frame) int
+
+// frame is a call of a Lua function. Each local is a cell of its own, made
+// afresh each time its declaration runs, so closures share the ones they
+// capture.
+type frame struct {
+    L       *State
+    slots   []*Value
+    up      []*Value
+    varargs []Value
+    ret     []Value
+}
+
+// funcProto is a compiled function.
+type funcProto struct {
+    params  int
+    varargs bool
+    slots   int
+    body    func(f *frame)
+}
+
+type local struct {
+    name string
+    slot int
+}
+
+type upval struct {
+    name       string
+    fromParent bool //from the parent's locals, rather than its upvalues
+    index      int
+}
+
+// funcState is a function being compiled.
+type funcState struct {
+    parent  *funcState
+    actives []local //locals in scope, innermost last
+    slots   int
+    upvals  []upval
+    varargs bool
+    loops   int
+}
+
+// resolve finds a name as a local slot, an upvalue or, failing both, a
+// global.
+func (fs *funcState) resolve(name string) (kind string, index int) {
+    for i := len(fs.actives) - 1; i >= 0; i-- {
+        if fs.actives[i].name == name {
+            return "local", fs.actives[i].slot
+        }
+    }
+    for i, u := range fs.upvals {
+        if u.name == name {
+            return "upvalue", i
+        }
+    }
+    if fs.parent == nil {
+        return "global", 0
+    }
+    kind, index = fs.parent.resolve(name)
+    if kind == "global" {
+        return kind, 0
+    }
+    fs.upvals = append(fs.upvals, upval{name, kind == "local", index})
+    return "upvalue", len(fs.upvals) - 1
+}
+
+func (fs *funcState) declare(name string) int {
+    fs.actives = append(fs.actives, local{name, fs.slots})
+    fs.slots++
+    return fs.slots - 1
+}
+
+type parser struct {
+    L   *State
+    lex *lexer
+    tok token
+    fs  *funcState
+}
+
+// where gives the chunk and a line, for runtime errors.
+func (p *parser) where(line int) string {
+    return fmt.Sprintf("%s:%d: ", p.lex.name, line)
+}
+
+func (p *parser) next() os.Error {
+    t, err := p.lex.next()
+    p.tok = t
+    return err
+}
+
+// is says whether the token is a keyword or operator.
+func (p *parser) is(text string) bool {
+    return (p.tok.kind == TOK_KEYWORD || p.tok.kind == TOK_OP) && p.tok.text == text
+}
+
+func (p *parser) near() string {
+    switch p.tok.kind {
+    case TOK_EOF:
+        return "<eof>"
+    case TOK_NUMBER:
+        return NumberString(p.tok.num)
+    }
+    return p.tok.text
+}
+
+func (p *parser) error(format string, args ...interface{}) os.Error {
+    return &SyntaxError{p.lex.name, p.tok.line, fmt.Sprintf(format, args...)}
+}
+
+// expect skips over a keyword or operator that has to be next.
+func (p *parser) expect(text string) os.Error {
+    if !p.is(text) {
+        return p.error("'%s' expected near '%s'", text, p.near())
+    }
+    return p.next()
+}
+
+// match closes a construct that opened with what on line.
+func (p *parser) match(text string, what string, line int) os.Error {
+    if p.is(text) {
+        return p.next()
+    }
+    if line == p.tok.line {
+        return p.expect(text)
+    }
+    return p.error("'%s' expected (to close '%s' at line %d) near '%s'", text, what, line, p.near())
+}
+
+func (p *parser) name() (string, os.Error) {
+    if p.tok.kind != TOK_NAME {
+        return "", p.error("<name> expected near '%s'", p.near())
+    }
+    n := p.tok.text
+    return n, p.next()
+}
+
+// chunk compiles a whole chunk, as a function taking any arguments.
+func (p *parser) chunk() (proto *funcProto, err os.Error) {
+    if err = p.next(); err != nil {
+        return nil, err
+    }
+    p.fs = &funcState{varargs: true}
+    body, err := p.block()
+    if err != nil {
+        return nil, err
+    }
+    if p.tok.kind != TOK_EOF {
+        return nil, p.error("'<eof>' expected near '%s'", p.near())
+    }
+    return p.proto(body, 0), nil
+}
+
+func (p *parser) proto(body stmt, params int) *funcProto {
+    return &funcProto{params: params, varargs: p.fs.varargs, slots: p.fs.slots,
+        body: func(f *frame) { body(f) }}
+}
+
+// blockEnd says whether the token ends a block.
+func (p *parser) blockEnd() bool {
+    return p.tok.kind == TOK_EOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+// block compiles statements up to the end of a block, scoping their
+// locals to it.
+func (p *parser) block() (stmt, os.Error) {
+    n := len(p.fs.actives)
+    b, err := p.statements()
+    p.fs.actives = p.fs.actives[:n]
+    return b, err
+}
+
+func (p *parser) statements() (stmt, os.Error) {
+    var stmts []stmt
+    for !p.blockEnd() {
+        if p.is("return") || p.is("break") {
+            st, err := p.last()
+            if err != nil {
+                return nil, err
+            }
+            stmts = append(stmts, st)
+            break
+        }
+        st, err := p.statement()
+        if err != nil {
+            return nil, err
+        }
+        if st != nil {
+            stmts = append(stmts, st)
+        }
+        if p.is(";") {
+            if err = p.next(); err != nil {
+                return nil, err
+            }
+        }
+    }
+    if !p.blockEnd() {
+        return nil, p.error("'end' expected near '%s'", p.near())
+    }
+    switch len(stmts) {
+    case 0:
+        return func(f *frame) int { return FLOW_NORMAL }, nil
+    case 1:
+        return stmts[0], nil
+    }
+    return func(f *frame) int {
+        for _, st := range stmts {
+            if r := st(f); r != FLOW_NORMAL {
+                return r
+            }
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+// last compiles return or break, which have to end a block.
+func (p *parser) last() (stmt, os.Error) {
+    if p.is("break") {
+        if p.fs.loops == 0 {
+            return nil, p.error("no loop to break near 'break'")
+        }
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        if p.is(";") {
+            if err := p.next(); err != nil {
+                return nil, err
+            }
+        }
+        return func(f *frame) int { return FLOW_BREAK }, nil
+    }
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    var es []*exp
+    if !p.blockEnd() && !p.is(";") {
+        var err os.Error
+        if es, err = p.exprList(); err != nil {
+            return nil, err
+        }
+    }
+    if p.is(";") {
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+    }
+    if len(es) == 1 && es[0].multi == nil {
+        e := es[0].get
+        return func(f *frame) int {
+            f.ret = []Value{e(f)}
+            return FLOW_RETURN
+        }, nil
+    }
+    return func(f *frame) int {
+        f.ret = evalList(f, es)
+        return FLOW_RETURN
+    }, nil
+}
+
+func (p *parser) statement() (stmt, os.Error) {
+    line := p.tok.line
+    switch true {
+    case p.is("if"):
+        return p.ifStat(line)
+    case p.is("while"):
+        return p.whileStat(line)
+    case p.is("do"):
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        b, err := p.block()
+        if err != nil {
+            return nil, err
+        }
+        return b, p.match("end", "do", line)
+    case p.is("for"):
+        return p.forStat(line)
+    case p.is("repeat"):
+        return p.repeatStat(line)
+    case p.is("function"):
+        return p.funcStat(line)
+    case p.is("local"):
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        if p.is("function") {
+            return p.localFunc()
+        }
+        return p.localStat()
+    }
+    return p.exprStat()
+}
+
+func (p *parser) cond() (func(f *frame) Value, os.Error) {
+    e, err := p.expr()
+    if err != nil {
+        return nil, err
+    }
+    return e.get, nil
+}
+
+func (p *parser) ifStat(line int) (stmt, os.Error) {
+    var conds []func(f *frame) Value
+    var blocks []stmt
+    var els stmt
+    for {
+        //if or elseif
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        c, err := p.cond()
+        if err != nil {
+            return nil, err
+        }
+        if err = p.expect("then"); err != nil {
+            return nil, err
+        }
+        b, err := p.block()
+        if err != nil {
+            return nil, err
+        }
+        conds, blocks = append(conds, c), append(blocks, b)
+        if !p.is("elseif") {
+            break
+        }
+    }
+    if p.is("else") {
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        b, err := p.block()
+        if err != nil {
+            return nil, err
+        }
+        els = b
+    }
+    if err := p.match("end", "if", line); err != nil {
+        return nil, err
+    }
+    return func(f *frame) int {
+        for i, c := range conds {
+            if Truth(c(f)) {
+                return blocks[i](f)
+            }
+        }
+        if els != nil {
+            return els(f)
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+// loopBody compiles a loop's block, where break can go.
+func (p *parser) loopBody() (stmt, os.Error) {
+    p.fs.loops++
+    b, err := p.block()
+    p.fs.loops--
+    return b, err
+}
+
+func (p *parser) whileStat(line int) (stmt, os.Error) {
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    c, err := p.cond()
+    if err != nil {
+        return nil, err
+    }
+    if err = p.expect("do"); err != nil {
+        return nil, err
+    }
+    b, err := p.loopBody()
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match("end", "while", line); err != nil {
+        return nil, err
+    }
+    where := p.where(line)
+    return func(f *frame) int {
+        for Truth(c(f)) {
+            f.L.step(where)
+            if r := b(f); r != FLOW_NORMAL {
+                if r == FLOW_RETURN {
+                    return r
+                }
+                break
+            }
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+func (p *parser) repeatStat(line int) (stmt, os.Error) {
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    //until can see the block's locals
+    n := len(p.fs.actives)
+    p.fs.loops++
+    b, err := p.statements()
+    p.fs.loops--
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match("until", "repeat", line); err != nil {
+        return nil, err
+    }
+    c, err := p.cond()
+    p.fs.actives = p.fs.actives[:n]
+    if err != nil {
+        return nil, err
+    }
+    where := p.where(line)
+    return func(f *frame) int {
+        for {
+            f.L.step(where)
+            if r := b(f); r != FLOW_NORMAL {
+                if r == FLOW_RETURN {
+                    return r
+                }
+                break
+            }
+            if Truth(c(f)) {
+                break
+            }
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+func (p *parser) forStat(line int) (stmt, os.Error) {
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    name, err := p.name()
+    if err != nil {
+        return nil, err
+    }
+    if p.is("=") {
+        return p.numericFor(name, line)
+    }
+    names := []string{name}
+    for p.is(",") {
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+        if name, err = p.name(); err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+    }
+    if err = p.expect("in"); err != nil {
+        return nil, err
+    }
+    es, err := p.exprList()
+    if err != nil {
+        return nil, err
+    }
+    if err = p.expect("do"); err != nil {
+        return nil, err
+    }
+    n := len(p.fs.actives)
+    slots := make([]int, len(names))
+    for i, name := range names {
+        slots[i] = p.fs.declare(name)
+    }
+    b, err := p.loopBody()
+    p.fs.actives = p.fs.actives[:n]
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match("end", "for", line); err != nil {
+        return nil, err
+    }
+    where := p.where(line)
+    return func(f *frame) int {
+        vals := evalList(f, es)
+        for len(vals) < 3 {
+            vals = append(vals, nil)
+        }
+        fn, state, control := vals[0], vals[1], vals[2]
+        for {
+            f.L.step(where)
+            f.L.where = where
+            rets := f.L.call(fn, []Value{state, control})
+            if len(rets) == 0 || rets[0] == nil {
+                break
+            }
+            control = rets[0]
+            for i, slot := range slots {
+                var v Value
+                if i < len(rets) {
+                    v = rets[i]
+                }
+                f.slots[slot] = &v
+            }
+            if r := b(f); r != FLOW_NORMAL {
+                if r == FLOW_RETURN {
+                    return r
+                }
+                break
+            }
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+func (p *parser) numericFor(name string, line int) (stmt, os.Error) {
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    es, err := p.exprList()
+    if err != nil {
+        return nil, err
+    }
+    if len(es) != 2 && len(es) != 3 {
+        return nil, p.error("'do' expected near '%s'", p.near())
+    }
+    if err = p.expect("do"); err != nil {
+        return nil, err
+    }
+    n := len(p.fs.actives)
+    slot := p.fs.declare(name)
+    b, err := p.loopBody()
+    p.fs.actives = p.fs.actives[:n]
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match("end", "for", line); err != nil {
+        return nil, err
+    }
+    where := p.where(line)
+    return func(f *frame) int {
+        var v [3]float64
+        v[2] = 1
+        for i, e := range es {
+            x, ok := ToNumber(e.get(f))
+            if !ok {
+                f.L.errorAt(where, "'for' %s must be a number", []string{"initial value", "limit", "step"}[i])
+            }
+            v[i] = x
+        }
+        start, limit, step := v[0], v[1], v[2]
+        for i := start; step > 0 && i <= limit || step <= 0 && i >= limit; i += step {
+            f.L.step(where)
+            x := Value(i)
+            f.slots[slot] = &x
+            if r := b(f); r != FLOW_NORMAL {
+                if r == FLOW_RETURN {
+                    return r
+                }
+                break
+            }
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+// funcStat compiles function a.b.c:m() ... end.
+func (p *parser) funcStat(line int) (stmt, os.Error) {
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    name, err := p.name()
+    if err != nil {
+        return nil, err
+    }
+    target := p.variable(name)
+    method := false
+    for p.is(".") || p.is(":") {
+        method = p.is(":")
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+        key, err := p.name()
+        if err != nil {
+            return nil, err
+        }
+        target = p.index(target, constant(key), "field '"+key+"'", p.tok.line)
+        if method {
+            break
+        }
+    }
+    fn, err := p.body(method, line)
+    if err != nil {
+        return nil, err
+    }
+    set := target.set
+    return func(f *frame) int {
+        set(f, fn.get(f))
+        return FLOW_NORMAL
+    }, nil
+}
+
+func (p *parser) localFunc() (stmt, os.Error) {
+    line := p.tok.line
+    if err := p.next(); err != nil {
+        return nil, err
+    }
+    name, err := p.name()
+    if err != nil {
+        return nil, err
+    }
+    //the function can see itself
+    slot := p.fs.declare(name)
+    fn, err := p.body(false, line)
+    if err != nil {
+        return nil, err
+    }
+    return func(f *frame) int {
+        var v Value
+        f.slots[slot] = &v
+        v = fn.get(f)
+        return FLOW_NORMAL
+    }, nil
+}
+
+func (p *parser) localStat() (stmt, os.Error) {
+    var names []string
+    for {
+        name, err := p.name()
+        if err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+        if !p.is(",") {
+            break
+        }
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+    }
+    var es []*exp
+    if p.is("=") {
+        if err := p.next(); err != nil {
+            return nil, err
+        }
+        var err os.Error
+        if es, err = p.exprList(); err != nil {
+            return nil, err
+        }
+    }
+    //the names come into scope after the values are worked out
+    slots := make([]int, len(names))
+    for i, name := range names {
+        slots[i] = p.fs.declare(name)
+    }
+    if len(slots) == 1 && len(es) == 1 && es[0].multi == nil {
+        slot, e := slots[0], es[0].get
+        return func(f *frame) int {
+            v := e(f)
+            f.slots[slot] = &v
+            return FLOW_NORMAL
+        }, nil
+    }
+    return func(f *frame) int {
+        vals := evalList(f, es)
+        for i, slot := range slots {
+            var v Value
+            if i < len(vals) {
+                v = vals[i]
+            }
+            f.slots[slot] = &v
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+// exprStat compiles a call or an assignment.
+func (p *parser) exprStat() (stmt, os.Error) {
+    line := p.tok.line
+    e, err := p.suffixed()
+    if err != nil {
+        return nil, err
+    }
+    if !p.is("=") && !p.is(",") {
+        if !e.call {
+            return nil, p.error("syntax error near '%s'", p.near())
+        }
+        m := e.multi
+        return func(f *frame) int {
+            m(f)
+            return FLOW_NORMAL
+        }, nil
+    }
+    targets := []*exp{e}
+    for p.is(",") {
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+        if e, err = p.suffixed(); err != nil {
+            return nil, err
+        }
+        targets = append(targets, e)
+    }
+    for _, t := range targets {
+        if t.set == nil {
+            return nil, &SyntaxError{p.lex.name, line, "syntax error: can't assign to that"}
+        }
+    }
+    if err = p.expect("="); err != nil {
+        return nil, err
+    }
+    es, err := p.exprList()
+    if err != nil {
+        return nil, err
+    }
+    if len(targets) == 1 && len(es) == 1 && es[0].multi == nil {
+        set, e := targets[0].set, es[0].get
+        return func(f *frame) int {
+            set(f, e(f))
+            return FLOW_NORMAL
+        }, nil
+    }
+    return func(f *frame) int {
+        vals := evalList(f, es)
+        for i, t := range targets {
+            var v Value
+            if i < len(vals) {
+                v = vals[i]
+            }
+            t.set(f, v)
+        }
+        return FLOW_NORMAL
+    }, nil
+}
+
+// body compiles a function's parameters and body, up to its end.
+func (p *parser) body(method bool, line int) (*exp, os.Error) {
+    fs := &funcState{parent: p.fs}
+    p.fs = fs
+    defer func() { p.fs = fs.parent }()
+    if method {
+        fs.declare("self")
+    }
+    if err := p.expect("("); err != nil {
+        return nil, err
+    }
+    for !p.is(")") {
+        if p.is("...") {
+            fs.varargs = true
+            if err := p.next(); err != nil {
+                return nil, err
+            }
+            break
+        }
+        name, err := p.name()
+        if err != nil {
+            return nil, err
+        }
+        fs.declare(name)
+        if !p.is(",") {
+            break
+        }
+        if err = p.next(); err != nil {
+            return nil, err
+        }
+    }
+    if err := p.expect(")"); err != nil {
+        return nil, err
+    }
+    params := fs.slots
+    b, err := p.block()
+    if err != nil {
+        return nil, err
+    }
+    if err = p.match("end", "function", line); err != nil {
+        return nil, err
+    }
+    proto := p.proto(b, params)
+    upvals := fs.upvals
+    return &exp{get: func(f *frame) Value {
+        up := make([]*Value, len(upvals))
+        for i, u := range upvals {
+            if u.fromParent {
+                up[i] = f.slots[u.index]
+            } else {
+                up[i] = f.up[u.index]
+            }
+        }
+        return &Function{proto, up}
+    }}, nil
+}
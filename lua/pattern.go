@@ -0,0 +1,381 @@
+package lua
+
+import (
+    "strings"
+)
+
+// Lua patterns, matched the way Lua's own string library does it.
+
+const MAX_CAPTURES = 32
+
+// What a capture's length can be besides a length.
+const (
+    CAP_UNFINISHED = -1
+    CAP_POSITION   = -2
+)
+
+// SPECIALS are the characters that make find match a pattern rather than
+// plain text.
+const SPECIALS = "^$*+?.([%-"
+
+type capture struct {
+    start, length int
+}
+
+type matchState struct {
+    L       *State
+    src     string
+    pat     string
+    level   int
+    capture [MAX_CAPTURES]capture
+    depth   int
+}
+
+// classEnd gives the index after the single character class at p.
+func (ms *matchState) classEnd(p int) int {
+    pat := ms.pat
+    c := pat[p]
+    p++
+    switch c {
+    case '%':
+        if p >= len(pat) {
+            ms.L.Error("malformed pattern (ends with '%%')")
+        }
+        return p + 1
+    case '[':
+        if p < len(pat) && pat[p] == '^' {
+            p++
+        }
+        for {
+            //look for a ], skipping escapes like %]
+            if p >= len(pat) {
+                ms.L.Error("malformed pattern (missing ']')")
+            }
+            c := pat[p]
+            p++
+            if c == '%' && p < len(pat) {
+                p++
+            }
+            if p < len(pat) && pat[p] == ']' {
+                break
+            }
+        }
+        return p + 1
+    }
+    return p
+}
+
+func isLower(c byte) bool {
+    return c >= 'a' && c <= 'z'
+}
+
+func isUpper(c byte) bool {
+    return c >= 'A' && c <= 'Z'
+}
+
+func isSpace(c byte) bool {
+    return c == ' ' || c >= '\t' && c <= '\r'
+}
+
+func isPunct(c byte) bool {
+    return c > ' ' && c < 127 && !isNameChar(c) || c == '_'
+}
+
+// matchClass matches c against a %x class, whose capital is its opposite.
+func matchClass(c byte, class byte) bool {
+    var res bool
+    switch class | 0x20 {
+    case 'a':
+        res = isLower(c) || isUpper(c)
+    case 'c':
+        res = c < ' ' || c == 127
+    case 'd':
+        res = isDigit(c)
+    case 'l':
+        res = isLower(c)
+    case 'p':
+        res = isPunct(c)
+    case 's':
+        res = isSpace(c)
+    case 'u':
+        res = isUpper(c)
+    case 'w':
+        res = isLower(c) || isUpper(c) || isDigit(c)
+    case 'x':
+        res = isDigit(c) || c|0x20 >= 'a' && c|0x20 <= 'f'
+    case 'z':
+        res = c == 0
+    default:
+        return class == c
+    }
+    if isUpper(class) {
+        return !res
+    }
+    return res
+}
+
+// matchBracket matches c against the set from p, at its [, to end, at its ].
+func (ms *matchState) matchBracket(c byte, p int, end int) bool {
+    pat := ms.pat
+    sig := true
+    if pat[p+1] == '^' {
+        sig = false
+        p++
+    }
+    for p++; p < end; p++ {
+        switch true {
+        case pat[p] == '%':
+            p++
+            if matchClass(c, pat[p]) {
+                return sig
+            }
+        case pat[p+1] == '-' && p+2 < end:
+            p += 2
+            if pat[p-2] <= c && c <= pat[p] {
+                return sig
+            }
+        case pat[p] == c:
+            return sig
+        }
+    }
+    return !sig
+}
+
+// singleMatch matches the character at s against the class from p to ep.
+func (ms *matchState) singleMatch(s int, p int, ep int) bool {
+    if s >= len(ms.src) {
+        return false
+    }
+    c := ms.src[s]
+    switch ms.pat[p] {
+    case '.':
+        return true
+    case '%':
+        return matchClass(c, ms.pat[p+1])
+    case '[':
+        return ms.matchBracket(c, p, ep-1)
+    }
+    return ms.pat[p] == c
+}
+
+// match matches the pattern from p against the source from s, giving
+// where the match ends or -1.
+func (ms *matchState) match(s int, p int) int {
+    if ms.depth++; ms.depth > 200 {
+        ms.L.Error("pattern too complex")
+    }
+    defer func() { ms.depth-- }()
+    pat := ms.pat
+    for {
+        if p == len(pat) {
+            return s
+        }
+        switch pat[p] {
+        case '(':
+            if p+1 < len(pat) && pat[p+1] == ')' {
+                return ms.startCapture(s, p+2, CAP_POSITION)
+            }
+            return ms.startCapture(s, p+1, CAP_UNFINISHED)
+        case ')':
+            return ms.endCapture(s, p+1)
+        case '$':
+            if p+1 == len(pat) {
+                if s == len(ms.src) {
+                    return s
+                }
+                return -1
+            }
+        case '%':
+            if p+1 >= len(pat) {
+                break
+            }
+            switch next := pat[p+1]; true {
+            case next == 'b':
+                if s = ms.matchBalance(s, p+2); s < 0 {
+                    return -1
+                }
+                p += 4
+                continue
+            case next == 'f':
+                p += 2
+                if p >= len(pat) || pat[p] != '[' {
+                    ms.L.Error("missing '[' after '%%f' in pattern")
+                }
+                ep := ms.classEnd(p)
+                prev, cur := byte(0), byte(0)
+                if s > 0 {
+                    prev = ms.src[s-1]
+                }
+                if s < len(ms.src) {
+                    cur = ms.src[s]
+                }
+                if ms.matchBracket(prev, p, ep-1) || !ms.matchBracket(cur, p, ep-1) {
+                    return -1
+                }
+                p = ep
+                continue
+            case isDigit(next):
+                if s = ms.matchCapture(s, int(next-'0')); s < 0 {
+                    return -1
+                }
+                p += 2
+                continue
+            }
+        }
+        ep := ms.classEnd(p)
+        m := ms.singleMatch(s, p, ep)
+        op := byte(0)
+        if ep < len(pat) {
+            op = pat[ep]
+        }
+        switch op {
+        case '?':
+            if m {
+                if res := ms.match(s+1, ep+1); res >= 0 {
+                    return res
+                }
+            }
+            p = ep + 1
+            continue
+        case '*':
+            return ms.maxExpand(s, p, ep)
+        case '+':
+            if !m {
+                return -1
+            }
+            return ms.maxExpand(s+1, p, ep)
+        case '-':
+            return ms.minExpand(s, p, ep)
+        }
+        if !m {
+            return -1
+        }
+        s++
+        p = ep
+    }
+    return -1
+}
+
+func (ms *matchState) maxExpand(s int, p int, ep int) int {
+    i := 0
+    for ms.singleMatch(s+i, p, ep) {
+        i++
+    }
+    for ; i >= 0; i-- {
+        if res := ms.match(s+i, ep+1); res >= 0 {
+            return res
+        }
+    }
+    return -1
+}
+
+func (ms *matchState) minExpand(s int, p int, ep int) int {
+    for {
+        if res := ms.match(s, ep+1); res >= 0 {
+            return res
+        }
+        if !ms.singleMatch(s, p, ep) {
+            return -1
+        }
+        s++
+    }
+    return -1
+}
+
+func (ms *matchState) startCapture(s int, p int, what int) int {
+    if ms.level >= MAX_CAPTURES {
+        ms.L.Error("too many captures")
+    }
+    ms.capture[ms.level] = capture{s, what}
+    ms.level++
+    res := ms.match(s, p)
+    if res < 0 {
+        ms.level--
+    }
+    return res
+}
+
+func (ms *matchState) endCapture(s int, p int) int {
+    l := -1
+    for i := ms.level - 1; i >= 0; i-- {
+        if ms.capture[i].length == CAP_UNFINISHED {
+            l = i
+            break
+        }
+    }
+    if l < 0 {
+        ms.L.Error("invalid pattern capture")
+    }
+    ms.capture[l].length = s - ms.capture[l].start
+    res := ms.match(s, p)
+    if res < 0 {
+        ms.capture[l].length = CAP_UNFINISHED
+    }
+    return res
+}
+
+func (ms *matchState) matchBalance(s int, p int) int {
+    if p+1 >= len(ms.pat) {
+        ms.L.Error("unbalanced pattern")
+    }
+    if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+        return -1
+    }
+    opening, closing := ms.pat[p], ms.pat[p+1]
+    depth := 1
+    for s++; s < len(ms.src); s++ {
+        switch ms.src[s] {
+        case closing:
+            if depth--; depth == 0 {
+                return s + 1
+            }
+        case opening:
+            depth++
+        }
+    }
+    return -1
+}
+
+func (ms *matchState) matchCapture(s int, l int) int {
+    l--
+    if l < 0 || l >= ms.level || ms.capture[l].length == CAP_UNFINISHED {
+        ms.L.Error("invalid capture index")
+    }
+    c := ms.capture[l]
+    if strings.HasPrefix(ms.src[s:], ms.src[c.start:c.start+c.length]) {
+        return s + c.length
+    }
+    return -1
+}
+
+// getCapture gives capture i, or the whole match from s to e if there are
+// no captures.
+func (ms *matchState) getCapture(i int, s int, e int) Value {
+    if i >= ms.level {
+        if i != 0 {
+            ms.L.Error("invalid capture index")
+        }
+        return ms.src[s:e]
+    }
+    c := ms.capture[i]
+    switch c.length {
+    case CAP_UNFINISHED:
+        ms.L.Error("unfinished capture")
+    case CAP_POSITION:
+        return float64(c.start + 1)
+    }
+    return ms.src[c.start : c.start+c.length]
+}
+
+// captures gives all the captures, or the whole match.
+func (ms *matchState) captures(s int, e int) []Value {
+    n := ms.level
+    if n == 0 {
+        n = 1
+    }
+    vals := make([]Value, n)
+    for i := range vals {
+        vals[i] = ms.getCapture(i, s, e)
+    }
+    return vals
+}
@@ -0,0 +1,317 @@
+package lua
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// posrelat turns a negative string position into one from the start.
+func posrelat(pos int, length int) int {
+    if pos < 0 {
+        pos += length + 1
+    }
+    return pos
+}
+
+func openString(L *State) {
+    L.strings = L.Library("string", map[string]func(L *State, args []Value) []Value{
+        "len": func(L *State, args []Value) []Value {
+            return values(float64(len(L.CheckString(args, 1))))
+        },
+        "sub": func(L *State, args []Value) []Value {
+            s := L.CheckString(args, 1)
+            i, j := posrelat(L.OptInt(args, 2, 1), len(s)), posrelat(L.OptInt(args, 3, -1), len(s))
+            if i < 1 {
+                i = 1
+            }
+            if j > len(s) {
+                j = len(s)
+            }
+            if i > j {
+                return values("")
+            }
+            return values(s[i-1 : j])
+        },
+        "upper": func(L *State, args []Value) []Value {
+            return values(strings.ToUpper(L.CheckString(args, 1)))
+        },
+        "lower": func(L *State, args []Value) []Value {
+            return values(strings.ToLower(L.CheckString(args, 1)))
+        },
+        "rep": func(L *State, args []Value) []Value {
+            s, n := L.CheckString(args, 1), L.CheckInt(args, 2)
+            if n < 1 {
+                return values("")
+            }
+            return values(strings.Repeat(s, n))
+        },
+        "reverse": func(L *State, args []Value) []Value {
+            s := L.CheckString(args, 1)
+            b := make([]byte, len(s))
+            for i := range b {
+                b[i] = s[len(s)-1-i]
+            }
+            return values(string(b))
+        },
+        "byte": func(L *State, args []Value) []Value {
+            s := L.CheckString(args, 1)
+            i := posrelat(L.OptInt(args, 2, 1), len(s))
+            j := posrelat(L.OptInt(args, 3, i), len(s))
+            if i < 1 {
+                i = 1
+            }
+            if j > len(s) {
+                j = len(s)
+            }
+            var vals []Value
+            for ; i <= j; i++ {
+                vals = append(vals, float64(s[i-1]))
+            }
+            return vals
+        },
+        "char": func(L *State, args []Value) []Value {
+            b := make([]byte, len(args))
+            for i := range b {
+                c := L.CheckInt(args, i+1)
+                if c < 0 || c > 255 {
+                    L.ArgError(i+1, "invalid value")
+                }
+                b[i] = byte(c)
+            }
+            return values(string(b))
+        },
+        "format": strFormat,
+        "find": func(L *State, args []Value) []Value {
+            return strFind(L, args, true)
+        },
+        "match": func(L *State, args []Value) []Value {
+            return strFind(L, args, false)
+        },
+        "gmatch": strGmatch,
+        "gsub":   strGsub,
+    })
+    L.strmeta = NewTable()
+    L.strmeta.Set("__index", L.strings)
+}
+
+// strFind is find, which gives where the match is, and match, which gives
+// what it captured.
+func strFind(L *State, args []Value, find bool) []Value {
+    s, pat := L.CheckString(args, 1), L.CheckString(args, 2)
+    init := posrelat(L.OptInt(args, 3, 1), len(s)) - 1
+    if init < 0 {
+        init = 0
+    } else if init > len(s) {
+        init = len(s)
+    }
+    if find && (Truth(Arg(args, 4)) || strings.IndexAny(pat, SPECIALS) < 0) {
+        if i := strings.Index(s[init:], pat); i >= 0 {
+            return values(float64(init+i+1), float64(init+i+len(pat)))
+        }
+        return values(nil)
+    }
+    anchor := len(pat) > 0 && pat[0] == '^'
+    if anchor {
+        pat = pat[1:]
+    }
+    ms := &matchState{L: L, src: s, pat: pat}
+    for start := init; start <= len(s); start++ {
+        ms.level = 0
+        if e := ms.match(start, 0); e >= 0 {
+            if !find {
+                return ms.captures(start, e)
+            }
+            vals := values(float64(start+1), float64(e))
+            if ms.level > 0 {
+                vals = append(vals, ms.captures(start, e)...)
+            }
+            return vals
+        }
+        if anchor {
+            break
+        }
+    }
+    return values(nil)
+}
+
+func strGmatch(L *State, args []Value) []Value {
+    s, pat := L.CheckString(args, 1), L.CheckString(args, 2)
+    pos := 0
+    return values(&GoFunction{"gmatch_iterator", func(L *State, args []Value) []Value {
+        ms := &matchState{L: L, src: s, pat: pat}
+        for start := pos; start <= len(s); start++ {
+            ms.level = 0
+            if e := ms.match(start, 0); e >= 0 {
+                pos = e
+                if e == start {
+                    //an empty match moves on by one
+                    pos++
+                }
+                return ms.captures(start, e)
+            }
+        }
+        pos = len(s) + 1
+        return values(nil)
+    }})
+}
+
+func strGsub(L *State, args []Value) []Value {
+    src, pat := L.CheckString(args, 1), L.CheckString(args, 2)
+    repl := Arg(args, 3)
+    switch repl.(type) {
+    case string, float64, *Table, *Function, *GoFunction:
+    default:
+        L.TypeError(args, 3, "string/function/table")
+    }
+    max := L.OptInt(args, 4, len(src)+1)
+    anchor := len(pat) > 0 && pat[0] == '^'
+    if anchor {
+        pat = pat[1:]
+    }
+    ms := &matchState{L: L, src: src, pat: pat}
+    var b bytes.Buffer
+    s, n := 0, 0
+    for n < max {
+        ms.level = 0
+        e := ms.match(s, 0)
+        if e >= 0 {
+            n++
+            ms.addValue(&b, s, e, repl)
+        }
+        if e > s {
+            s = e
+        } else if s < len(src) {
+            b.WriteByte(src[s])
+            s++
+        } else {
+            break
+        }
+        if anchor {
+            break
+        }
+    }
+    b.WriteString(src[s:])
+    return values(b.String(), float64(n))
+}
+
+// addValue adds the replacement for a match from s to e.
+func (ms *matchState) addValue(b *bytes.Buffer, s int, e int, repl Value) {
+    L := ms.L
+    var v Value
+    switch r := repl.(type) {
+    case float64:
+        ms.addString(b, s, e, NumberString(r))
+        return
+    case string:
+        ms.addString(b, s, e, r)
+        return
+    case *Table:
+        v = L.Index(r, ms.getCapture(0, s, e))
+    default:
+        v = first(L.call(r, ms.captures(s, e)))
+    }
+    switch r := v.(type) {
+    case nil:
+        b.WriteString(ms.src[s:e])
+    case bool:
+        if r {
+            L.Error("invalid replacement value (a boolean)")
+        }
+        b.WriteString(ms.src[s:e])
+    case string:
+        b.WriteString(r)
+    case float64:
+        b.WriteString(NumberString(r))
+    default:
+        L.Error("invalid replacement value (a %s)", TypeName(v))
+    }
+}
+
+// addString adds a replacement string, with %0 to %9 standing for the
+// captures.
+func (ms *matchState) addString(b *bytes.Buffer, s int, e int, repl string) {
+    for i := 0; i < len(repl); i++ {
+        c := repl[i]
+        if c != '%' || i+1 == len(repl) {
+            b.WriteByte(c)
+            continue
+        }
+        i++
+        switch c = repl[i]; true {
+        case c == '0':
+            b.WriteString(ms.src[s:e])
+        case isDigit(c):
+            text, _ := concatString(ms.getCapture(int(c-'1'), s, e))
+            b.WriteString(text)
+        default:
+            b.WriteByte(c)
+        }
+    }
+}
+
+// strFormat is string.format, which takes C's conversions.
+func strFormat(L *State, args []Value) []Value {
+    format := L.CheckString(args, 1)
+    var b bytes.Buffer
+    n := 1
+    for i := 0; i < len(format); i++ {
+        c := format[i]
+        if c != '%' {
+            b.WriteByte(c)
+            continue
+        }
+        if i+1 < len(format) && format[i+1] == '%' {
+            b.WriteByte('%')
+            i++
+            continue
+        }
+        //flags, width and precision carry over to Go's fmt
+        start := i
+        for i++; i < len(format) && strings.Index("-+ #0", format[i:i+1]) >= 0; i++ {
+        }
+        for j := 0; j < 2 && i < len(format) && isDigit(format[i]); j++ {
+            i++
+        }
+        precision := false
+        if i < len(format) && format[i] == '.' {
+            precision = true
+            for i++; i < len(format) && isDigit(format[i]); i++ {
+            }
+        }
+        if i >= len(format) {
+            L.Error("invalid option '%%' to 'format'")
+        }
+        spec := format[start:i]
+        n++
+        switch conv := format[i]; conv {
+        case 'd', 'i':
+            b.WriteString(fmt.Sprintf(spec+"d", int64(L.CheckNumber(args, n))))
+        case 'u':
+            b.WriteString(fmt.Sprintf(spec+"d", uint64(int64(L.CheckNumber(args, n)))))
+        case 'o', 'x', 'X':
+            b.WriteString(fmt.Sprintf(spec+string(conv), uint64(int64(L.CheckNumber(args, n)))))
+        case 'c':
+            b.WriteByte(byte(L.CheckInt(args, n)))
+        case 'e', 'E', 'f':
+            b.WriteString(fmt.Sprintf(spec+string(conv), L.CheckNumber(args, n)))
+        case 'g', 'G':
+            if !precision {
+                //C's default, where Go's is as many digits as it takes
+                spec += ".6"
+            }
+            b.WriteString(fmt.Sprintf(spec+string(conv), L.CheckNumber(args, n)))
+        case 's':
+            if n > len(args) {
+                L.ArgError(n, "string expected, got no value")
+            }
+            b.WriteString(fmt.Sprintf(spec+"s", L.ToStringMeta(args[n-1])))
+        case 'q':
+            b.WriteString(strconv.Quote(L.CheckString(args, n)))
+        default:
+            L.Error("invalid option '%%%c' to 'format'", conv)
+        }
+    }
+    return values(b.String())
+}
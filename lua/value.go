@@ -0,0 +1,354 @@
+package lua
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// A Value is a Lua value: nil, a bool, a float64, a string, a *Table, a
+// *Function, a *GoFunction or a *Coroutine.
+type Value interface{}
+
+// A Table is a Lua table. Keys 1 to n live in an array and the rest in a
+// map; a key set to nil stays in the map with a nil value until the map is
+// rebuilt, since there's no taking keys out of a map while next walks it.
+type Table struct {
+    arr   []Value
+    hash  map[Value]Value
+    nils  int     //keys in hash with nil values
+    order []Value //hash's keys in the order next gives them, or nil
+    pos   map[Value]int
+    meta  *Table
+}
+
+// NewTable makes an empty table.
+func NewTable() *Table {
+    return &Table{}
+}
+
+// A Function is a Lua function with its upvalues.
+type Function struct {
+    proto *funcProto
+    up    []*Value
+}
+
+// A GoFunction is a function written in Go. It gets its arguments and
+// returns its results, and raises errors with State.Error.
+type GoFunction struct {
+    Name string
+    Fn   func(L *State, args []Value) []Value
+}
+
+// key checks k can be a table key.
+func (L *State) key(k Value) Value {
+    switch k := k.(type) {
+    case nil:
+        L.Error("table index is nil")
+    case float64:
+        if k != k {
+            L.Error("table index is NaN")
+        }
+    }
+    return k
+}
+
+// arrayIndex gives the array slot for k, if it's a whole number.
+func arrayIndex(k Value) (int, bool) {
+    f, ok := k.(float64)
+    if !ok || f < 1 || f > 1<<30 || f != math.Floor(f) {
+        return 0, false
+    }
+    return int(f), true
+}
+
+// Get reads t[k] without metamethods.
+func (t *Table) Get(k Value) Value {
+    if i, ok := arrayIndex(k); ok && i <= len(t.arr) {
+        return t.arr[i-1]
+    }
+    if s, ok := k.(string); ok && t.hash != nil {
+        //the common case, without converting back to an interface
+        return t.hash[s]
+    }
+    if t.hash == nil || k == nil {
+        return nil
+    }
+    return t.hash[k]
+}
+
+// GetString reads t[k] for a string k.
+func (t *Table) GetString(k string) Value {
+    if t.hash == nil {
+        return nil
+    }
+    return t.hash[k]
+}
+
+// Set sets t[k] without metamethods. k mustn't be nil or NaN.
+func (t *Table) Set(k Value, v Value) {
+    if i, ok := arrayIndex(k); ok {
+        switch true {
+        case i <= len(t.arr):
+            t.arr[i-1] = v
+            for v == nil && len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+                t.arr = t.arr[:len(t.arr)-1]
+            }
+            return
+        case i == len(t.arr)+1 && v != nil:
+            t.arr = append(t.arr, v)
+            t.setHash(k, nil)
+            //move the keys that follow from the map
+            for t.hash != nil {
+                next := float64(len(t.arr) + 1)
+                w, ok := t.hash[next]
+                if !ok || w == nil {
+                    break
+                }
+                t.arr = append(t.arr, w)
+                t.setHash(next, nil)
+            }
+            return
+        }
+    }
+    t.setHash(k, v)
+}
+
+func (t *Table) setHash(k Value, v Value) {
+    if t.hash == nil {
+        if v == nil {
+            return
+        }
+        t.hash = make(map[Value]Value)
+    }
+    old, ok := t.hash[k]
+    switch true {
+    case !ok && v == nil:
+        return
+    case !ok:
+        t.compact()
+        t.order = nil
+    case old == nil && v != nil:
+        t.nils--
+    case old != nil && v == nil:
+        t.nils++
+    }
+    t.hash[k] = v
+}
+
+// compact rebuilds the map without its nil values, if there are many.
+func (t *Table) compact() {
+    if t.nils < 32 || t.nils < len(t.hash)/2 {
+        return
+    }
+    hash := make(map[Value]Value)
+    for k, v := range t.hash {
+        if v != nil {
+            hash[k] = v
+        }
+    }
+    t.hash, t.nils, t.order = hash, 0, nil
+}
+
+// Len gives a border of t, as # does: a n where t[n] isn't nil and t[n+1]
+// is.
+func (t *Table) Len() int {
+    if len(t.arr) > 0 || t.hash == nil {
+        return len(t.arr)
+    }
+    n := 0
+    for t.hash[float64(n+1)] != nil {
+        n++
+    }
+    return n
+}
+
+// Append sets t[#t+1] to v.
+func (t *Table) Append(v Value) {
+    t.Set(float64(t.Len()+1), v)
+}
+
+// Next gives the key and value after k, or the first ones for nil, and
+// false at the end.
+func (t *Table) Next(k Value) (Value, Value, bool) {
+    i := 0
+    if k != nil {
+        //an index past the array is in the map, unless the array shrank
+        n, ok := arrayIndex(k)
+        if _, inHash := t.hash[k]; !ok || n > len(t.arr) && inHash {
+            return t.nextHash(k)
+        }
+        i = n
+    }
+    for ; i < len(t.arr); i++ {
+        if t.arr[i] != nil {
+            return float64(i + 1), t.arr[i], true
+        }
+    }
+    return t.nextHash(nil)
+}
+
+func (t *Table) nextHash(k Value) (Value, Value, bool) {
+    if t.hash == nil {
+        return nil, nil, k == nil
+    }
+    if t.order == nil {
+        t.order = make([]Value, 0, len(t.hash))
+        t.pos = make(map[Value]int)
+        for key := range t.hash {
+            t.pos[key] = len(t.order)
+            t.order = append(t.order, key)
+        }
+    }
+    i := 0
+    if k != nil {
+        n, ok := t.pos[k]
+        if !ok {
+            return nil, nil, false
+        }
+        i = n + 1
+    }
+    for ; i < len(t.order); i++ {
+        if v := t.hash[t.order[i]]; v != nil {
+            return t.order[i], v, true
+        }
+    }
+    return nil, nil, true
+}
+
+// Meta gives t's metatable, or nil.
+func (t *Table) Meta() *Table {
+    return t.meta
+}
+
+// SetMeta sets t's metatable.
+func (t *Table) SetMeta(meta *Table) {
+    t.meta = meta
+}
+
+// TypeName gives the name type() gives v.
+func TypeName(v Value) string {
+    switch v.(type) {
+    case nil:
+        return "nil"
+    case bool:
+        return "boolean"
+    case float64:
+        return "number"
+    case string:
+        return "string"
+    case *Table:
+        return "table"
+    case *Function, *GoFunction:
+        return "function"
+    case *Coroutine:
+        return "thread"
+    }
+    return "userdata"
+}
+
+// Truth says whether v counts as true: anything but nil and false.
+func Truth(v Value) bool {
+    switch v := v.(type) {
+    case nil:
+        return false
+    case bool:
+        return v
+    }
+    return true
+}
+
+// NumberString formats a number the way Lua does.
+func NumberString(f float64) string {
+    switch true {
+    case f != f:
+        return "nan"
+    case math.IsInf(f, 1):
+        return "inf"
+    case math.IsInf(f, -1):
+        return "-inf"
+    case f == math.Floor(f) && math.Fabs(f) < 1e15:
+        return strconv.Itoa64(int64(f))
+    }
+    return fmt.Sprintf("%.14g", f)
+}
+
+// ToString converts v to a string without __tostring.
+func ToString(v Value) string {
+    switch v := v.(type) {
+    case nil:
+        return "nil"
+    case bool:
+        if v {
+            return "true"
+        }
+        return "false"
+    case float64:
+        return NumberString(v)
+    case string:
+        return v
+    case *GoFunction:
+        return fmt.Sprintf("builtin: %s", v.Name)
+    }
+    return fmt.Sprintf("%s: %p", TypeName(v), v)
+}
+
+// ToNumber converts v to a number the way arithmetic does, taking strings
+// that hold numbers.
+func ToNumber(v Value) (float64, bool) {
+    switch v := v.(type) {
+    case float64:
+        return v, true
+    case string:
+        return parseNumber(strings.TrimSpace(v))
+    }
+    return 0, false
+}
+
+// parseNumber reads a decimal or 0x hex number.
+func parseNumber(s string) (float64, bool) {
+    neg := false
+    t := s
+    if len(t) > 0 && (t[0] == '-' || t[0] == '+') {
+        neg = t[0] == '-'
+        t = t[1:]
+    }
+    if len(t) > 2 && t[0] == '0' && (t[1] == 'x' || t[1] == 'X') {
+        n, err := strconv.Btoui64(t[2:], 16)
+        if err != nil {
+            return 0, false
+        }
+        if neg {
+            return -float64(n), true
+        }
+        return float64(n), true
+    }
+    if t == "" || strings.IndexAny(t[:1], "0123456789.") < 0 || strings.IndexAny(t, "xXnN") >= 0 {
+        //no inf, nan or hex floats
+        return 0, false
+    }
+    f, err := strconv.Atof64(s)
+    if err != nil {
+        return 0, false
+    }
+    return f, true
+}
+
+// RawEqual compares values without __eq.
+func RawEqual(a Value, b Value) bool {
+    switch a := a.(type) {
+    case nil:
+        return b == nil
+    case bool:
+        b, ok := b.(bool)
+        return ok && a == b
+    case float64:
+        b, ok := b.(float64)
+        return ok && a == b
+    case string:
+        b, ok := b.(string)
+        return ok && a == b
+    }
+    return a == b
+}
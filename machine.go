@@ -15,20 +15,45 @@ type Machine struct {
     input            chan []byte
     read_input_state byte
     keys             []byte
+    dataBus          byte //the last value on the CPU's data bus
     //interrupts
-    scheduledNMI     int
-    scheduledIRQ     int
-    irqWaiting       bool
+    nmiPending       bool //an edge was seen on /NMI and hasn't been serviced
+    nmiPolled        bool //nmiPending as of the end of the previous cycle
+    irqLine          bool //something is holding /IRQ low this cycle
+    irqPending       bool //irqLine with I clear at the end of this cycle
+    irqPolled        bool //irqPending as of the end of the previous cycle
+    //dma
+    dmaHalt          bool //a DMA is waiting to halt the CPU on its next read
+    oamDMA           bool
+    oamPage          byte
+    dmcDMA           bool
+    dmcDummy         bool //the DMC DMA still needs its dummy cycle
+    //testing
+    exitOnTestDone   bool
+    tracer           *tracer
+    traceToggle      chan bool //ToggleTrace's requests for the CPU goroutine
+    cdl              *CDL
+    profile          *Profile
+    debugger         *Debugger
+    symbols          *Symbols
+    viewer           *PPUViewer
+    events           *EventViewer
+    ramSearch        *RAMSearch
+    cheats           *Cheats
+    hooks            *hooks
+    lastHookID       int
+    done             chan bool //closed when Run returns
 }
 
-func MakeMachine(romname string, frames chan []int, input chan []byte) *Machine {
-    m := &Machine{input: input}
-    m.rom = &ROM{}
-    f, err := os.OpenFile(romname, 0, 0)
-    if f == nil {
-        fmt.Printf("Couldn't open rom!\n%v\n", err)
+func MakeMachine(romname string, frames chan []int, input chan []byte) (*Machine, os.Error) {
+    m := &Machine{input: input, exitOnTestDone: true, traceToggle: make(chan bool, 1),
+        done: make(chan bool)}
+    rom, err := LoadROM(romname)
+    if err != nil {
+        return nil, err
     }
-    m.rom.loadRom(f)
+    m.rom = rom
+    m.rom.bus = &m.dataBus
     m.cpu = makeCPU(m)
     m.ppu = makePPU(m, frames)
     m.apu = makeAPU(m)
@@ -36,49 +61,55 @@ func MakeMachine(romname string, frames chan []int, input chan []byte) *Machine
     for i := 0; i < 0x800; i++ {
         m.mem[i] = 0xff
     }
-    return m
+    return m, nil
 }
 
+// getMem reads the CPU bus. Addresses nothing drives read back whatever was
+// last on it.
 func (m *Machine) getMem(addr word) byte {
+    val := m.dataBus
     switch true {
     case addr < 0x2000:
-        return m.mem[addr&0x7ff]
+        val = m.mem[addr&0x7ff]
     case addr < 0x4000:
         m.ppu.run()
-        return m.ppu.readRegister(int(addr & 7))
+        val = m.ppu.readRegister(int(addr & 7))
     case addr < 0x4018:
         switch addr {
+        case 0x4015:
+            //the status register is inside the CPU, so the bus keeps its value
+            return m.apu.readRegister(0x15) | m.dataBus&0x20
         case 0x4016:
+            //only the low bit is driven by the controller
+            val &= 0xe0
             if m.read_input_state < 8 {
                 m.read_input_state++
-                return m.keys[m.read_input_state-1]
+                val |= m.keys[m.read_input_state-1]
             } else {
-                return 1
+                val |= 1
             }
-        default:
-            return m.apu.readRegister(byte(addr - 0x4000))
+        case 0x4017:
+            val &= 0xe0
         }
-        //apu etc
-        return 0
-    case addr < 0x6000:
-        return 0
-    case addr < 0x8000:
-        return m.rom.prg_ram[addr-0x6000]
+    case addr < 0x4020:
     default:
-        bank := (m.rom.prg_bank_mask & addr) >> m.rom.prg_bank_shift
-        //fmt.Printf("bank %v off %04X\n", bank, addr&((1<<m.rom.prg_bank_shift)-1))
-        return m.rom.prg_rom[bank][addr&((1<<m.rom.prg_bank_shift)-1)]
+        val = m.rom.mapper.ReadCPU(uint16(addr))
     }
-    return 0 //wtf go?
+    m.dataBus = val
+    return val
 }
 
 func (m *Machine) setMem(addr word, val byte) {
+    m.dataBus = val
     switch true {
     case addr < 0x2000:
         m.mem[addr&0x7ff] = val
     case addr < 0x4000:
         m.ppu.run()
         m.ppu.writeRegister(int(addr&7), val)
+        if h := m.hooks; h != nil {
+            h.ppuWrite(int(addr&7), val)
+        }
     case addr < 0x4018:
         switch addr {
         case 0x4016:
@@ -87,103 +118,334 @@ func (m *Machine) setMem(addr word, val byte) {
                 m.read_input_state = 0
             }
         case 0x4014:
-            for v := word(0); v < 0x100; v++ {
-                addr := (v + m.ppu.objAddr) & 0xff
-                m.ppu.objMem[addr] = m.mem[(word(val)<<8)|v]
-            }
-            m.cpu.cycleCount += 513
+            //the copy starts when the CPU next reads
+            m.oamPage = val
+            m.oamDMA = true
+            m.dmaHalt = true
         default:
             m.apu.writeRegister(byte(addr - 0x4000), val)
         }
         //apu etc
-    case addr < 0x6000:
+    case addr < 0x4020:
         return
-    case addr < 0x8000:
-        m.rom.prg_ram[addr-0x6000] = val
     default:
-        m.rom.mapper.prgWrite(addr, val)
+        m.rom.mapper.WriteCPU(uint16(addr), val)
+        if m.rom.nt_changed {
+            m.rom.nt_changed = false
+            m.ppu.updateNametables()
+        }
     }
 }
 
 func (m *Machine) requestNMI() {
-    m.scheduledNMI = 2
+    m.nmiPending = true
 }
 
 func (m *Machine) suppressNMI() {
-    m.scheduledNMI = -1
+    m.nmiPending = false
 }
 
+// requestIrq holds /IRQ low for the current cycle. IRQ sources call it every
+// cycle they want service.
 func (m *Machine) requestIrq() {
-    if m.scheduledIRQ < 0 && !m.cpu.getFlag(I) {
-        m.scheduledIRQ = 2
+    m.irqLine = true
+}
+
+// requestDMCDMA schedules a read for the DMC's sample buffer.
+func (m *Machine) requestDMCDMA() {
+    if !m.dmcDMA {
+        m.dmcDMA = true
+        m.dmcDummy = true
+        m.dmaHalt = true
     }
-    m.irqWaiting = true
 }
 
-func (m *Machine) runInterrupts() {
-    if m.scheduledIRQ >= 0 {
-        m.scheduledIRQ -= 1
+// runDMA steals cycles from the CPU for the pending sprite and DMC DMAs. The
+// CPU was about to read addr, and the halt cycle and any cycles spent waiting
+// for a get (even) cycle repeat that read. Sprite DMA alternates reads on get
+// cycles with writes to $2004 on put cycles, which takes 513 or 514 cycles
+// depending on where it starts. A DMC read needs a halt and a dummy cycle
+// first, but sprite DMA cycles count as those when the two overlap.
+func (m *Machine) runDMA(addr word) {
+    m.getMem(addr) //halt
+    m.tick()
+    m.dmaHalt = false
+    count := 0
+    val := byte(0)
+    for m.dmcDMA || m.oamDMA {
+        get := m.cpu.cycleCount&1 == 0
+        dmcReady := m.dmcDMA && !m.dmaHalt && !m.dmcDummy
+        if m.dmaHalt {
+            m.dmaHalt = false
+        } else if m.dmcDummy {
+            m.dmcDummy = false
+        }
+        switch true {
+        case get && dmcReady:
+            m.dmcDMA = false
+            m.logPRG(m.apu.dmc.addr, CDL_PCM)
+            m.apu.dmc.fill(m.getMem(m.apu.dmc.addr))
+            m.tick()
+        case get && m.oamDMA:
+            val = m.getMem(word(m.oamPage)<<8 | word(count>>1))
+            m.tick()
+            count++
+        case !get && m.oamDMA && count&1 != 0:
+            m.tick()
+            m.setMem(0x2004, val)
+            count++
+            if count == 0x200 {
+                m.oamDMA = false
+            }
+        default:
+            m.getMem(addr) //dummy
+            m.tick()
+        }
     }
-    if m.scheduledNMI >= 0 {
-        m.scheduledNMI -= 1
+}
+
+// peekMem reads CPU memory without the side effects a real read has.
+// Registers read back what a real read would return.
+func (m *Machine) peekMem(addr word) byte {
+    switch true {
+    case addr < 0x2000:
+        return m.mem[addr&0x7ff]
+    case addr < 0x4000:
+        return m.ppu.peekRegister(int(addr & 7))
+    case addr == 0x4015:
+        return m.apu.peekStatus() | m.dataBus&0x20
+    case addr == 0x4016:
+        if m.read_input_state < 8 {
+            return m.dataBus&0xe0 | m.keys[m.read_input_state]
+        }
+        return m.dataBus&0xe0 | 1
+    case addr == 0x4017:
+        return m.dataBus & 0xe0
+    case addr < 0x4020:
+        return m.dataBus
+    default:
+        return m.rom.mapper.PeekCPU(uint16(addr))
     }
-    if m.scheduledNMI == 0 {
-        m.cpu.nmi()
-        m.irqWaiting = false
-        m.scheduledIRQ = -1
-    } else if m.scheduledIRQ == 0 {
-        m.cpu.irq()
-        m.irqWaiting = false
+    return 0
+}
+
+// Peek reads the CPU address space without the side effects a real read
+// has, so reading $2002 doesn't clear vblank, $4016 doesn't shift the
+// controller and $2007 doesn't move the PPU's address.
+func (m *Machine) Peek(addr uint16) byte {
+    return m.peekMem(word(addr))
+}
+
+// Poke writes RAM, PRG RAM or PRG ROM where the CPU sees them, without
+// setting off anything a real write would, like a mapper's bank switch.
+// It returns an error for registers and anything else that can't be
+// changed.
+func (m *Machine) Poke(addr uint16, val byte) os.Error {
+    return m.pokeMem(word(addr), val)
+}
+
+// PeekPPU reads the PPU address space, through the mapper and nametable
+// mirroring, without clocking the mapper's scanline counter.
+func (m *Machine) PeekPPU(addr uint16) byte {
+    return m.ppu.peekMem(word(addr))
+}
+
+// PokePPU writes the PPU address space like PeekPPU reads it.
+func (m *Machine) PokePPU(addr uint16, val byte) os.Error {
+    return m.ppu.pokeMem(word(addr), val)
+}
+
+// OAM returns the PPU's sprite memory, which can be read and written.
+func (m *Machine) OAM() []byte {
+    return m.ppu.objMem[:]
+}
+
+// PeekPalette reads palette entry i, 0-31, mirrored the way the PPU
+// mirrors it.
+func (m *Machine) PeekPalette(i int) byte {
+    return m.ppu.peekMem(0x3f00 | word(i&0x1f))
+}
+
+// PokePalette writes palette entry i like PeekPalette reads it.
+func (m *Machine) PokePalette(i int, val byte) {
+    m.ppu.pokeMem(0x3f00|word(i&0x1f), val)
+}
+
+// pokeMem writes CPU memory without the side effects a real write has.
+// Registers can't be poked, and from $4020 up the mapper decides what can
+// be, patching ROM in the bank mapped at addr.
+func (m *Machine) pokeMem(addr word, val byte) os.Error {
+    switch true {
+    case addr < 0x2000:
+        m.mem[addr&0x7ff] = val
+    case addr < 0x4020:
+        return fmt.Errorf("can't poke the register at $%04X", addr)
+    default:
+        return m.rom.mapper.PokeCPU(uint16(addr), val)
     }
+    return nil
 }
 
-func (m *Machine) syncPPU(cycles uint) {
-    m.cpu.cycleCount += uint64(cycles)
+// tick clocks everything but the CPU through one CPU cycle, then samples the
+// interrupt lines the way the 6502 does at the end of each cycle. What was
+// sampled on an instruction's second-to-last cycle decides whether an
+// interrupt runs after it.
+func (m *Machine) tick() {
+    m.cpu.cycleCount++
+    m.nmiPolled = m.nmiPending
+    m.irqPolled = m.irqPending
+    m.irqLine = false
     m.ppu.run()
+    if h := m.hooks; h != nil && len(h.byKind[HOOK_SCANLINE]) > 0 {
+        h.dots(m.ppu)
+    }
+    m.apu.update(1)
+    m.rom.mapper.TickCPU()
+    if m.rom.mapper.IRQ() {
+        m.requestIrq()
+    }
+    m.irqPending = m.irqLine && !m.cpu.getFlag(I)
 }
 
 func (m *Machine) Debug(keysym uint32) {
     switch keysym {
     case sdl.K_d:
         m.ppu.dumpNTs()
+    case sdl.K_e:
+        if m.events != nil {
+            if err := m.events.Save("."); err != nil {
+                fmt.Printf("error saving events. %v\n", err)
+            }
+        }
+    case sdl.K_b:
+        if m.debugger != nil {
+            m.debugger.Pause()
+        }
+    case sdl.K_1, sdl.K_2, sdl.K_3, sdl.K_4, sdl.K_5, sdl.K_6, sdl.K_7, sdl.K_8, sdl.K_9:
+        if m.cheats != nil {
+            m.cheats.toggle(int(keysym-sdl.K_1) + 1)
+        }
+    }
+}
+
+// step runs one instruction and any interrupt it let in.
+func (m *Machine) step() os.Error {
+    if h := m.hooks; h != nil && h.addrs[m.cpu.pc]&BREAK_EXEC != 0 {
+        h.exec(m.cpu.pc)
+    }
+    p := m.profile
+    var from uint32
+    var opcode byte
+    s := m.cpu.s
+    if p != nil {
+        //before the instruction has a chance to switch banks
+        from, opcode = m.bankPC(m.cpu.pc), m.peekMem(m.cpu.pc)
+    }
+    var cycles int
+    if t := m.tracer; t != nil {
+        t.begin(m)
+        cycles = m.cpu.step()
+        t.end()
+    } else {
+        cycles = m.cpu.step()
+    }
+    if p != nil {
+        m.profileInstruction(p, from, s, opcode, cycles)
+    }
+    if m.cpu.jam != nil {
+        return m.cpu.jam
+    }
+    if m.nmiPolled || m.irqPolled {
+        from, s = m.bankPC(m.cpu.pc), m.cpu.s
+        start := m.cpu.cycleCount
+        m.cpu.interrupt(false)
+        if p != nil {
+            m.profileInterrupt(p, from, s, int(m.cpu.cycleCount-start))
+        }
+        if h := m.hooks; h != nil {
+            if m.inNMI() {
+                h.event(HOOK_NMI)
+            } else {
+                h.event(HOOK_IRQ)
+            }
+        }
     }
+    return nil
 }
 
-func (m *Machine) Run(debug bool) {
+// Run resets the machine and runs it until the CPU jams, which it reports
+// with a *JamError. debug logs every instruction to stdout if no other trace
+// has been started.
+func (m *Machine) Run(debug bool) os.Error {
+    if debug && m.tracer == nil {
+        m.StartTrace(os.Stdout, TraceOptions{PPU: true})
+    }
     m.cpu.reset()
-    var inst = Instruction{}
-    pc := word(0)
     for true {
-        pc = m.cpu.pc
-        inst = m.cpu.nextInstruction()
-        if debug {
-            fmt.Printf("%X  %v %s %s\n", pc, inst, m.cpu.regs(), m.ppu.dump())
+        if m.debugger != nil {
+            m.debugger.check()
+        }
+        if err := m.step(); err != nil {
+            m.StopTrace()
+            close(m.done)
+            return err
         }
-        cycles := m.cpu.runInstruction(&inst)
-        m.ppu.setNTMirroring(m.rom.mirror)
-        m.ppu.run()
-        m.apu.update(cycles)
-        m.rom.mapper.update(m)
-        m.runInterrupts()
 
         //special handling for blargg tests
-        if(m.rom.prg_ram[1] == 0xde && m.rom.prg_ram[2] == 0xb0) {
-            switch(m.rom.prg_ram[0]) {
-                case 0x80:
-                    //test running
-                case 0x81:
-                    //need reset
-                default:
-                    fmt.Println("test done")
-                    i := 0
-                    for i = 4; i < len(m.rom.prg_ram)-4; i++ {
-                        if m.rom.prg_ram[i] == 0x0 {
-                            break
-                        }
-                    }
-                    fmt.Println(string(m.rom.prg_ram[4:i]))
-                    os.Exit(0)
+        if m.exitOnTestDone {
+            if status, text := m.TestStatus(); status < 0x80 {
+                fmt.Println("test done")
+                fmt.Println(text)
+                m.StopTrace()
+                os.Exit(0)
             }
         }
     }
+    return nil
+}
+
+// takeCommands runs what's been sent to the cheats and the RAM search,
+// between frames. They're polled here rather than from hooks, so that
+// having them ready for commands doesn't give the machine hooks to check.
+func (m *Machine) takeCommands() {
+    if c := m.cheats; c != nil {
+        c.takeCommands()
+    }
+    if r := m.ramSearch; r != nil {
+        r.takeCommands()
+    }
+}
+
+// TestStatus returns the result code and text that blargg's test ROMs leave
+// at $6000. The code is 0x80 or above while a test is still running.
+func (m *Machine) TestStatus() (byte, string) {
+    ram := m.rom.prg_ram
+    if ram[1] != 0xde || ram[2] != 0xb0 {
+        return 0x80, ""
+    }
+    i := 0
+    for i = 4; i < len(ram)-4; i++ {
+        if ram[i] == 0x0 {
+            break
+        }
+    }
+    return ram[0], string(ram[4:i])
+}
+
+// SetExitOnTestDone controls whether Run exits the process once a blargg
+// test ROM reports its result. It is on by default.
+func (m *Machine) SetExitOnTestDone(exit bool) {
+    m.exitOnTestDone = exit
+}
+
+// SetXAAMagic sets the constant the XAA and ATX opcodes use.
+func (m *Machine) SetXAAMagic(magic byte) {
+    m.cpu.magic = magic
+}
+
+// SetMMC3Revision picks the IRQ counter behaviour if the cart is an MMC3.
+func (m *Machine) SetMMC3Revision(rev int) {
+    if mmc3, ok := m.rom.mapper.(*MMC3); ok {
+        mmc3.SetIRQRevision(rev)
+    }
 }
@@ -2,11 +2,14 @@ package main
 
 import (
     "⚛sdl"
+    "bufio"
     "os"
     "fmt"
     "./gones"
     "path/filepath"
     "flag"
+    "strconv"
+    "strings"
 )
 
 var keymap = []int{sdl.K_z,
@@ -33,42 +36,246 @@ func sdlInput() chan []byte {
     return c
 }
 
-func readStdin() chan byte {
-    c := make(chan byte)
+// readLines feeds lines from stdin to the debugger or the RAM search.
+func readLines() chan string {
+    c := make(chan string)
     go func() {
-        b := make([]byte, 1)
+        r := bufio.NewReader(os.Stdin)
         for {
-            n, _ := os.Stdin.Read(b)
-            if n != 0 {
-                c <- b[0]
+            line, err := r.ReadString('\n')
+            if err != nil {
+                return
             }
+            c <- line
         }
     }()
     return c
 }
 
+// send passes a command on without holding up the SDL loop. The machine
+// takes commands between frames, so they only back up while it's paused.
+func send(c chan string, line string) {
+    select {
+    case c <- line:
+    default:
+        fmt.Printf("Too many commands waiting; dropped %s", line)
+    }
+}
+
+// runOptions are the flags that set up an interactive run.
+type runOptions struct {
+    debug, debugger bool
+    gdbAddr         string
+    traceFile       string
+    trace           gones.TraceOptions
+    cdlFile         string
+    profileFile     string
+    symbols         *gones.Symbols
+    ppuView         string
+    ppuViewSL       int
+    eventView       string
+    scriptFile      string
+}
+
 func main() {
     //set up command line options
-    var inputFile, recordKeys, testFile, testManyFile string
+    var o runOptions
+    var inputFile, recordKeys, testFile, testManyFile, nestestLog string
     flag.StringVar(&inputFile, "input", "", "Specify an input file to use instead of keypresses")
     flag.StringVar(&testFile, "test", "", "Specify a test file to run")
     flag.StringVar(&testManyFile, "testm", "", "Specify a file containing a list of tests to run")
     flag.StringVar(&recordKeys, "record", "", "Record keypresses for later playback")
-    var suppressVideo, debug bool
+    flag.StringVar(&nestestLog, "nestest", "", "Run nestest in automation mode and compare it against this nestest.log")
+    var suppressVideo bool
     flag.BoolVar(&suppressVideo, "novideo", false, "Disable video output for running in testing mode")
-    flag.BoolVar(&debug, "d", false, "Turn on instruction dumping")
+    flag.BoolVar(&o.debug, "d", false, "Turn on instruction dumping")
+    flag.BoolVar(&o.debugger, "debugger", false, "Start paused with a debugger console on stdin; b pauses")
+    flag.StringVar(&o.gdbAddr, "gdb", "", "Serve GDB's remote protocol on this address, like localhost:2159")
+    var traceFormat, tracePC, traceFrames, traceStart, traceStop string
+    flag.StringVar(&o.cdlFile, "cdl", "", "Keep a code/data log in this FCEUX .cdl file, carrying on from it if it exists")
+    flag.StringVar(&o.profileFile, "profile", "", "Profile the CPU and write a pprof profile to this file on quitting")
+    var symbolFiles string
+    flag.StringVar(&o.ppuView, "ppuview", "", "Serve pattern table, nametable, sprite and palette viewers over HTTP on this address, like localhost:8060")
+    flag.IntVar(&o.ppuViewSL, "ppuviewsl", 240, "Scanline the PPU viewers are updated at, 0-261")
+    flag.StringVar(&o.eventView, "events", "", "Serve a viewer of when each frame's register writes and interrupts land over HTTP on this address; e saves it")
+    flag.StringVar(&symbolFiles, "symbols", "", "Name addresses from these ca65 .dbg, FCEUX .nl or Mesen .mlb files, separated by commas")
+    flag.StringVar(&o.scriptFile, "script", "", "Run this Lua script to automate the emulator; -scripthelp lists what it can call")
+    var scriptHelp bool
+    flag.BoolVar(&scriptHelp, "scripthelp", false, "List the functions -script's scripts can call")
+    flag.StringVar(&o.traceFile, "trace", "", "Log instructions to this file; t pauses and resumes it")
+    flag.StringVar(&traceFormat, "traceformat", "nestest", "Trace log format: nestest, fceux or mesen")
+    flag.StringVar(&tracePC, "tracepc", "", "Only trace instructions in this PC range, like 8000-9fff")
+    flag.StringVar(&traceFrames, "traceframes", "", "Start tracing at one frame and stop after another, like 60-120 or 60-")
+    flag.StringVar(&traceStart, "tracestart", "", "Start tracing when the CPU gets to this address, like c000")
+    flag.StringVar(&traceStop, "tracestop", "", "Stop tracing when the CPU gets to this address")
+    flag.BoolVar(&o.trace.Paused, "tracepaused", false, "Start the trace log paused")
+    flag.BoolVar(&o.trace.PPU, "traceppu", false, "Add PPU scanline and dot to the trace log")
+    flag.BoolVar(&o.trace.Banks, "tracebanks", false, "Add mapped PRG banks to the trace log")
+    flag.BoolVar(&o.trace.Memory, "tracemem", false, "Add memory accesses to the trace log")
+    flag.BoolVar(&o.trace.Symbols, "tracesymbols", false, "Add labels and operand names from -symbols to the trace log")
     flag.Parse()
+    if scriptHelp {
+        fmt.Print(gones.SCRIPT_HELP)
+        return
+    }
+    if o.traceFile != "" {
+        if err := parseTraceFlags(&o.trace, traceFormat, tracePC, traceFrames, traceStart, traceStop); err != nil {
+            fmt.Printf("%v\n", err)
+            os.Exit(1)
+        }
+    }
+    o.symbols = loadSymbols(symbolFiles)
 
-    if testFile != "" {
+    if flag.Arg(0) == "disasm" {
+        disasm(flag.Arg(1), flag.Arg(2), o.symbols)
+    } else if nestestLog != "" {
+        compareNestest(flag.Arg(0), nestestLog)
+    } else if testFile != "" {
         test(testFile)
     } else if testManyFile != "" {
         testMany(testManyFile)
     } else {
-        run(debug)
+        run(o)
+    }
+}
+
+// loadSymbols loads a comma separated list of symbol files, returning nil if
+// there are none.
+func loadSymbols(files string) *gones.Symbols {
+    if files == "" {
+        return nil
+    }
+    syms := gones.NewSymbols()
+    for _, f := range strings.Split(files, ",") {
+        if err := syms.Load(f); err != nil {
+            fmt.Printf("Couldn't load symbols!\n%v\n", err)
+            os.Exit(1)
+        }
+    }
+    return syms
+}
+
+// parseTraceFlags fills in the parts of opts that need parsing.
+func parseTraceFlags(opts *gones.TraceOptions, format string, pcs string, frames string, start string, stop string) os.Error {
+    switch format {
+    case "nestest":
+        opts.Format = gones.TRACE_NESTEST
+    case "fceux":
+        opts.Format = gones.TRACE_FCEUX
+    case "mesen":
+        opts.Format = gones.TRACE_MESEN
+    default:
+        return fmt.Errorf("unknown trace format %s", format)
+    }
+    if pcs != "" {
+        r := strings.Split(pcs, "-")
+        if len(r) != 2 {
+            return fmt.Errorf("bad PC range %s", pcs)
+        }
+        lo, err := strconv.Btoui64(r[0], 16)
+        if err != nil {
+            return err
+        }
+        hi, err := strconv.Btoui64(r[1], 16)
+        if err != nil {
+            return err
+        }
+        opts.PCLow, opts.PCHigh = uint16(lo), uint16(hi)
+    }
+    if frames != "" {
+        r := strings.Split(frames, "-")
+        start, err := strconv.Btoui64(r[0], 10)
+        if err != nil {
+            return err
+        }
+        opts.StartFrame = start
+        if len(r) > 1 && r[1] != "" {
+            if opts.StopFrame, err = strconv.Btoui64(r[1], 10); err != nil {
+                return err
+            }
+            opts.StopFrame++
+        }
+    }
+    if start != "" {
+        pc, err := strconv.Btoui64(start, 16)
+        if err != nil {
+            return err
+        }
+        opts.StartPC, opts.StartAtPC = uint16(pc), true
+    }
+    if stop != "" {
+        pc, err := strconv.Btoui64(stop, 16)
+        if err != nil {
+            return err
+        }
+        opts.StopPC, opts.StopAtPC = uint16(pc), true
+    }
+    return nil
+}
+
+// disasm lists a rom's PRG in 16KB banks, or just the bank named by bankArg.
+// The last bank is listed at $C000 and the rest at $8000, which is where
+// most mappers leave them.
+func disasm(romfile string, bankArg string, syms *gones.Symbols) {
+    rom, err := gones.LoadROM(romfile)
+    if err != nil {
+        fmt.Printf("Couldn't load rom!\n%v\n", err)
+        os.Exit(1)
+    }
+    prg := rom.PRG()
+    banks := len(prg) / 0x4000
+    only := -1
+    if bankArg != "" {
+        only, err = strconv.Atoi(bankArg)
+        if err != nil || only < 0 || only >= banks {
+            fmt.Printf("bad bank %s, the rom has %d\n", bankArg, banks)
+            os.Exit(1)
+        }
+    }
+    for b := 0; b < banks; b++ {
+        if only >= 0 && b != only {
+            continue
+        }
+        base := uint16(0x8000)
+        if b == banks-1 {
+            base = 0xc000
+        }
+        d := gones.NewDisassembler(prg[b*0x4000:(b+1)*0x4000], base, b)
+        if syms != nil {
+            d.UseSymbols(syms, b*0x4000)
+        }
+        if err = d.Write(os.Stdout); err != nil {
+            fmt.Printf("%v\n", err)
+            os.Exit(1)
+        }
     }
 }
 
-func run(debug bool) {
+func saveCDL(cdl *gones.CDL, fname string) {
+    f, err := os.Create(fname)
+    if f == nil {
+        fmt.Printf("Couldn't save code/data log!\n%v\n", err)
+        return
+    }
+    defer f.Close()
+    if err = cdl.Write(f); err != nil {
+        fmt.Printf("Couldn't save code/data log!\n%v\n", err)
+    }
+}
+
+func saveProfile(p *gones.Profile, fname string) {
+    f, err := os.Create(fname)
+    if f == nil {
+        fmt.Printf("Couldn't save profile!\n%v\n", err)
+        return
+    }
+    defer f.Close()
+    if err = p.WritePprof(f); err != nil {
+        fmt.Printf("Couldn't save profile!\n%v\n", err)
+    }
+}
+
+func run(o runOptions) {
     //initialize video if we need to 
     var screen *sdl.Surface
     sdl.Init(sdl.INIT_VIDEO)
@@ -80,21 +287,121 @@ func run(debug bool) {
     romfile := flag.Arg(0)
     romname := filepath.Base(flag.Arg(0))
     num := 0
-    m := gones.MakeMachine(romfile, frames, sdlInput())
+    m, err := gones.MakeMachine(romfile, frames, sdlInput())
+    if err != nil {
+        fmt.Printf("Couldn't load rom!\n%v\n", err)
+        sdl.Quit()
+        os.Exit(1)
+    }
+    if o.symbols != nil {
+        m.SetSymbols(o.symbols)
+    }
+
+    if o.traceFile != "" {
+        f, err := os.Create(o.traceFile)
+        if f == nil {
+            fmt.Printf("Couldn't open trace log!\n%v\n", err)
+            sdl.Quit()
+            os.Exit(1)
+        }
+        defer f.Close()
+        m.StartTrace(f, o.trace)
+    }
+
+    var cdl *gones.CDL
+    if o.cdlFile != "" {
+        cdl = m.StartCDL()
+        if f, _ := os.Open(o.cdlFile); f != nil {
+            err = cdl.Read(f)
+            f.Close()
+            if err != nil {
+                fmt.Printf("Couldn't read code/data log!\n%v\n", err)
+                sdl.Quit()
+                os.Exit(1)
+            }
+        }
+    }
+
+    var profile *gones.Profile
+    if o.profileFile != "" {
+        profile = m.StartProfile()
+    }
+
+    cheats := make(chan string, 64)
+    if _, err = m.StartCheats(gones.CheatFile(romfile), cheats, os.Stdout); err != nil {
+        fmt.Printf("Couldn't load cheats!\n%v\n", err)
+        sdl.Quit()
+        os.Exit(1)
+    }
+
+    //the debugger takes over stdin; otherwise cheat commands go to the
+    //cheats and lines other than s to the RAM search
+    var input chan string
+    ram := make(chan string, 64)
+    if o.debugger {
+        m.StartDebugger(readLines(), os.Stdout)
+    } else {
+        input = readLines()
+        m.StartRAMSearch(ram, os.Stdout)
+    }
+    if o.gdbAddr != "" {
+        if err = m.ServeGDB(o.gdbAddr); err != nil {
+            fmt.Printf("Couldn't serve gdb!\n%v\n", err)
+            sdl.Quit()
+            os.Exit(1)
+        }
+    }
+    if o.ppuView != "" {
+        if err = m.ServePPUViewer(o.ppuView, o.ppuViewSL); err != nil {
+            fmt.Printf("Couldn't serve the PPU viewers!\n%v\n", err)
+            sdl.Quit()
+            os.Exit(1)
+        }
+    }
+    if o.eventView != "" {
+        if err = m.ServeEventViewer(o.eventView); err != nil {
+            fmt.Printf("Couldn't serve the event viewer!\n%v\n", err)
+            sdl.Quit()
+            os.Exit(1)
+        }
+    }
+
+    if o.scriptFile != "" {
+        if _, err = m.LoadScript(o.scriptFile, os.Stdout); err != nil {
+            fmt.Printf("Couldn't load script!\n%v\n", err)
+            sdl.Quit()
+            os.Exit(1)
+        }
+    }
+
+    quit := func(code int) {
+        m.StopTrace()
+        if cdl != nil {
+            saveCDL(cdl, o.cdlFile)
+        }
+        if profile != nil {
+            saveProfile(profile, o.profileFile)
+        }
+        sdl.Quit()
+        os.Exit(code)
+    }
 
     video := false
-    //run machine
-    go m.Run(debug)
-    //start reading std input
-    input := readStdin()
+    //run machine; it only stops if the CPU jams
+    jam := make(chan os.Error, 1)
+    go func() {
+        jam <- m.Run(o.debug)
+    }()
     for {
         select {
+        case err := <-jam:
+            fmt.Printf("%v\n", err)
+            quit(1)
         case event := <-sdl.Events:
             switch e := event.(type) {
             case sdl.QuitEvent:
                 fmt.Printf("Quitting\n")
-                sdl.Quit()
-                os.Exit(0)
+                quit(0)
             case sdl.KeyboardEvent:
                 kevent := event.(sdl.KeyboardEvent)
                 if kevent.Type == sdl.KEYDOWN {
@@ -105,6 +412,8 @@ func run(debug bool) {
                     video = !video
                     fmt.Printf("recording video: %v\n", video)
                     num = 0
+                case sdl.K_t:
+                    m.ToggleTrace()
                 default:
                     m.Debug(kevent.Keysym.Sym)
                 }
@@ -117,11 +426,15 @@ func run(debug bool) {
                 num++
             }
             screen.Flip()
-        case c := <-input:
-            //char from stdin
-            switch c {
-            case 's':
+        case line := <-input:
+            //command from stdin
+            switch l := strings.TrimSpace(line); true {
+            case l == "s":
                 gones.SaveImage("ss.png", (*[256 * 240]int)(screen.Pixels)[:])
+            case l == "cheat" || strings.HasPrefix(l, "cheat "):
+                send(cheats, line)
+            default:
+                send(ram, line)
             }
         }
     }
@@ -3,78 +3,220 @@ package gones
 import "fmt"
 import "os"
 
+// Mapper is implemented by cartridge boards. The CPU side sees every access
+// in $4020-$FFFF, including PRG RAM at $6000-$7FFF, and the PPU side sees
+// pattern table addresses in $0000-$1FFF. Nametables at $2000-$2FFF (and
+// their mirror at $3000) go through the four slots returned by Nametables.
+// Boards that don't need a hook can embed BaseMapper to get the behaviour
+// of a plain NROM cart for it.
 type Mapper interface {
-    load(rom *ROM)
-    prgWrite(addr word, val byte)
-    update(m *Machine)
-    name() string
+    Load(rom *ROM)
+    Name() string
+    ReadCPU(addr uint16) byte
+    WriteCPU(addr uint16, val byte)
+    ReadPPU(addr uint16) byte
+    WritePPU(addr uint16, val byte)
+    // PeekCPU and PeekPPU read like ReadCPU and ReadPPU without setting
+    // off anything a read would, like acknowledging an IRQ or latching a
+    // CHR bank, for debuggers.
+    PeekCPU(addr uint16) byte
+    PeekPPU(addr uint16) byte
+    // PokeCPU and PokePPU change the memory behind an address, RAM or
+    // ROM, without setting off anything a write would. They return an
+    // error if there's nothing there that can be changed.
+    PokeCPU(addr uint16, val byte) os.Error
+    PokePPU(addr uint16, val byte) os.Error
+    // TickCPU is called once per CPU cycle.
+    TickCPU()
+    // A12 is called whenever PPU address line 12 changes level.
+    A12(high bool)
+    // IRQ reports whether the board is pulling the IRQ line low.
+    IRQ() bool
+    // Nametables returns the 1KB of memory behind each of the four
+    // nametable slots. ciram is the console's 2KB of nametable RAM followed
+    // by the 2KB four screen carts add; a mapper can also hand back CHR ROM
+    // or its own RAM. It is asked again after a write to the mapper calls
+    // ROM.SetMirroring or ROM.NametablesChanged.
+    Nametables(ciram []byte) [4][]byte
 }
 
-func loadMapper(num byte, rom *ROM) Mapper {
-    var m Mapper
-    switch num {
-    case 0:
-        m = new(NROM)
-    case 1:
-        m = new(MMC1)
-    case 2:
-        m = new(UNROM)
-    case 3:
-        m = new(CNROM)
-    case 4:
-        m = new(MMC3)
-    case 7:
-        m = new (AXROM)
-    default:
-        fmt.Printf("Unsupported Mapper: %d\n", num)
-        os.Exit(1)
+// A MapperFactory returns a fresh, unloaded mapper.
+type MapperFactory func() Mapper
+
+var mappers = make(map[int]MapperFactory)
+
+// RegisterMapper makes factory the implementation of iNES mapper num,
+// replacing any mapper already registered under that number.
+func RegisterMapper(num int, factory MapperFactory) {
+    mappers[num] = factory
+}
+
+func init() {
+    RegisterMapper(0, func() Mapper { return new(NROM) })
+    RegisterMapper(1, func() Mapper { return new(MMC1) })
+    RegisterMapper(2, func() Mapper { return new(UNROM) })
+    RegisterMapper(3, func() Mapper { return new(CNROM) })
+    RegisterMapper(4, func() Mapper { return new(MMC3) })
+    RegisterMapper(7, func() Mapper { return new(AXROM) })
+    RegisterMapper(118, func() Mapper { return &MMC3{board: TXSROM} })
+    RegisterMapper(119, func() Mapper { return &MMC3{board: TQROM} })
+}
+
+func loadMapper(num int, rom *ROM) (Mapper, os.Error) {
+    factory, ok := mappers[num]
+    if !ok {
+        return nil, fmt.Errorf("unsupported mapper: %d", num)
+    }
+    m := factory()
+    m.Load(rom)
+    fmt.Fprintf(os.Stderr, "Mapper: %d %s\n", num, m.Name())
+    return m, nil
+}
+
+// BaseMapper maps the first and last 16KB of PRG and the first 8KB of CHR,
+// always-enabled PRG RAM at $6000, nothing at $4020-$5FFF, uses the
+// mirroring from the header and never raises an IRQ.
+type BaseMapper struct {
+    rom *ROM
+}
+
+func (b *BaseMapper) Load(rom *ROM) {
+    b.rom = rom
+    rom.SetBankSizes(0x4000, 0x1000)
+    rom.MapPRG(0, 0)
+    rom.MapPRG(1, rom.PRGBanks()-1)
+    rom.MapCHR(0, 0)
+    rom.MapCHR(1, 1)
+}
+
+// ROM returns the cartridge the mapper was loaded with.
+func (b *BaseMapper) ROM() *ROM { return b.rom }
+
+func (b *BaseMapper) Name() string { return "NROM" }
+
+func (b *BaseMapper) ReadCPU(addr uint16) byte {
+    return b.PeekCPU(addr)
+}
+
+func (b *BaseMapper) WriteCPU(addr uint16, val byte) {
+    if addr >= 0x6000 && addr < 0x8000 {
+        b.rom.prg_ram[addr-0x6000] = val
+    }
+}
+
+func (b *BaseMapper) ReadPPU(addr uint16) byte {
+    return b.PeekPPU(addr)
+}
+
+func (b *BaseMapper) WritePPU(addr uint16, val byte) {
+    if !b.rom.chr_ram {
+        return
+    }
+    b.PokePPU(addr, val)
+}
+
+func (b *BaseMapper) PeekCPU(addr uint16) byte {
+    switch true {
+    case addr < 0x6000:
+        return b.rom.OpenBus()
+    case addr < 0x8000:
+        return b.rom.prg_ram[addr-0x6000]
     }
-    m.load(rom)
-    fmt.Printf("Mapper: %d %s\n", num, m.name())
-    return m
+    a := word(addr)
+    w := b.rom.prg_rom[(b.rom.prg_bank_mask&a)>>b.rom.prg_bank_shift]
+    return w[windowIndex(w, int(a&((1<<b.rom.prg_bank_shift)-1)))]
 }
 
-type NROM struct{}
+func (b *BaseMapper) PeekPPU(addr uint16) byte {
+    a := word(addr)
+    w := b.rom.chr_rom[(a&b.rom.chr_bank_mask)>>b.rom.chr_bank_shift]
+    return w[windowIndex(w, int(a&(^b.rom.chr_bank_mask)))]
+}
 
-func (n *NROM) load(rom *ROM) {
-    rom.prg_rom[0] = rom.prg_banks
-    rom.prg_rom[1] = rom.prg_banks[0x4000*int(rom.prg_size-1):]
-    rom.chr_rom[0] = rom.chr_banks
-    rom.chr_rom[1] = rom.chr_banks[0x1000:]
-    rom.chr_bank_mask = 0x1000
-    rom.chr_bank_shift = 12
-    rom.prg_bank_mask = 0x4000
-    rom.prg_bank_shift = 14
+// PokeCPU changes PRG RAM, or PRG ROM in the bank mapped at addr. There's
+// nothing at $4020-$5FFF.
+func (b *BaseMapper) PokeCPU(addr uint16, val byte) os.Error {
+    switch true {
+    case addr < 0x6000:
+        return fmt.Errorf("nothing to change at $%04X", addr)
+    case addr < 0x8000:
+        b.rom.prg_ram[addr-0x6000] = val
+        return nil
+    }
+    a := word(addr)
+    w := b.rom.prg_rom[(b.rom.prg_bank_mask&a)>>b.rom.prg_bank_shift]
+    w[windowIndex(w, int(a&((1<<b.rom.prg_bank_shift)-1)))] = val
+    return nil
 }
 
-func (n *NROM) prgWrite(addr word, val byte) {}
+// PokePPU changes CHR RAM, or CHR ROM in the bank mapped at addr.
+func (b *BaseMapper) PokePPU(addr uint16, val byte) os.Error {
+    a := word(addr)
+    w := b.rom.chr_rom[(a&b.rom.chr_bank_mask)>>b.rom.chr_bank_shift]
+    w[windowIndex(w, int(a&(^b.rom.chr_bank_mask)))] = val
+    return nil
+}
+
+func (b *BaseMapper) TickCPU() {}
+
+func (b *BaseMapper) A12(high bool) {}
 
-func (n *NROM) update(m *Machine) {}
+func (b *BaseMapper) IRQ() bool { return false }
 
-func (n *NROM) name() string { return "NROM" }
+func (b *BaseMapper) Nametables(ciram []byte) [4][]byte {
+    return MirrorNametables(b.rom.mirror, ciram)
+}
+
+// MirrorNametables lays out ciram in one of the fixed arrangements,
+// HORIZONTAL, VERTICAL, FOUR_SCREEN, SINGLE_LOWER or SINGLE_UPPER.
+func MirrorNametables(mirror int, ciram []byte) [4][]byte {
+    var pages [4]int
+    switch mirror {
+    case VERTICAL:
+        pages = [4]int{0, 1, 0, 1}
+    case HORIZONTAL:
+        pages = [4]int{0, 0, 1, 1}
+    case FOUR_SCREEN:
+        pages = [4]int{0, 1, 2, 3}
+    case SINGLE_LOWER:
+        pages = [4]int{0, 0, 0, 0}
+    case SINGLE_UPPER:
+        pages = [4]int{1, 1, 1, 1}
+    }
+    return CIRAMNametables(pages, ciram)
+}
+
+// CIRAMNametables puts 1KB page pages[i] of ciram in nametable slot i.
+func CIRAMNametables(pages [4]int, ciram []byte) [4][]byte {
+    var nt [4][]byte
+    for i := 0; i < 4; i++ {
+        nt[i] = ciram[pages[i]*0x400 : pages[i]*0x400+0x400]
+    }
+    return nt
+}
+
+type NROM struct {
+    BaseMapper
+}
 
 type MMC1 struct {
+    BaseMapper
     control, loadr, shift, prg_bank byte
-    rom                             *ROM
-}
-
-func (m *MMC1) load(rom *ROM) {
-    rom.prg_rom[0] = rom.prg_banks
-    rom.prg_rom[1] = rom.prg_banks[0x4000*int(rom.prg_size-1):]
-    rom.chr_rom[0] = rom.chr_banks
-    rom.chr_rom[1] = rom.chr_banks[0x1000:]
-    rom.chr_bank_mask = 0x1000
-    rom.chr_bank_shift = 12
-    rom.prg_bank_mask = 0x4000
-    rom.prg_bank_shift = 14
+}
+
+func (m *MMC1) Load(rom *ROM) {
+    m.BaseMapper.Load(rom)
     m.control = 0xc
     m.shift = 0
     m.loadr = 0
     m.prg_bank = 0
-    m.rom = rom
 }
 
-func (m *MMC1) prgWrite(addr word, val byte) {
+func (m *MMC1) WriteCPU(addr uint16, val byte) {
+    if addr < 0x8000 {
+        m.BaseMapper.WriteCPU(addr, val)
+        return
+    }
     m.loadr |= (val & 1) << m.shift
     m.shift++
     if val&0x80 != 0 {
@@ -87,13 +229,13 @@ func (m *MMC1) prgWrite(addr word, val byte) {
         if addr < 0xa000 {
             switch m.loadr & 3 {
             case 0:
-                m.rom.mirror = SINGLE_LOWER
+                m.rom.SetMirroring(SINGLE_LOWER)
             case 1:
-                m.rom.mirror = SINGLE_UPPER
+                m.rom.SetMirroring(SINGLE_UPPER)
             case 2:
-                m.rom.mirror = VERTICAL
+                m.rom.SetMirroring(VERTICAL)
             case 3:
-                m.rom.mirror = HORIZONTAL
+                m.rom.SetMirroring(HORIZONTAL)
             }
             if m.control&0xc != m.loadr&0xc {
                 m.control = m.loadr
@@ -103,21 +245,19 @@ func (m *MMC1) prgWrite(addr word, val byte) {
         } else if addr < 0xc000 {
             if m.control&(1<<4) != 0 {
                 //4kb mode
-                m.rom.chr_rom[0] = m.rom.chr_banks[0x1000*int(m.loadr):]
+                m.rom.MapCHR(0, int(m.loadr))
             } else {
-                if m.rom.chr_size != 0 {
-                    loadr := m.loadr & (m.rom.chr_size - 1)
-                    m.rom.chr_rom[0] = m.rom.chr_banks[0x1000*int(loadr&0x1e):]
-                    m.rom.chr_rom[1] = m.rom.chr_banks[0x1000*int(loadr|1):]
-                }
+                m.rom.MapCHR(0, int(m.loadr&0x1e))
+                m.rom.MapCHR(1, int(m.loadr|1))
             }
         } else if addr < 0xe000 {
             if m.control&(1<<4) != 0 {
                 //4kb mode
-                m.rom.chr_rom[1] = m.rom.chr_banks[0x1000*int(m.loadr):]
+                m.rom.MapCHR(1, int(m.loadr))
             }
         } else {
-            m.prg_bank = m.loadr & (m.rom.prg_size - 1)
+            //bit 4 is the PRG RAM enable
+            m.prg_bank = m.loadr & 0xf
             fmt.Printf("Setting prg bank %v\n", m.prg_bank);
             m.updatePrgBanks()
         }
@@ -126,109 +266,153 @@ func (m *MMC1) prgWrite(addr word, val byte) {
     }
 }
 
-func (m *MMC1) update(mach *Machine) {}
-
 func (m *MMC1) updatePrgBanks() {
     switch m.control & 0xc {
     case 0, 4:
-        m.rom.prg_rom[0] = m.rom.prg_banks[0x4000*int(m.prg_bank&0xe):]
-        m.rom.prg_rom[1] = m.rom.prg_banks[0x4000*int(m.prg_bank|1):]
+        m.rom.MapPRG(0, int(m.prg_bank&0xe))
+        m.rom.MapPRG(1, int(m.prg_bank|1))
     case 8:
-        m.rom.prg_rom[0] = m.rom.prg_banks
-        m.rom.prg_rom[1] = m.rom.prg_banks[0x4000*int(m.prg_bank):]
+        m.rom.MapPRG(0, 0)
+        m.rom.MapPRG(1, int(m.prg_bank))
     case 0xc:
-        m.rom.prg_rom[0] = m.rom.prg_banks[0x4000*int(m.prg_bank):]
-        m.rom.prg_rom[1] = m.rom.prg_banks[0x4000*int(m.rom.prg_size-1):]
+        m.rom.MapPRG(0, int(m.prg_bank))
+        m.rom.MapPRG(1, m.rom.PRGBanks()-1)
     }
 }
 
-func (m *MMC1) name() string { return "MMC1" }
+func (m *MMC1) Name() string { return "MMC1" }
 
 type UNROM struct {
-    rom *ROM
+    BaseMapper
 }
 
-func (u *UNROM) load(rom *ROM) {
-    u.rom = rom
-    rom.prg_rom[0] = rom.prg_banks
-    rom.prg_rom[1] = rom.prg_banks[0x4000*int(rom.prg_size-1):]
-    rom.chr_rom[0] = rom.chr_banks
-    rom.chr_rom[1] = rom.chr_banks[0x1000:]
-    rom.chr_bank_mask = 0x1000
-    rom.chr_bank_shift = 12
-    rom.prg_bank_mask = 0x4000
-    rom.prg_bank_shift = 14
+func (u *UNROM) Load(rom *ROM) {
+    u.BaseMapper.Load(rom)
 }
 
-func (u *UNROM) prgWrite(addr word, val byte) {
-    bank := int(val & 7)
-    u.rom.prg_rom[0] = u.rom.prg_banks[0x4000*bank:]
+func (u *UNROM) WriteCPU(addr uint16, val byte) {
+    if addr < 0x8000 {
+        u.BaseMapper.WriteCPU(addr, val)
+        return
+    }
+    u.rom.MapPRG(0, int(val&7))
 }
 
-func (u *UNROM) update(m *Machine) {}
-
-func (u *UNROM) name() string {
+func (u *UNROM) Name() string {
     return "UNROM"
 }
 
 type CNROM struct {
-    rom *ROM
+    BaseMapper
 }
 
-func (c *CNROM) load(rom *ROM) {
-    c.rom = rom
-    rom.prg_rom[0] = rom.prg_banks
-    rom.prg_rom[1] = rom.prg_banks[0x4000*int(rom.prg_size-1):]
-    rom.chr_rom[0] = rom.chr_banks
-    rom.chr_rom[1] = rom.chr_banks[0x1000:]
-    rom.chr_bank_mask = 0x1000
-    rom.chr_bank_shift = 12
-    rom.prg_bank_mask = 0x4000
-    rom.prg_bank_shift = 14
+func (c *CNROM) Load(rom *ROM) {
+    c.BaseMapper.Load(rom)
 }
 
-func (c *CNROM) prgWrite(addr word, val byte) {
+func (c *CNROM) WriteCPU(addr uint16, val byte) {
+    if addr < 0x8000 {
+        c.BaseMapper.WriteCPU(addr, val)
+        return
+    }
     bank := int(val & 3)
-    c.rom.chr_rom[0] = c.rom.chr_banks[0x2000*bank:]
-    c.rom.chr_rom[1] = c.rom.chr_banks[0x2000*bank+0x1000:]
+    c.rom.MapCHR(0, bank*2)
+    c.rom.MapCHR(1, bank*2+1)
 }
 
-func (c *CNROM) update(m *Machine) {}
-
-func (c *CNROM) name() string {
+func (c *CNROM) Name() string {
     return "CNROM"
 }
 
+// MMC3 IRQ counter revisions. When the counter reloads to zero the Sharp
+// chips raise an IRQ on every clock, while the NEC (MMC3A) ones only raise
+// one if the counter got to zero by decrementing or was reloaded by $C001.
+const (
+    MMC3_SHARP = iota
+    MMC3_NEC
+)
+
+// MMC3Revision is the IRQ behaviour used for MMC3 carts whose header
+// doesn't name a revision.
+var MMC3Revision = MMC3_SHARP
+
+// MMC3 variants that take over parts of the PPU bus.
+const (
+    TXROM = iota
+    TXSROM // mapper 118, CHR bank bit 7 drives CIRAM A10
+    TQROM  // mapper 119, CHR bank bit 6 selects 8KB of CHR RAM
+)
+
 type MMC3 struct {
-    rom *ROM
+    BaseMapper
+    board int
     bankSelect byte
-    currentChrBanks [6]int
-    currentPrgBanks [3]int
+    bankRegs [8]byte
     bankConfiguration byte
+    prgRamEnabled bool
+    prgRamProtected bool
     irqLatch byte
     irqEnabled bool
     irqWaiting bool
+    irqReload bool
     irqCounter byte
+    irqRevision int
     a12high bool
+    chrRam []byte
+    chrIsRam [8]bool
 }
 
-func (c *MMC3) load(rom *ROM) {
-    c.rom = rom
-    rom.prg_rom[3] = rom.prg_banks[0x2000*int(rom.prg_size*2-1):]
+func (c *MMC3) Load(rom *ROM) {
+    c.BaseMapper.Load(rom)
+    rom.SetBankSizes(0x2000, 0x400)
+    rom.MapPRG(3, rom.PRGBanks()-1)
+    c.irqRevision = MMC3Revision
+    if rom.submapper == 4 {
+        c.irqRevision = MMC3_NEC
+    }
+    c.prgRamEnabled = true
+    if c.board == TQROM {
+        c.chrRam = make([]byte, 0x2000)
+    }
     for i := 0; i < 6; i++ {
-        c.currentChrBanks[i] = i
+        c.bankRegs[i] = byte(i)
     }
-    c.currentPrgBanks[0] = 0
-    c.currentPrgBanks[1] = 1
+    c.bankRegs[6] = 0
+    c.bankRegs[7] = 1
     c.updateChrBanks()
     c.updatePrgBanks()
-    rom.chr_bank_mask = 0xfc00
-    rom.chr_bank_shift = 10
-    rom.prg_bank_mask = 0x6000
-    rom.prg_bank_shift = 13
 }
 
-func (c *MMC3) prgWrite(addr word, val byte) {
+// SetIRQRevision switches the IRQ counter between MMC3_SHARP and MMC3_NEC.
+func (c *MMC3) SetIRQRevision(rev int) {
+    c.irqRevision = rev
+}
+
+func (c *MMC3) ReadCPU(addr uint16) byte {
+    if addr >= 0x6000 && addr < 0x8000 && !c.prgRamEnabled {
+        return c.rom.OpenBus()
+    }
+    return c.BaseMapper.ReadCPU(addr)
+}
+
+func (c *MMC3) PeekCPU(addr uint16) byte {
+    return c.ReadCPU(addr)
+}
+
+func (c *MMC3) PokeCPU(addr uint16, val byte) os.Error {
+    if addr >= 0x6000 && addr < 0x8000 && (!c.prgRamEnabled || c.prgRamProtected) {
+        return fmt.Errorf("PRG RAM at $%04X is disabled or write protected", addr)
+    }
+    return c.BaseMapper.PokeCPU(addr, val)
+}
+
+func (c *MMC3) WriteCPU(addr uint16, val byte) {
+    if addr < 0x8000 {
+        if addr < 0x6000 || (c.prgRamEnabled && !c.prgRamProtected) {
+            c.BaseMapper.WriteCPU(addr, val)
+        }
+        return
+    }
     switch addr & 1 {
     case 0:
         switch true {
@@ -236,12 +420,17 @@ func (c *MMC3) prgWrite(addr word, val byte) {
                 //bank select
                 c.bankSelect = val & 7
                 c.bankConfiguration = (val & 0xc0) >> 6
+                c.updatePrgBanks()
+                c.updateChrBanks()
             case addr < 0xc000:
-                //mirroring
+                //mirroring, which four-screen boards like TVROM ignore
+                if c.board == TXSROM || c.rom.FourScreen() {
+                    break
+                }
                 if val & 1 == 0 {
-                    c.rom.mirror = VERTICAL
+                    c.rom.SetMirroring(VERTICAL)
                 } else {
-                    c.rom.mirror = HORIZONTAL
+                    c.rom.SetMirroring(HORIZONTAL)
                 }
             case addr < 0xe000:
                 //irq latch
@@ -256,32 +445,17 @@ func (c *MMC3) prgWrite(addr word, val byte) {
         switch true {
             case addr < 0xa000:
                 //set bank
-                v := int(val)
-                switch c.bankSelect {
-                    case 0:
-                        c.currentChrBanks[0] = v & 0xfe
-                    case 1:
-                        c.currentChrBanks[1] = v & 0xfe
-                    case 2:
-                        c.currentChrBanks[2] = v
-                    case 3:
-                        c.currentChrBanks[3] = v
-                    case 4:
-                        c.currentChrBanks[4] = v
-                    case 5:
-                        c.currentChrBanks[5] = v
-                    case 6:
-                        c.currentPrgBanks[0] = v & (int(c.rom.prg_size)*2-1)
-                    case 7:
-                        c.currentPrgBanks[1] = v & (int(c.rom.prg_size)*2-1)
-                }
+                c.bankRegs[c.bankSelect] = val
                 c.updatePrgBanks()
                 c.updateChrBanks()
             case addr < 0xc000:
                 //prg ram
+                c.prgRamEnabled = val & 0x80 != 0
+                c.prgRamProtected = val & 0x40 != 0
             case addr < 0xe000:
                 //irq reload
                 c.irqCounter = 0
+                c.irqReload = true
             default:
                 //irq enable
                 c.irqEnabled = true
@@ -289,99 +463,136 @@ func (c *MMC3) prgWrite(addr word, val byte) {
     }
 }
 
+func (c *MMC3) WritePPU(addr uint16, val byte) {
+    slot := addr >> 10
+    if c.chrIsRam[slot] {
+        c.rom.chr_rom[slot][addr&0x3ff] = val
+        return
+    }
+    c.BaseMapper.WritePPU(addr, val)
+}
+
+// chrBank returns the 1KB bank shown in CHR slot and the raw bank register
+// value that selected it.
+func (c *MMC3) chrBank(slot int) (int, byte) {
+    if c.bankConfiguration & 2 != 0 {
+        slot ^= 4
+    }
+    if slot < 4 {
+        //two 2KB banks
+        v := c.bankRegs[slot>>1]
+        return int(v&0xfe) | slot&1, v
+    }
+    //four 1KB banks
+    v := c.bankRegs[slot-2]
+    return int(v), v
+}
+
 func (c *MMC3) updateChrBanks() {
-    if c.bankConfiguration & 2 == 0 {
-        //two four
-        c.rom.chr_rom[0] = c.rom.chr_banks[c.currentChrBanks[0]*0x400:]
-        c.rom.chr_rom[1] = c.rom.chr_banks[c.currentChrBanks[0]*0x400 + 0x400:]
-        c.rom.chr_rom[2] = c.rom.chr_banks[c.currentChrBanks[1]*0x400:]
-        c.rom.chr_rom[3] = c.rom.chr_banks[c.currentChrBanks[1]*0x400 + 0x400:]
-        c.rom.chr_rom[4] = c.rom.chr_banks[c.currentChrBanks[2]*0x400:]
-        c.rom.chr_rom[5] = c.rom.chr_banks[c.currentChrBanks[3]*0x400:]
-        c.rom.chr_rom[6] = c.rom.chr_banks[c.currentChrBanks[4]*0x400:]
-        c.rom.chr_rom[7] = c.rom.chr_banks[c.currentChrBanks[5]*0x400:]
-    } else {
-        //four two
-        c.rom.chr_rom[0] = c.rom.chr_banks[c.currentChrBanks[2]*0x400:]
-        c.rom.chr_rom[1] = c.rom.chr_banks[c.currentChrBanks[3]*0x400:]
-        c.rom.chr_rom[2] = c.rom.chr_banks[c.currentChrBanks[4]*0x400:]
-        c.rom.chr_rom[3] = c.rom.chr_banks[c.currentChrBanks[5]*0x400:]
-        c.rom.chr_rom[4] = c.rom.chr_banks[c.currentChrBanks[0]*0x400:]
-        c.rom.chr_rom[5] = c.rom.chr_banks[c.currentChrBanks[0]*0x400 + 0x400:]
-        c.rom.chr_rom[6] = c.rom.chr_banks[c.currentChrBanks[1]*0x400:]
-        c.rom.chr_rom[7] = c.rom.chr_banks[c.currentChrBanks[1]*0x400 + 0x400:]
+    for slot := 0; slot < 8; slot++ {
+        bank, v := c.chrBank(slot)
+        if c.board == TQROM && v & 0x40 != 0 {
+            bank &= 7
+            c.rom.MapCHRMemory(slot, c.chrRam[bank*0x400:bank*0x400+0x400])
+            c.chrIsRam[slot] = true
+        } else {
+            c.rom.MapCHR(slot, bank)
+            c.chrIsRam[slot] = false
+        }
+    }
+    if c.board == TXSROM {
+        c.rom.NametablesChanged()
+    }
+}
+
+func (c *MMC3) Nametables(ciram []byte) [4][]byte {
+    if c.board != TXSROM {
+        return c.BaseMapper.Nametables(ciram)
+    }
+    var pages [4]int
+    for i := 0; i < 4; i++ {
+        _, v := c.chrBank(i)
+        pages[i] = int(v >> 7)
     }
+    return CIRAMNametables(pages, ciram)
 }
 
 func (c *MMC3) updatePrgBanks() {
-    fmt.Printf("switching to prg banks %d %d %d \n", c.currentPrgBanks[0], c.currentPrgBanks[1], c.currentPrgBanks[2]);
-    fmt.Printf("bank config %d\n", c.bankConfiguration & 1);
+    last := c.rom.PRGBanks() - 2
+    r6 := int(c.bankRegs[6] & 0x3f)
+    r7 := int(c.bankRegs[7] & 0x3f)
     if c.bankConfiguration & 1 == 0 {
-        c.rom.prg_rom[0] = c.rom.prg_banks[0x2000 * c.currentPrgBanks[0]:]
-        c.rom.prg_rom[1] = c.rom.prg_banks[0x2000 * c.currentPrgBanks[1]:]
-        c.rom.prg_rom[2] = c.rom.prg_banks[0x2000 * int(c.rom.prg_size*2-2):]
+        c.rom.MapPRG(0, r6)
+        c.rom.MapPRG(1, r7)
+        c.rom.MapPRG(2, last)
     } else {
-        c.rom.prg_rom[0] = c.rom.prg_banks[0x2000 * int(c.rom.prg_size*2-2):]
-        c.rom.prg_rom[1] = c.rom.prg_banks[0x2000 * c.currentPrgBanks[1]:]
-        c.rom.prg_rom[2] = c.rom.prg_banks[0x2000 * c.currentPrgBanks[0]:]
+        c.rom.MapPRG(0, last)
+        c.rom.MapPRG(1, r7)
+        c.rom.MapPRG(2, r6)
     }
 }
 
-func (c *MMC3) update(m *Machine) {
-    if !c.a12high && m.ppu.a12high {
-        //fmt.Printf("clockeroo sl: %v cyc %v \n", m.ppu.sl, m.ppu.cyc)
+func (c *MMC3) A12(high bool) {
+    if !c.a12high && high {
+        //fmt.Printf("clockeroo\n")
         c.clockCounter()
     }
-    c.a12high = m.ppu.a12high
-    if c.irqWaiting && c.irqEnabled {
-        m.requestIrq()
-    }
+    c.a12high = high
+}
+
+func (c *MMC3) IRQ() bool {
+    return c.irqWaiting && c.irqEnabled
 }
 
 func (c *MMC3) clockCounter() {
     //fmt.Printf("clocking counter %v \n", c.irqCounter)
-    if c.irqCounter > 0 {
-        c.irqCounter--
-    } else {
+    old := c.irqCounter
+    if c.irqCounter == 0 || c.irqReload {
         c.irqCounter = c.irqLatch
+    } else {
+        c.irqCounter--
     }
     if c.irqCounter == 0 && c.irqEnabled {
-        c.irqWaiting = true
+        if c.irqRevision == MMC3_SHARP || old != 0 || c.irqReload {
+            c.irqWaiting = true
+        }
     }
+    c.irqReload = false
     //fmt.Printf("clocking counter now %v\n", c.irqCounter)
 }
 
-func (c *MMC3) name() string {
+func (c *MMC3) Name() string {
+    switch c.board {
+    case TXSROM:
+        return "TxSROM"
+    case TQROM:
+        return "TQROM"
+    }
     return "MMC3"
 }
 
 type AXROM struct{
-    rom *ROM
+    BaseMapper
 }
 
-func (a *AXROM) load(rom *ROM) {
-    a.rom = rom
-    a.rom.prg_rom[0] = a.rom.prg_banks
-    a.rom.prg_rom[1] = a.rom.prg_banks[0x4000:]//*int(a.rom.prg_size-1):]
-    a.rom.chr_rom[0] = a.rom.chr_banks
-    a.rom.chr_rom[1] = a.rom.chr_banks[0x1000:]
-    rom.chr_bank_mask = 0x1000
-    rom.chr_bank_shift = 12
-    rom.prg_bank_mask = 0x4000
-    rom.prg_bank_shift = 14
+func (a *AXROM) Load(rom *ROM) {
+    a.BaseMapper.Load(rom)
+    rom.SetBankSizes(0x8000, 0x1000)
+    rom.MapPRG(0, 0)
 }
 
-func (a *AXROM) prgWrite(addr word, val byte) {
-    a.rom.prg_rom[0] = a.rom.prg_banks[0x8000 * int(val&7):]
-    a.rom.prg_rom[1] = a.rom.prg_banks[0x8000 * int(val&7) + 0x4000:]
+func (a *AXROM) WriteCPU(addr uint16, val byte) {
+    if addr < 0x8000 {
+        a.BaseMapper.WriteCPU(addr, val)
+        return
+    }
+    a.rom.MapPRG(0, int(val&7))
     if val & 0x10 != 0 {
-        a.rom.mirror = SINGLE_LOWER
+        a.rom.SetMirroring(SINGLE_LOWER)
     } else {
-        a.rom.mirror = SINGLE_UPPER
+        a.rom.SetMirroring(SINGLE_UPPER)
     }
 }
 
-func (a *AXROM) update(m *Machine) {}
-
-func (a *AXROM) name() string { return "AXROM" }
+func (a *AXROM) Name() string { return "AXROM" }
 
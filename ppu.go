@@ -1,8 +1,6 @@
 package gones
 
 import (
-    "image"
-    "image/png"
     "fmt"
     "os"
 )
@@ -15,6 +13,9 @@ const (
     SINGLE_UPPER
 )
 
+//how many PPU cycles a bit of the I/O latch holds its value, about 600ms
+const PPU_BUS_DECAY = 3220000
+
 type PPU struct {
     mach   *Machine
     cycles chan int
@@ -30,8 +31,13 @@ type PPU struct {
     //memory
     mem         [0x4000]byte
     memBuf      byte
-    mirrorTable [0x4000]word
+    //2KB of CIRAM then the 2KB a four screen cart adds
+    ciram       [0x1000]byte
+    nt          [4][]byte
     latch       bool
+    portRead    bool //the current fetch is for a $2007 read
+    ioBus       byte      //the latch register reads and writes go through
+    ioBusTime   [8]uint64 //when each bit of ioBus was last driven
     pmask       byte
     pstat       byte
     pctrl       byte
@@ -46,7 +52,6 @@ type PPU struct {
     xoff, fineX      byte
     horizScroll      bool
     vertScroll       bool
-    currentMirroring int
     vaddr, taddr     word
     nextVaddr        word
     sl               int
@@ -84,86 +89,131 @@ func makePPU(m *Machine, frames chan []int) *PPU {
     p := PPU{mach: m, frames: frames}
     p.screen = make([]int, 256*240)
     for i := word(0); i < 0x4000; i++ {
-        p.mirrorTable[i] = i
         p.mem[i] = 0xff
     }
+    for i := 0; i < 0x1000; i++ {
+        p.ciram[i] = 0xff
+    }
     for i := int(0); i < 0x100; i++ {
         p.objMem[i] = 0xff
     }
-    p.setMirroring(0x3000, 0x2000, 0xf00)
-    p.currentMirroring = -1
-    p.setNTMirroring(m.rom.mirror)
+    p.updateNametables()
     p.sl = -2
     p.cycles = make(chan int)
     p.bgPrefetch = make(chan Tile, 128) // not sure about this value
     return &p
 }
 
+// position returns the scanline and dot the PPU is on, worked out from when
+// the last vblank started since the renderer runs ahead in chunks. Scanline
+// 261 is the pre-render line.
+func (p *PPU) position() (int, int) {
+    d := int(p.mach.cpu.cycleCount*3-p.lastNMI) + 1
+    sl := 241 + d/341
+    for sl > 261 {
+        sl -= 262
+    }
+    return sl, d % 341
+}
+
 func (p *PPU) dump() string {
     return fmt.Sprintf("CYC: %d SL: %d VADDR: %4X", p.cyc, p.sl, p.vaddr)
 }
 
-func (p *PPU) setMirroring(from word, to word, n word) {
-    for i := word(0); i < n; i++ {
-        p.mirrorTable[from+i] = to + i
+// updateNametables asks the mapper where each of the four nametables lives.
+func (p *PPU) updateNametables() {
+    p.nt = p.mach.rom.mapper.Nametables(p.ciram[:])
+}
+
+func (p *PPU) setA12(high bool) {
+    if high != p.a12high {
+        p.a12high = high
+        p.mach.rom.mapper.A12(high)
     }
 }
 
-func (p *PPU) setNTMirroring(t int) {
-    if t == p.currentMirroring {
-        return
+// refreshBus drives the bits of the I/O latch in mask with val. The other
+// bits keep decaying.
+func (p *PPU) refreshBus(val byte, mask byte) {
+    p.ioBus = (p.ioBus & ^mask) | (val & mask)
+    for i := uint(0); i < 8; i++ {
+        if mask&(1<<i) != 0 {
+            p.ioBusTime[i] = p.cycleCount
+        }
     }
-    p.currentMirroring = t
-    switch t {
-    case VERTICAL:
-        p.setMirroring(0x2000, 0x2000, 0x400)
-        p.setMirroring(0x2400, 0x2400, 0x400)
-        p.setMirroring(0x2800, 0x2000, 0x400)
-        p.setMirroring(0x2c00, 0x2400, 0x400)
-    case HORIZONTAL:
-        p.setMirroring(0x2000, 0x2000, 0x400)
-        p.setMirroring(0x2400, 0x2000, 0x400)
-        p.setMirroring(0x2800, 0x2400, 0x400)
-        p.setMirroring(0x2c00, 0x2400, 0x400)
-    case SINGLE_LOWER:
-        p.setMirroring(0x2000, 0x2000, 0x400)
-        p.setMirroring(0x2400, 0x2000, 0x400)
-        p.setMirroring(0x2800, 0x2000, 0x400)
-        p.setMirroring(0x2c00, 0x2000, 0x400)
-    case SINGLE_UPPER:
-        p.setMirroring(0x2000, 0x2400, 0x400)
-        p.setMirroring(0x2400, 0x2400, 0x400)
-        p.setMirroring(0x2800, 0x2400, 0x400)
-        p.setMirroring(0x2c00, 0x2400, 0x400)
-    default:
-        break
+}
+
+// openBus returns the I/O latch after letting bits that haven't been driven
+// for a while decay to 0.
+func (p *PPU) openBus() byte {
+    p.ioBus = p.decayedBus()
+    return p.ioBus
+}
+
+// decayedBus returns what the I/O latch has decayed to.
+func (p *PPU) decayedBus() byte {
+    bus := p.ioBus
+    for i := uint(0); i < 8; i++ {
+        if p.cycleCount-p.ioBusTime[i] > PPU_BUS_DECAY {
+            bus &= ^byte(1 << i)
+        }
     }
+    return bus
+}
+
+// peekRegister returns what reading register num would, without clearing
+// vblank, moving vaddr or anything else a real read does.
+func (p *PPU) peekRegister(num int) byte {
+    bus := p.decayedBus()
+    switch num {
+    case 2:
+        return (p.pstat & 0xe0) | (bus & 0x1f)
+    case 4:
+        return p.objMem[p.objAddr]
+    case 7:
+        if p.vaddr < 0x3f00 {
+            return p.memBuf
+        }
+        return (p.peekMem(p.vaddr) & 0x3f) | (bus & 0xc0)
+    }
+    return bus
 }
 
 func (p *PPU) readRegister(num int) byte {
-    ret := byte(0)
+    ret := p.openBus()
     switch num {
     case 2:
-        ret = p.pstat
+        status := p.pstat
         p.pstat &= ^byte(1 << 7)
         p.latch = false
         cycles := p.cycleCount
         if cycles - p.lastNMI < 3 {
             p.mach.suppressNMI()
             if cycles - p.lastNMI == 0 {
-                ret = p.pstat
+                status = p.pstat
             }
         }
-        return ret
+        //only the top three bits are driven
+        ret = (status & 0xe0) | (ret & 0x1f)
+        p.refreshBus(ret, 0xe0)
     case 4:
-        return p.objMem[p.objAddr]
+        ret = p.objMem[p.objAddr]
+        p.refreshBus(ret, 0xff)
     case 7:
         if p.vaddr < 0x3f00 {
             ret = p.memBuf
+            p.portRead = true
             p.memBuf = p.getMem(p.vaddr)
+            p.portRead = false
+            p.refreshBus(ret, 0xff)
         } else {
+            //palette entries are 6 bits wide
             p.memBuf = p.getMem(p.vaddr - 0x1000)
-            ret = p.getMem(p.vaddr)
+            ret = (p.getMem(p.vaddr) & 0x3f) | (ret & 0xc0)
+            p.refreshBus(ret, 0x3f)
+        }
+        if d := p.mach.debugger; d != nil {
+            d.access(true, p.vaddr, p.peekMem(p.vaddr), BREAK_READ)
         }
         if p.pctrl&(1<<2) != 0 {
             p.vaddr += 32
@@ -171,13 +221,13 @@ func (p *PPU) readRegister(num int) byte {
             p.vaddr += 1
         }
         p.vaddr &= 0x3fff
-        p.a12high = p.vaddr & 0x1000 != 0
-        return ret
+        p.setA12(p.vaddr&0x1000 != 0)
     }
-    return 0
+    return ret
 }
 
 func (p *PPU) writeRegister(num int, val byte) {
+    p.refreshBus(val, 0xff)
     switch num {
     case 0:
         p.pctrl = val
@@ -220,7 +270,7 @@ func (p *PPU) writeRegister(num int, val byte) {
             p.taddr &= ^word(0xff)
             p.taddr |= word(val)
             p.vaddr = p.taddr
-            p.a12high = p.vaddr & 0x1000 != 0
+            p.setA12(p.vaddr&0x1000 != 0)
             if p.cyc >= 251 && p.sl < 240 && p.sl >= 0 {
                 p.vertScroll = true
             }
@@ -231,26 +281,33 @@ func (p *PPU) writeRegister(num int, val byte) {
         p.latch = !p.latch
     case 7:
         p.setMem(p.vaddr, val)
+        if d := p.mach.debugger; d != nil {
+            d.access(true, p.vaddr, val, BREAK_WRITE)
+        }
         if p.pctrl&(1<<2) != 0 {
             p.vaddr += 32
         } else {
             p.vaddr += 1
         }
         p.vaddr &= 0x3fff
-        p.a12high = p.vaddr & 0x1000 != 0
+        p.setA12(p.vaddr&0x1000 != 0)
     }
 }
 
 func (p *PPU) getMem(addr word) byte {
     switch true {
     case addr < 0x2000:
-        p.a12high = addr & 0x1000 != 0
-        chr_bank := (addr&p.mach.rom.chr_bank_mask)>>p.mach.rom.chr_bank_shift
-        return p.mach.rom.chr_rom[chr_bank][addr&(^p.mach.rom.chr_bank_mask)]
-    case addr < 0x3000:
-        return p.mem[p.mirrorTable[addr]]
+        p.setA12(addr&0x1000 != 0)
+        if p.mach.cdl != nil {
+            if p.portRead {
+                p.mach.logCHR(addr, CDL_READ)
+            } else {
+                p.mach.logCHR(addr, CDL_RENDERED)
+            }
+        }
+        return p.mach.rom.mapper.ReadPPU(uint16(addr))
     case addr < 0x3f00:
-        return p.getMem(addr - 0x1000)
+        return p.nt[(addr>>10)&3][addr&0x3ff]
     default:
         if addr&0xf == 0 {
             addr = 0
@@ -263,11 +320,10 @@ func (p *PPU) getMem(addr word) byte {
 func (p *PPU) setMem(addr word, val byte) {
     switch true {
     case addr < 0x2000:
-        p.a12high = addr & 0x1000 != 0
-        chr_bank := (addr&p.mach.rom.chr_bank_mask)>>p.mach.rom.chr_bank_shift
-        p.mach.rom.chr_rom[chr_bank][addr&(^p.mach.rom.chr_bank_mask)] = val
+        p.setA12(addr&0x1000 != 0)
+        p.mach.rom.mapper.WritePPU(uint16(addr), val)
     case addr < 0x3f00:
-        p.mem[p.mirrorTable[addr]] = val
+        p.nt[(addr>>10)&3][addr&0x3ff] = val
     default:
         if addr&0xf == 0 {
             addr = 0
@@ -276,6 +332,27 @@ func (p *PPU) setMem(addr word, val byte) {
     }
 }
 
+// peekMem reads PPU memory without clocking the mapper's A12 watcher,
+// logging the access or anything else a read sets off, for debuggers.
+func (p *PPU) peekMem(addr word) byte {
+    addr &= 0x3fff
+    if addr < 0x2000 {
+        return p.mach.rom.mapper.PeekPPU(uint16(addr))
+    }
+    return p.getMem(addr)
+}
+
+// pokeMem writes PPU memory without clocking the mapper's A12 watcher or
+// anything else a write sets off.
+func (p *PPU) pokeMem(addr word, val byte) os.Error {
+    addr &= 0x3fff
+    if addr < 0x2000 {
+        return p.mach.rom.mapper.PokePPU(uint16(addr), val)
+    }
+    p.setMem(addr, val)
+    return nil
+}
+
 func (p *PPU) newScanline() {
     p.vertScroll = false
     p.horizScroll = false
@@ -535,7 +612,16 @@ func (p *PPU) renderPixels(x byte, y byte, num byte) {
 
 func (p *PPU) drawFrame() {
     p.sl = -2
+    p.frameCounter++
+    h := p.mach.hooks
+    if h != nil {
+        h.frameDraw(p.screen)
+    }
     p.frames <- p.screen
+    if h = p.mach.hooks; h != nil {
+        h.event(HOOK_FRAME_END)
+    }
+    p.mach.takeCommands()
 }
 
 func (p *PPU) run() {
@@ -551,6 +637,9 @@ func (p *PPU) run() {
         case p.sl == -1:
             switch p.cyc {
             case 0:
+                if h := p.mach.hooks; h != nil {
+                    h.event(HOOK_FRAME_START)
+                }
                 p.pstat &= ^byte(1 << 7)
                 p.pstat &= ^byte(1 << 6)
                 p.pstat &= ^byte(1 << 5)
@@ -652,58 +741,10 @@ func (p *PPU) run() {
     }
 }
 
+// dumpNTs saves the nametables, as the PPU viewer draws them, to nt.png.
 func (p *PPU) dumpNTs() {
-    img := image.NewRGBA(512, 480)
-    basePtAddr := word(0)
-    if p.pctrl&(1<<4) != 0 {
-        basePtAddr = 0x1000
-    }
-    x := uint(0)
-    y := uint(0)
-    for nt := word(0x2000); nt < 0x3000; nt += 0x400 {
-        at_base := nt + 0x3c0
-        for ntaddr := nt; ntaddr < nt+0x3c0; ntaddr++ {
-            ntval := p.getMem(ntaddr)
-            ptaddr := (word(ntval) << 4) + basePtAddr
-            row := (ntaddr >> 6) & 1
-            col := (ntaddr & 2) >> 1
-            atval := p.getMem(at_base + ((ntaddr & 0x1f) >> 2) + ((ntaddr&0x3e0)>>7)*8)
-            atval >>= 4*row + 2*col
-            atval &= 3
-            atval <<= 2
-            for fy := uint(0); fy < 8; fy++ {
-                for fx := uint(0); fx < 8; fx++ {
-                    hi := p.getMem(ptaddr + word(8+fy))
-                    lo := p.getMem(ptaddr + word(fy))
-                    hi >>= (7 - fx)
-                    hi &= 1
-                    hi <<= 1
-                    lo >>= 7 - fx
-                    lo &= 1
-                    coli := word(0x3f00)
-                    if hi|lo != 0 {
-                        coli |= word(atval | hi | lo)
-                    }
-                    color := colors[p.getMem(coli)]
-                    img.Set(int(x+fx), int(y+fy), intToColor(color))
-                }
-            }
-            x += 8
-            if x%256 == 0 {
-                x -= 256
-                y += 8
-            }
-        }
-        x += 256
-        y -= 240
-        if x == 512 {
-            x = 0
-            y = 240
-        }
-    }
-    f, e := os.Create("nt.png")
-    if f == nil {
-        fmt.Printf("error opening file. %v\n", e.String())
+    v := &PPUViewer{snap: p.snapshot()}
+    if err := savePNG("nt.png", v.Nametables()); err != nil {
+        fmt.Printf("error saving nametables. %v\n", err.String())
     }
-    png.Encode(f, img)
 }
@@ -0,0 +1,364 @@
+package gones
+
+import (
+    "bytes"
+    "fmt"
+    "http"
+    "image"
+    "image/png"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+)
+
+// A PPUViewer keeps a picture of the PPU's memory and registers, taken once
+// a frame as the PPU reaches a chosen scanline, and draws the pattern
+// tables, nametables, sprites and palette from it. Picking the scanline
+// lets a mid-frame change be seen before the game undoes it.
+type PPUViewer struct {
+    lock sync.Mutex
+    hook int
+    snap *ppuSnapshot
+}
+
+// ppuSnapshot is the PPU's state as of one moment. Once taken it's never
+// changed, so the viewers can draw from it while the machine runs on.
+type ppuSnapshot struct {
+    mem              [0x4000]byte
+    oam              [0x100]byte
+    ctrl             byte
+    scrollX, scrollY int
+    frame            uint64
+    scanline         int
+}
+
+// StartPPUViewer starts taking pictures for the viewers at scanline, 0-261,
+// where 240 is just after the last visible line and 261 (or -1) is the
+// pre-render line. There's a picture of the PPU as it is now to begin
+// with.
+func (m *Machine) StartPPUViewer(scanline int) *PPUViewer {
+    m.StopPPUViewer()
+    v := &PPUViewer{snap: m.ppu.snapshot()}
+    v.hook = m.OnScanline(scanline, 0, func() {
+        s := m.ppu.snapshot()
+        v.lock.Lock()
+        v.snap = s
+        v.lock.Unlock()
+    })
+    m.viewer = v
+    return v
+}
+
+// StopPPUViewer stops updating the viewers.
+func (m *Machine) StopPPUViewer() {
+    if m.viewer != nil {
+        m.RemoveHook(m.viewer.hook)
+        m.viewer = nil
+    }
+}
+
+func (v *PPUViewer) snapshot() *ppuSnapshot {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    return v.snap
+}
+
+// snapshot copies the PPU's address space, OAM and scroll. The scroll is
+// where the t register points, which is where the next frame starts.
+func (p *PPU) snapshot() *ppuSnapshot {
+    s := &ppuSnapshot{ctrl: p.pctrl, frame: p.frameCounter}
+    s.scanline, _ = p.position()
+    for i := range s.mem {
+        s.mem[i] = p.peekMem(word(i))
+    }
+    s.oam = p.objMem
+    t := int(p.taddr)
+    s.scrollX = t>>10&1*256 + t&0x1f*8 + int(p.xoff)
+    s.scrollY = t>>11&1*240 + t>>5&0x1f*8 + t>>12&7
+    return s
+}
+
+// color gives palette entry i.
+func (s *ppuSnapshot) color(i int) image.RGBAColor {
+    return intToColor(colors[s.mem[0x3f00|i&0x1f]&0x3f])
+}
+
+// pixel gives the 2 bit colour of the pixel at x, y in a tile.
+func (s *ppuSnapshot) pixel(table int, tile int, x int, y int) int {
+    addr := table | tile<<4 | y
+    lo := s.mem[addr] >> uint(7-x) & 1
+    hi := s.mem[addr+8] >> uint(7-x) & 1
+    return int(hi<<1 | lo)
+}
+
+// drawTile draws a tile with its top left at x, y in palette pal, 0-7,
+// leaving transparent pixels alone unless opaque is set.
+func (s *ppuSnapshot) drawTile(img *image.RGBA, x int, y int, table int, tile int, pal int, flipH bool, flipV bool, opaque bool) {
+    for ty := 0; ty < 8; ty++ {
+        for tx := 0; tx < 8; tx++ {
+            sx, sy := tx, ty
+            if flipH {
+                sx = 7 - tx
+            }
+            if flipV {
+                sy = 7 - ty
+            }
+            c := s.pixel(table, tile, sx, sy)
+            switch true {
+            case c != 0:
+                img.Set(x+tx, y+ty, s.color(pal<<2|c))
+            case opaque:
+                img.Set(x+tx, y+ty, s.color(0))
+            }
+        }
+    }
+}
+
+// PatternTables draws both pattern tables side by side, $0000 on the left,
+// in palette pal: 0-3 for the background palettes and 4-7 for the
+// sprites'.
+func (v *PPUViewer) PatternTables(pal int) image.Image {
+    s := v.snapshot()
+    img := image.NewRGBA(256, 128)
+    for tile := 0; tile < 512; tile++ {
+        x := tile>>8*128 + tile&15*8
+        y := tile>>4&15*8
+        s.drawTile(img, x, y, tile>>8<<12, tile&0xff, pal&7, false, false, true)
+    }
+    return img
+}
+
+// Nametables draws the four nametables as the PPU sees them through the
+// cart's mirroring, with the part the scroll registers point at outlined.
+func (v *PPUViewer) Nametables() image.Image {
+    s := v.snapshot()
+    img := image.NewRGBA(512, 480)
+    table := int(s.ctrl) >> 4 & 1 << 12
+    for nt := 0; nt < 4; nt++ {
+        base := 0x2000 + nt*0x400
+        for i := 0; i < 0x3c0; i++ {
+            col, row := i&31, i>>5
+            attr := s.mem[base+0x3c0+row>>2*8+col>>2]
+            pal := int(attr>>uint(row&2<<1|col&2)) & 3
+            s.drawTile(img, nt&1*256+col*8, nt>>1*240+row*8, table, int(s.mem[base+i]), pal, false, false, true)
+        }
+    }
+    //outline the viewport, inverting what's under it so it shows on
+    //anything
+    invert := func(x int, y int) {
+        x, y = (s.scrollX+x)%512, (s.scrollY+y)%480
+        r, g, b, _ := img.At(x, y).RGBA()
+        img.Set(x, y, image.RGBAColor{^uint8(r >> 8), ^uint8(g >> 8), ^uint8(b >> 8), 0xff})
+    }
+    for x := 0; x < 256; x++ {
+        invert(x, 0)
+        invert(x, 239)
+    }
+    for y := 1; y < 239; y++ {
+        invert(0, y)
+        invert(255, y)
+    }
+    return img
+}
+
+// Sprites draws the 64 sprites in OAM order, 8 to a row, each in a 12x20
+// cell over the backdrop colour.
+func (v *PPUViewer) Sprites() image.Image {
+    s := v.snapshot()
+    img := image.NewRGBA(96, 160)
+    for y := 0; y < 160; y++ {
+        for x := 0; x < 96; x++ {
+            img.Set(x, y, s.color(0))
+        }
+    }
+    for i := 0; i < 64; i++ {
+        tile, attrs := int(s.oam[i*4+1]), s.oam[i*4+2]
+        x, y := i&7*12+2, i>>3*20+2
+        pal := 4 | int(attrs&3)
+        flipH, flipV := attrs&0x40 != 0, attrs&0x80 != 0
+        if s.ctrl&0x20 == 0 {
+            s.drawTile(img, x, y, int(s.ctrl)>>3&1<<12, tile, pal, flipH, flipV, false)
+            continue
+        }
+        //8x16 sprites take their pattern table from the tile's low bit, and
+        //flipping vertically swaps the two halves
+        top, bottom := tile&0xfe, tile|1
+        if flipV {
+            top, bottom = bottom, top
+        }
+        s.drawTile(img, x, y, tile&1<<12, top, pal, flipH, flipV, false)
+        s.drawTile(img, x, y+8, tile&1<<12, bottom, pal, flipH, flipV, false)
+    }
+    return img
+}
+
+// Palette draws the 32 palette entries as 16x16 squares, the background's
+// on the top row and the sprites' below.
+func (v *PPUViewer) Palette() image.Image {
+    s := v.snapshot()
+    img := image.NewRGBA(256, 32)
+    for i := 0; i < 32; i++ {
+        for y := 0; y < 16; y++ {
+            for x := 0; x < 16; x++ {
+                img.Set(i&15*16+x, i>>4*16+y, s.color(i))
+            }
+        }
+    }
+    return img
+}
+
+// WriteOAM lists the 64 sprites with their attributes decoded.
+func (v *PPUViewer) WriteOAM(w io.Writer) os.Error {
+    s := v.snapshot()
+    if _, err := fmt.Fprintf(w, "frame %d, scanline %d\n #   X   Y  tile  pal  priority  flip\n",
+        s.frame, s.scanline); err != nil {
+        return err
+    }
+    for i := 0; i < 64; i++ {
+        y, tile, attrs, x := s.oam[i*4], s.oam[i*4+1], s.oam[i*4+2], s.oam[i*4+3]
+        priority := "front"
+        if attrs&0x20 != 0 {
+            priority = "behind"
+        }
+        flip := ""
+        if attrs&0x40 != 0 {
+            flip += "h"
+        }
+        if attrs&0x80 != 0 {
+            flip += "v"
+        }
+        if _, err := fmt.Fprintf(w, "%02d  %3d %3d  $%02X   %d   %-8s  %s\n",
+            i, x, y, tile, attrs&3, priority, flip); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// SavePNGs writes patterns.png, nametables.png, sprites.png, palette.png
+// and oam.txt to dir.
+func (v *PPUViewer) SavePNGs(dir string) os.Error {
+    images := map[string]image.Image{
+        "patterns.png":   v.PatternTables(0),
+        "nametables.png": v.Nametables(),
+        "sprites.png":    v.Sprites(),
+        "palette.png":    v.Palette(),
+    }
+    for name, img := range images {
+        if err := savePNG(filepath.Join(dir, name), img); err != nil {
+            return err
+        }
+    }
+    f, err := os.Create(filepath.Join(dir, "oam.txt"))
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return v.WriteOAM(f)
+}
+
+func savePNG(fname string, img image.Image) os.Error {
+    f, err := os.Create(fname)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return png.Encode(f, img)
+}
+
+// A viewPage serves a viewer over HTTP: a page that refreshes itself every
+// second, and the images and text files it's made of.
+type viewPage struct {
+    title  string
+    body   func(r *http.Request) string //the page's HTML, inside <body>
+    images map[string]func(r *http.Request) image.Image
+    texts  map[string]func(w io.Writer) os.Error
+}
+
+const VIEW_PAGE = `<html><head><title>%s</title>
+<meta http-equiv="refresh" content="1"></head><body>
+%s</body></html>
+`
+
+func (p *viewPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    name := r.URL.Path[1:]
+    if f, ok := p.images[name]; ok {
+        w.Header().Set("Content-Type", "image/png")
+        w.Header().Set("Cache-Control", "no-cache")
+        png.Encode(w, f(r))
+        return
+    }
+    if f, ok := p.texts[name]; ok {
+        w.Header().Set("Content-Type", "text/plain")
+        f(w)
+        return
+    }
+    if name != "" {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", "text/html")
+    fmt.Fprintf(w, VIEW_PAGE, p.title, p.body(r))
+}
+
+// serve serves the page over HTTP on addr.
+func (p *viewPage) serve(addr string) os.Error {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    go http.Serve(l, p)
+    return nil
+}
+
+const PPU_VIEWER_PAGE = `<p>Pattern tables in palette %d: %s</p>
+<img src="patterns.png?palette=%d" width="512" height="256">
+<p>Nametables</p>
+<img src="nametables.png">
+<p>Sprites and palette</p>
+<img src="sprites.png" width="192" height="320"> <img src="palette.png" width="512" height="64">
+<pre>%s</pre>
+`
+
+// page serves the viewers as patterns.png?palette=n, nametables.png,
+// sprites.png, palette.png and oam.txt, and a page showing them all.
+func (v *PPUViewer) page() *viewPage {
+    palette := func(r *http.Request) int {
+        pal, _ := strconv.Atoi(r.FormValue("palette"))
+        return pal & 7
+    }
+    return &viewPage{
+        title: "gones PPU",
+        body: func(r *http.Request) string {
+            links := ""
+            for i := 0; i < 8; i++ {
+                links += fmt.Sprintf(`<a href="?palette=%d">%d</a> `, i, i)
+            }
+            var oam bytes.Buffer
+            v.WriteOAM(&oam)
+            return fmt.Sprintf(PPU_VIEWER_PAGE, palette(r), links, palette(r), oam.String())
+        },
+        images: map[string]func(r *http.Request) image.Image{
+            "patterns.png":   func(r *http.Request) image.Image { return v.PatternTables(palette(r)) },
+            "nametables.png": func(r *http.Request) image.Image { return v.Nametables() },
+            "sprites.png":    func(r *http.Request) image.Image { return v.Sprites() },
+            "palette.png":    func(r *http.Request) image.Image { return v.Palette() },
+        },
+        texts: map[string]func(w io.Writer) os.Error{
+            "oam.txt": func(w io.Writer) os.Error { return v.WriteOAM(w) },
+        },
+    }
+}
+
+// ServePPUViewer starts a viewer at scanline, if one isn't running, and
+// serves it over HTTP on addr.
+func (m *Machine) ServePPUViewer(addr string, scanline int) os.Error {
+    v := m.viewer
+    if v == nil {
+        v = m.StartPPUViewer(scanline)
+    }
+    return v.page().serve(addr)
+}
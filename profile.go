@@ -0,0 +1,310 @@
+package gones
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+)
+
+// A Profile counts where CPU time goes, by bank-qualified PC and by
+// subroutine. Subroutines are found by following JSR, BRK and interrupts,
+// and left when the stack pointer climbs back over where they were entered,
+// so RTS tricks and code that resets the stack don't confuse it.
+type Profile struct {
+    lock  sync.Mutex
+    rom   string
+    start int64
+    root  *profNode
+    stack []profFrame
+    lines map[uint32]SourceLine //source lines of counted PCs, where known
+}
+
+// A profNode is a subroutine reached through a particular chain of calls.
+type profNode struct {
+    name     string
+    entry    uint32 //bank-qualified address of the subroutine
+    callSite uint32 //where the parent called it from
+    parent   *profNode
+    children map[uint64]*profNode
+    pcs      map[uint32]*profCount
+}
+
+type profCount struct {
+    cycles       uint64
+    instructions uint64
+}
+
+type profFrame struct {
+    node *profNode
+    s    byte //stack pointer before the call
+}
+
+// StartProfile starts profiling the CPU and returns the profile.
+func (m *Machine) StartProfile() *Profile {
+    p := &Profile{rom: m.rom.fname, start: time.Nanoseconds(), lines: make(map[uint32]SourceLine)}
+    p.root = &profNode{name: "reset",
+        children: make(map[uint64]*profNode), pcs: make(map[uint32]*profCount)}
+    p.stack = []profFrame{{p.root, 0}}
+    m.profile = p
+    return p
+}
+
+// StopProfile stops adding to the profile.
+func (m *Machine) StopProfile() {
+    m.profile = nil
+}
+
+// bankPC qualifies pc with the PRG bank mapped there, so that code in
+// different banks at the same address is kept apart. RAM gets bank $FFFF.
+func (m *Machine) bankPC(pc word) uint32 {
+    if pc < 0x8000 {
+        return 0xffff<<16 | uint32(pc)
+    }
+    bank := m.rom.prgOffset(pc) >> m.rom.prg_bank_shift
+    return uint32(bank)<<16 | uint32(pc)
+}
+
+// profName names the subroutine at pc, by its symbol if it has one.
+func (m *Machine) profName(prefix string, pc word) string {
+    if name, ok := m.symbolAt(pc); ok {
+        return name
+    }
+    addr := m.bankPC(pc)
+    if addr>>16 == 0xffff {
+        return fmt.Sprintf("%s_ram_%04X", prefix, addr&0xffff)
+    }
+    return fmt.Sprintf("%s_%02X_%04X", prefix, addr>>16, addr&0xffff)
+}
+
+// count adds an instruction at pc taking cycles to the current subroutine.
+func (p *Profile) count(pc uint32, cycles int) {
+    n := p.stack[len(p.stack)-1].node
+    c := n.pcs[pc]
+    if c == nil {
+        c = new(profCount)
+        n.pcs[pc] = c
+    }
+    c.cycles += uint64(cycles)
+    c.instructions++
+}
+
+// call enters the subroutine name at entry, called from callSite with the
+// stack pointer at s.
+func (p *Profile) call(name string, callSite uint32, entry uint32, s byte) {
+    parent := p.stack[len(p.stack)-1].node
+    key := uint64(callSite)<<32 | uint64(entry)
+    n := parent.children[key]
+    if n == nil {
+        n = &profNode{name: name, entry: entry, callSite: callSite, parent: parent,
+            children: make(map[uint64]*profNode), pcs: make(map[uint32]*profCount)}
+        parent.children[key] = n
+    }
+    p.stack = append(p.stack, profFrame{n, s})
+}
+
+// unwind leaves every subroutine whose stack frame has been popped.
+func (p *Profile) unwind(s byte) {
+    for len(p.stack) > 1 && s >= p.stack[len(p.stack)-1].s {
+        p.stack = p.stack[:len(p.stack)-1]
+    }
+}
+
+// profileInstruction records an instruction that started at the
+// bank-qualified address from with the stack pointer at s and took cycles.
+func (m *Machine) profileInstruction(p *Profile, from uint32, s byte, opcode byte, cycles int) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if _, seen := p.lines[from]; !seen && m.symbols != nil {
+        p.lines[from], _ = m.sourceAt(from)
+    }
+    p.count(from, cycles)
+    switch opcode {
+    case 0x20: //JSR
+        p.call(m.profName("sub", m.cpu.pc), from, m.bankPC(m.cpu.pc), s)
+    case 0x00: //BRK
+        p.call(m.profName("brk", m.cpu.pc), from, m.bankPC(m.cpu.pc), s)
+    default:
+        p.unwind(m.cpu.s)
+    }
+}
+
+// profileInterrupt records an interrupt taken with the CPU about to run the
+// instruction at from.
+func (m *Machine) profileInterrupt(p *Profile, from uint32, s byte, cycles int) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    prefix := "irq"
+    if m.inNMI() {
+        prefix = "nmi"
+    }
+    p.call(m.profName(prefix, m.cpu.pc), from, m.bankPC(m.cpu.pc), s)
+    p.count(p.stack[len(p.stack)-1].node.entry, cycles)
+}
+
+// WritePprof writes the profile in pprof's gzipped protobuf format, for
+// `go tool pprof`. Samples count cycles and instructions. Each subroutine
+// is a function and each bank-qualified PC a location, so pprof's flat and
+// cum columns give exclusive and inclusive time. Source lines from symbols
+// go in as pprof's files and line numbers.
+func (p *Profile) WritePprof(w io.Writer) os.Error {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    e := &pprofEncoder{strings: make(map[string]int), functions: make(map[string]uint64),
+        locations: make(map[string]uint64), lines: p.lines}
+    e.str("")
+    var out protoBuf
+    for _, t := range [][2]string{{"cycles", "count"}, {"instructions", "count"}} {
+        var vt protoBuf
+        vt.intField(1, int64(e.str(t[0])))
+        vt.intField(2, int64(e.str(t[1])))
+        out.bytesField(1, vt.b)
+    }
+    e.samples(&out, p.root)
+    var mapping protoBuf
+    mapping.uintField(1, 1)
+    mapping.uintField(3, 0x100000000)
+    mapping.intField(5, int64(e.str(p.rom)))
+    mapping.uintField(7, 1) //has_functions
+    out.bytesField(3, mapping.b)
+    out.b = append(out.b, e.locs.b...)
+    out.b = append(out.b, e.funcs.b...)
+    for _, s := range e.table {
+        out.bytesField(6, []byte(s))
+    }
+    out.intField(9, p.start)
+    out.intField(10, time.Nanoseconds()-p.start)
+    var period protoBuf
+    period.intField(1, int64(e.str("cycles")))
+    period.intField(2, int64(e.str("count")))
+    out.bytesField(11, period.b)
+    out.intField(12, 1)
+    out.intField(14, int64(e.str("cycles"))) //default sample type
+
+    z, err := gzip.NewWriter(w)
+    if err != nil {
+        return err
+    }
+    if _, err = z.Write(out.b); err != nil {
+        return err
+    }
+    return z.Close()
+}
+
+// pprofEncoder builds up the string table, functions and locations of a
+// pprof profile as samples refer to them.
+type pprofEncoder struct {
+    table     []string
+    strings   map[string]int
+    functions map[string]uint64
+    locations map[string]uint64
+    lines     map[uint32]SourceLine
+    funcs     protoBuf
+    locs      protoBuf
+}
+
+func (e *pprofEncoder) str(s string) int {
+    if i, ok := e.strings[s]; ok {
+        return i
+    }
+    e.strings[s] = len(e.table)
+    e.table = append(e.table, s)
+    return len(e.table) - 1
+}
+
+// function returns the id of the function name, whose source is in file.
+func (e *pprofEncoder) function(name string, file string) uint64 {
+    if id, ok := e.functions[name]; ok {
+        return id
+    }
+    id := uint64(len(e.functions) + 1)
+    e.functions[name] = id
+    var f protoBuf
+    f.uintField(1, id)
+    f.intField(2, int64(e.str(name)))
+    f.intField(3, int64(e.str(name)))
+    if file != "" {
+        f.intField(4, int64(e.str(file)))
+    }
+    e.funcs.bytesField(5, f.b)
+    return id
+}
+
+// location returns the id of the location for addr inside function name,
+// which starts at entry.
+func (e *pprofEncoder) location(addr uint32, name string, entry uint32) uint64 {
+    key := fmt.Sprintf("%08X %s", addr, name)
+    if id, ok := e.locations[key]; ok {
+        return id
+    }
+    id := uint64(len(e.locations) + 1)
+    e.locations[key] = id
+    var line, l protoBuf
+    file := e.lines[entry].File
+    if file == "" {
+        file = e.lines[addr].File
+    }
+    line.uintField(1, e.function(name, file))
+    if l := e.lines[addr].Line; l != 0 {
+        line.intField(2, int64(l))
+    }
+    l.uintField(1, id)
+    l.uintField(2, 1)
+    l.uintField(3, uint64(addr))
+    l.bytesField(4, line.b)
+    e.locs.bytesField(4, l.b)
+    return id
+}
+
+// samples adds a sample for every PC counted in n and its callees.
+func (e *pprofEncoder) samples(out *protoBuf, n *profNode) {
+    var callers []uint64
+    for c := n; c.parent != nil; c = c.parent {
+        callers = append(callers, e.location(c.callSite, c.parent.name, c.parent.entry))
+    }
+    for pc, count := range n.pcs {
+        var s, ids, values protoBuf
+        ids.varint(e.location(pc, n.name, n.entry))
+        for _, id := range callers {
+            ids.varint(id)
+        }
+        values.varint(count.cycles)
+        values.varint(count.instructions)
+        s.bytesField(1, ids.b)
+        s.bytesField(2, values.b)
+        out.bytesField(2, s.b)
+    }
+    for _, c := range n.children {
+        e.samples(out, c)
+    }
+}
+
+// protoBuf encodes protocol buffer fields.
+type protoBuf struct {
+    b []byte
+}
+
+func (p *protoBuf) varint(v uint64) {
+    for v >= 0x80 {
+        p.b = append(p.b, byte(v)|0x80)
+        v >>= 7
+    }
+    p.b = append(p.b, byte(v))
+}
+
+func (p *protoBuf) uintField(field int, v uint64) {
+    p.varint(uint64(field) << 3)
+    p.varint(v)
+}
+
+func (p *protoBuf) intField(field int, v int64) {
+    p.uintField(field, uint64(v))
+}
+
+func (p *protoBuf) bytesField(field int, b []byte) {
+    p.varint(uint64(field)<<3 | 2)
+    p.varint(uint64(len(b)))
+    p.b = append(p.b, b...)
+}
@@ -0,0 +1,383 @@
+package gones
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+const RAM_SEARCH_HELP = `Addresses are hex, or names if symbols are loaded; values are decimal
+unless written $ff. Searches look through internal RAM at $0000-$07FF and
+PRG RAM at $6000-$7FFF, and compare against the values each address had
+at the last search.
+  search reset [8|16] [s|u]     start again with every address, reading
+                                bytes or little endian words, signed or
+                                unsigned
+  search eq|ne|lt|gt|le|ge [value]
+                                keep the addresses that compare with value,
+                                or with their last value if there's none
+  search changed [n]            keep the addresses that have changed, or
+                                changed by n
+  search list                   list the addresses left
+  watch addr [8|16] [s|u] [name]
+                                add an address to the watch list
+  unwatch addr                  take it off
+  watches                       show the watch list
+  watchprint on|off             show the watch list after every frame
+  watchcsv [file]               write the watch list to a CSV file after
+                                every frame, or stop; the list can't
+                                change while it's being written
+  help                          show this
+`
+
+// RAM_SEARCH_LIST is how many addresses a search lists before giving up.
+const RAM_SEARCH_LIST = 100
+
+type ramWatch struct {
+    addr   word
+    size   int //8 or 16
+    signed bool
+    name   string
+}
+
+// A RAMSearch narrows down where a game keeps something, like the number
+// of lives, by comparing RAM from one search to the next, and keeps a
+// list of addresses to watch frame by frame. Like the debugger it reads
+// commands from a channel, taking them between frames.
+type RAMSearch struct {
+    m          *Machine
+    commands   chan string
+    out        io.Writer
+    hook       int //shows the watch list each frame, or 0
+    size       int
+    signed     bool
+    candidates []word
+    last       map[word]int //each candidate's value at the last search
+    watches    []*ramWatch
+    print      bool
+    csv        *os.File
+}
+
+// StartRAMSearch starts a search of every byte, unsigned, reading commands
+// from commands and writing to out.
+func (m *Machine) StartRAMSearch(commands chan string, out io.Writer) *RAMSearch {
+    m.StopRAMSearch()
+    r := &RAMSearch{m: m, commands: commands, out: out}
+    r.reset(8, false)
+    m.ramSearch = r
+    return r
+}
+
+// StopRAMSearch stops taking commands and watching, and closes any CSV
+// file.
+func (m *Machine) StopRAMSearch() {
+    if r := m.ramSearch; r != nil {
+        if r.hook != 0 {
+            m.RemoveHook(r.hook)
+        }
+        if r.csv != nil {
+            r.csv.Close()
+        }
+        m.ramSearch = nil
+    }
+}
+
+// takeCommands runs the commands that have come in, and hooks the end of
+// each frame while the watch list is being shown or written.
+func (r *RAMSearch) takeCommands() {
+    for done := false; !done; {
+        select {
+        case line := <-r.commands:
+            if err := r.command(strings.Fields(line)); err != nil {
+                fmt.Fprintf(r.out, "%v\n", err)
+            }
+        default:
+            done = true
+        }
+    }
+    watching := r.print && len(r.watches) > 0 || r.csv != nil
+    switch true {
+    case watching && r.hook == 0:
+        r.hook = r.m.OnFrameEnd(func() { r.frame() })
+    case !watching && r.hook != 0:
+        r.m.RemoveHook(r.hook)
+        r.hook = 0
+    }
+}
+
+// frame shows the watch list.
+func (r *RAMSearch) frame() {
+    if r.print && len(r.watches) > 0 {
+        s := fmt.Sprintf("frame %d:", r.m.ppu.frameCounter)
+        for _, w := range r.watches {
+            s += fmt.Sprintf(" %s=%d", w.name, r.value(w.addr, w.size, w.signed))
+        }
+        fmt.Fprintln(r.out, s)
+    }
+    if r.csv != nil {
+        s := fmt.Sprint(r.m.ppu.frameCounter)
+        for _, w := range r.watches {
+            s += fmt.Sprintf(",%d", r.value(w.addr, w.size, w.signed))
+        }
+        fmt.Fprintln(r.csv, s)
+    }
+}
+
+// value reads a byte or little endian word without side effects.
+func (r *RAMSearch) value(addr word, size int, signed bool) int {
+    v := int(r.m.peekMem(addr))
+    if size == 16 {
+        v |= int(r.m.peekMem(addr+1)) << 8
+    }
+    return r.fit(v, size, signed)
+}
+
+// fit wraps n to size bits, signed or not.
+func (r *RAMSearch) fit(n int, size int, signed bool) int {
+    n &= 1<<uint(size) - 1
+    if signed && n >= 1<<uint(size-1) {
+        n -= 1 << uint(size)
+    }
+    return n
+}
+
+// reset makes every address a candidate again.
+func (r *RAMSearch) reset(size int, signed bool) {
+    r.size, r.signed = size, signed
+    r.candidates = nil
+    last := size/8 - 1 //a word can't start on a region's last byte
+    for a := 0; a < 0x800-last; a++ {
+        r.candidates = append(r.candidates, word(a))
+    }
+    for a := 0x6000; a < 0x8000-last; a++ {
+        r.candidates = append(r.candidates, word(a))
+    }
+    r.snapshot()
+}
+
+func (r *RAMSearch) snapshot() {
+    r.last = make(map[word]int)
+    for _, a := range r.candidates {
+        r.last[a] = r.value(a, r.size, r.signed)
+    }
+}
+
+// parseValue parses a value the way the debugger parses conditions.
+func (r *RAMSearch) parseValue(s string) (int, os.Error) {
+    e, err := parseExpr(s, r.m.symbols)
+    if err != nil {
+        return 0, err
+    }
+    return e(&exprEnv{m: r.m}), nil
+}
+
+// parseAddr parses a CPU address the way the debugger does.
+func (r *RAMSearch) parseAddr(s string) (word, os.Error) {
+    addr, ppu, err := r.m.parseAddr(s)
+    if err == nil && ppu {
+        err = os.NewError("only CPU addresses can be watched")
+    }
+    return addr, err
+}
+
+// parseType reads an optional 8 or 16 and s or u from the front of args.
+func parseType(args []string, size int, signed bool) ([]string, int, bool) {
+    for len(args) > 0 {
+        switch strings.ToLower(args[0]) {
+        case "8":
+            size = 8
+        case "16":
+            size = 16
+        case "s":
+            signed = true
+        case "u":
+            signed = false
+        default:
+            return args, size, signed
+        }
+        args = args[1:]
+    }
+    return args, size, signed
+}
+
+func (r *RAMSearch) command(args []string) os.Error {
+    if len(args) == 0 {
+        return nil
+    }
+    cmd, args := strings.ToLower(args[0]), args[1:]
+    switch cmd {
+    case "help":
+        fmt.Fprint(r.out, RAM_SEARCH_HELP)
+    case "search":
+        return r.search(args)
+    case "watch":
+        if len(args) == 0 {
+            return os.NewError("usage: watch addr [8|16] [s|u] [name]")
+        }
+        if err := r.csvBusy(); err != nil {
+            return err
+        }
+        addr, err := r.parseAddr(args[0])
+        if err != nil {
+            return err
+        }
+        rest, size, signed := parseType(args[1:], 8, false)
+        name := strings.Join(rest, " ")
+        if name == "" {
+            var ok bool
+            if name, ok = r.m.symbolAt(addr); !ok {
+                name = fmt.Sprintf("$%04X", addr)
+            }
+        }
+        r.watches = append(r.watches, &ramWatch{addr, size, signed, name})
+    case "unwatch":
+        if len(args) != 1 {
+            return os.NewError("usage: unwatch addr")
+        }
+        if err := r.csvBusy(); err != nil {
+            return err
+        }
+        addr, err := r.parseAddr(args[0])
+        if err != nil {
+            return err
+        }
+        var watches []*ramWatch
+        for _, w := range r.watches {
+            if w.addr != addr {
+                watches = append(watches, w)
+            }
+        }
+        if len(watches) == len(r.watches) {
+            return fmt.Errorf("$%04X isn't being watched", addr)
+        }
+        r.watches = watches
+    case "watches":
+        for _, w := range r.watches {
+            v := r.value(w.addr, w.size, w.signed)
+            fmt.Fprintf(r.out, "$%04X  %-16s %6d  $%0*X\n", w.addr, w.name, v, w.size/4, r.fit(v, w.size, false))
+        }
+    case "watchprint":
+        if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+            return os.NewError("usage: watchprint on|off")
+        }
+        r.print = args[0] == "on"
+    case "watchcsv":
+        if r.csv != nil {
+            r.csv.Close()
+            r.csv = nil
+        }
+        if len(args) == 0 {
+            return nil
+        }
+        f, err := os.Create(args[0])
+        if err != nil {
+            return err
+        }
+        r.csv = f
+        r.csvHeader()
+    default:
+        return fmt.Errorf("unknown command %s; try help", cmd)
+    }
+    return nil
+}
+
+// csvBusy stops the watch list changing while it's going to a CSV file,
+// whose columns are fixed by its header.
+func (r *RAMSearch) csvBusy() os.Error {
+    if r.csv != nil {
+        return os.NewError("the watch list is going to a CSV file; stop it with watchcsv first")
+    }
+    return nil
+}
+
+// csvHeader starts the CSV file with a column for each watch.
+func (r *RAMSearch) csvHeader() {
+    s := "frame"
+    for _, w := range r.watches {
+        s += "," + w.name
+    }
+    fmt.Fprintln(r.csv, s)
+}
+
+func (r *RAMSearch) search(args []string) os.Error {
+    if len(args) == 0 {
+        return os.NewError("usage: search reset|eq|ne|lt|gt|le|ge|changed|list ...")
+    }
+    op, args := strings.ToLower(args[0]), args[1:]
+    switch op {
+    case "reset":
+        rest, size, signed := parseType(args, 8, false)
+        if len(rest) > 0 {
+            return os.NewError("usage: search reset [8|16] [s|u]")
+        }
+        r.reset(size, signed)
+        fmt.Fprintf(r.out, "%d addresses\n", len(r.candidates))
+        return nil
+    case "list":
+        r.list()
+        return nil
+    }
+    compare := map[string]func(a int, b int) bool{
+        "eq": func(a int, b int) bool { return a == b },
+        "ne": func(a int, b int) bool { return a != b },
+        "lt": func(a int, b int) bool { return a < b },
+        "gt": func(a int, b int) bool { return a > b },
+        "le": func(a int, b int) bool { return a <= b },
+        "ge": func(a int, b int) bool { return a >= b },
+    }
+    f, ok := compare[op]
+    if !ok && op != "changed" {
+        return fmt.Errorf("no search %s", op)
+    }
+    if len(args) > 1 {
+        return fmt.Errorf("usage: search %s [value]", op)
+    }
+    n, given := 0, len(args) == 1
+    if given {
+        var err os.Error
+        if n, err = r.parseValue(args[0]); err != nil {
+            return err
+        }
+    }
+    var kept []word
+    for _, a := range r.candidates {
+        now, last := r.value(a, r.size, r.signed), r.last[a]
+        keep := false
+        switch true {
+        case op == "changed" && given:
+            keep = r.fit(now-last, r.size, false) == r.fit(n, r.size, false)
+        case op == "changed":
+            keep = now != last
+        case given:
+            keep = f(now, r.fit(n, r.size, r.signed))
+        default:
+            keep = f(now, last)
+        }
+        if keep {
+            kept = append(kept, a)
+        }
+    }
+    r.candidates = kept
+    r.snapshot()
+    fmt.Fprintf(r.out, "%d addresses left\n", len(kept))
+    if len(kept) <= 10 {
+        r.list()
+    }
+    return nil
+}
+
+func (r *RAMSearch) list() {
+    for i, a := range r.candidates {
+        if i == RAM_SEARCH_LIST {
+            fmt.Fprintf(r.out, "and %d more\n", len(r.candidates)-i)
+            return
+        }
+        v := r.value(a, r.size, r.signed)
+        line := fmt.Sprintf("$%04X  %6d  $%0*X", a, v, r.size/4, r.fit(v, r.size, false))
+        if name, ok := r.m.symbolAt(a); ok {
+            line += "  " + name
+        }
+        fmt.Fprintln(r.out, line)
+    }
+}
@@ -10,45 +10,105 @@ type ROM struct {
     chr_size       byte
     chr_ram        bool
     chr_rom        [8][]byte
+    chr_offsets    [8]int //where each window starts in chr_banks, or -1
     chr_banks      []byte
     chr_bank_mask  word
     chr_bank_shift uint
     prg_ram        []byte
     prg_size       byte
     prg_rom        [4][]byte
+    prg_offsets    [4]int //where each window starts in prg_banks
     prg_banks      []byte
     prg_bank_mask  word
     prg_bank_shift uint
     flags6, flags7 byte
     mapper_num     byte
+    submapper      byte
     mapper         Mapper
     mirror         int
+    four_screen    bool //the header asks for four-screen VRAM
+    nt_changed     bool //the mapper has moved the nametables around
+    battery        bool
+    bus            *byte
 }
 
-func (r *ROM) loadRom(f *os.File) {
+// LoadROM reads an iNES or UNIF image by itself, for tools that don't need a
+// whole machine.
+func LoadROM(fname string) (*ROM, os.Error) {
+    f, err := os.OpenFile(fname, 0, 0)
+    if f == nil {
+        return nil, err
+    }
+    defer f.Close()
+    r := &ROM{}
+    if err = r.loadRom(f); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *ROM) loadRom(f *os.File) os.Error {
     header := make([]byte, 16)
     r.fname = f.Name()
     f.Read(header)
-    if string(header[:4]) == "NES\x1a" {
-        fmt.Printf("header constant OK!\n")
+    prg_ram_size := byte(0)
+    switch string(header[:4]) {
+    case "NES\x1a":
+        fmt.Fprintf(os.Stderr, "header constant OK!\n")
+        prg_ram_size = r.loadINES(f, header)
+    case "UNIF":
+        fmt.Fprintf(os.Stderr, "UNIF header OK!\n")
+        //the rest of the 32 byte header is padding
+        f.Read(header)
+        if err := r.loadUnif(f); err != nil {
+            return err
+        }
+    default:
+        return os.NewError("bad rom: no iNES or UNIF header")
+    }
+    r.four_screen = r.mirror == FOUR_SCREEN
+    mapper, err := loadMapper(int(r.mapper_num), r)
+    if err != nil {
+        return err
+    }
+    r.mapper = mapper
+    fmt.Fprintf(os.Stderr, "prg size %d\nchr size %d\n", r.prg_size, r.chr_size)
+    if prg_ram_size == 0 {
+        r.prg_ram = make([]byte, 0x4000)
     } else {
-        fmt.Printf("bad rom...\n")
+        r.prg_ram = make([]byte, uint(prg_ram_size)*0x4000)
     }
+    fmt.Fprintf(os.Stderr, "Rom loaded successfully!\n")
+    return nil
+}
+
+// loadINES reads the rest of an iNES or NES 2.0 file and returns the PRG RAM
+// size from the header.
+func (r *ROM) loadINES(f *os.File, header []byte) byte {
     r.prg_size = header[4]
     r.chr_size = header[5]
     r.flags6 = header[6]
     r.flags7 = header[7]
-    if r.flags6&1 != 0 {
-        fmt.Println("Vertical Mirroring")
+    r.battery = r.flags6&(1<<1) != 0
+    if r.flags6&(1<<3) != 0 {
+        fmt.Fprintln(os.Stderr, "Four Screen VRAM")
+        r.mirror = FOUR_SCREEN
+    } else if r.flags6&1 != 0 {
+        fmt.Fprintln(os.Stderr, "Vertical Mirroring")
         r.mirror = VERTICAL
     } else {
-        fmt.Println("Horizontal Mirroring")
+        fmt.Fprintln(os.Stderr, "Horizontal Mirroring")
         r.mirror = HORIZONTAL
     }
     r.mapper_num = (r.flags7 & 0xf0) | ((r.flags6 & 0xf0) >> 4)
     prg_ram_size := header[8]
+    if r.flags7&0x0c == 0x08 {
+        fmt.Fprintln(os.Stderr, "NES 2.0 header")
+        r.submapper = header[8] >> 4
+        prg_ram_size = 0
+    }
     if r.flags6&(1<<2) != 0 {
-        fmt.Printf("loading trainer\n")
+        fmt.Fprintf(os.Stderr, "loading trainer\n")
         trainer := make([]byte, 512)
         f.Read(trainer)
     }
@@ -59,15 +119,155 @@ func (r *ROM) loadRom(f *os.File) {
         f.Read(r.chr_banks)
     } else {
         r.chr_banks = make([]byte, 0x2000)
+        r.chr_ram = true
     }
-    r.mapper = loadMapper(r.mapper_num, r)
-    fmt.Printf("prg size %d\nchr size %d\n", r.prg_size, r.chr_size)
-    if prg_ram_size == 0 {
-        r.prg_ram = make([]byte, 0x4000)
-    } else {
-        r.prg_ram = make([]byte, uint(prg_ram_size)*0x4000)
+    return prg_ram_size
+}
+
+// PRG returns the whole PRG ROM.
+func (r *ROM) PRG() []byte { return r.prg_banks }
+
+// CHR returns the whole CHR ROM, or the 8KB of CHR RAM for carts without one.
+func (r *ROM) CHR() []byte { return r.chr_banks }
+
+// HasCHRRAM reports whether the cart has CHR RAM rather than CHR ROM.
+func (r *ROM) HasCHRRAM() bool { return r.chr_ram }
+
+// PRGRAM returns the cart's RAM at $6000-$7FFF.
+func (r *ROM) PRGRAM() []byte { return r.prg_ram }
+
+// MapperNumber returns the iNES mapper number from the header.
+func (r *ROM) MapperNumber() int { return int(r.mapper_num) }
+
+// OpenBus returns the last value on the CPU data bus, which is what reads
+// of addresses the cart doesn't drive should return.
+func (r *ROM) OpenBus() byte {
+    if r.bus == nil {
+        return 0
+    }
+    return *r.bus
+}
+
+// SetMirroring changes the nametable layout used by BaseMapper.
+func (r *ROM) SetMirroring(mirror int) {
+    r.mirror = mirror
+    r.nt_changed = true
+}
+
+// FourScreen says whether the header asks for four-screen VRAM, which the
+// mapper's mirroring control can't change.
+func (r *ROM) FourScreen() bool { return r.four_screen }
+
+// NametablesChanged tells the PPU to ask the mapper for its nametables
+// again, for mappers that lay them out some other way than SetMirroring.
+func (r *ROM) NametablesChanged() { r.nt_changed = true }
+
+// SetBankSizes sets the PRG window size (8KB, 16KB or 32KB) used by MapPRG
+// and the CHR window size (1KB, 2KB, 4KB or 8KB) used by MapCHR.
+func (r *ROM) SetBankSizes(prg int, chr int) {
+    r.prg_bank_shift = 0
+    for 1<<r.prg_bank_shift < prg {
+        r.prg_bank_shift++
+    }
+    r.prg_bank_mask = word(0x8000 - prg)
+    r.chr_bank_shift = 0
+    for 1<<r.chr_bank_shift < chr {
+        r.chr_bank_shift++
+    }
+    r.chr_bank_mask = word(0x2000 - chr)
+}
+
+// PRGBanks returns the number of PRG banks of the current window size.
+func (r *ROM) PRGBanks() int {
+    return len(r.prg_banks) >> r.prg_bank_shift
+}
+
+// CHRBanks returns the number of CHR banks of the current window size.
+func (r *ROM) CHRBanks() int {
+    return len(r.chr_banks) >> r.chr_bank_shift
+}
+
+// MapPRG puts PRG bank number bank in window slot, counting from $8000.
+// Bank numbers wrap around the size of the ROM, and negative ones count back
+// from the end. A ROM smaller than the window is mirrored across it.
+func (r *ROM) MapPRG(slot int, bank int) {
+    r.prg_rom[slot], r.prg_offsets[slot] = bankSlice(r.prg_banks, bank, 1<<r.prg_bank_shift)
+}
+
+// PRGSlots returns the number of PRG windows between $8000 and $FFFF.
+func (r *ROM) PRGSlots() int {
+    return 0x8000 >> r.prg_bank_shift
+}
+
+// PRGBank returns the bank number MapPRG last put in window slot.
+func (r *ROM) PRGBank(slot int) int {
+    return r.prg_offsets[slot] >> r.prg_bank_shift
+}
+
+// CHRSlots returns the number of CHR windows between $0000 and $1FFF.
+func (r *ROM) CHRSlots() int {
+    return 0x2000 >> r.chr_bank_shift
+}
+
+// CHRBank returns the bank number MapCHR last put in window slot, or -1 if
+// MapCHRMemory put something else there.
+func (r *ROM) CHRBank(slot int) int {
+    return r.chr_offsets[slot] >> r.chr_bank_shift
+}
+
+// prgOffset returns where the byte the CPU sees at addr ($8000-$FFFF) is in
+// the PRG ROM, going by the banks MapPRG put in the windows.
+func (r *ROM) prgOffset(addr word) int {
+    slot := (addr & r.prg_bank_mask) >> r.prg_bank_shift
+    i := windowIndex(r.prg_rom[slot], int(addr&((1<<r.prg_bank_shift)-1)))
+    return r.prg_offsets[slot] + i
+}
+
+// chrOffset returns where the byte the PPU sees at addr ($0000-$1FFF) is in
+// the CHR ROM, or -1 if it isn't in there.
+func (r *ROM) chrOffset(addr word) int {
+    slot := (addr & r.chr_bank_mask) >> r.chr_bank_shift
+    if r.chr_offsets[slot] < 0 {
+        return -1
+    }
+    i := windowIndex(r.chr_rom[slot], int(addr&(^r.chr_bank_mask)))
+    return r.chr_offsets[slot] + i
+}
+
+// MapCHR puts CHR bank number bank in window slot, counting from $0000,
+// wrapping bank numbers the way MapPRG does.
+func (r *ROM) MapCHR(slot int, bank int) {
+    r.chr_rom[slot], r.chr_offsets[slot] = bankSlice(r.chr_banks, bank, 1<<r.chr_bank_shift)
+}
+
+// MapCHRMemory puts mem, memory of the mapper's own like TQROM's CHR RAM,
+// in CHR window slot. It should be the size of the window.
+func (r *ROM) MapCHRMemory(slot int, mem []byte) {
+    r.chr_rom[slot], r.chr_offsets[slot] = mem, -1
+}
+
+// bankSlice returns bank number bank of mem, in banks of size bytes, and
+// where it starts. If mem is smaller than a bank it's all returned, and
+// windows index it modulo its length.
+func bankSlice(mem []byte, bank int, size int) ([]byte, int) {
+    n := len(mem) / size
+    if n == 0 {
+        return mem, 0
+    }
+    bank %= n
+    if bank < 0 {
+        bank += n
+    }
+    return mem[bank*size : (bank+1)*size], bank * size
+}
+
+// windowIndex returns where the byte at offset i of a window is in w, which
+// is shorter than the window when the ROM is.
+func windowIndex(w []byte, i int) int {
+    if i >= len(w) {
+        i %= len(w)
     }
-    fmt.Printf("Rom loaded successfully!\n")
+    return i
 }
 
 func (r *ROM) saveGame() {
@@ -0,0 +1,748 @@
+package gones
+
+import (
+    "./lua"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+)
+
+const SCRIPT_HELP = `Scripts are Lua 5.1, with FCEUX's functions for driving the emulator, so
+most FCEUX scripts run as they are. The script's main code runs when it
+loads and carries on each time emu.frameadvance() lets a frame go by.
+Callbacks run on the emulator's own events; a script with callbacks stays
+running after its main code has finished. Addresses are CPU addresses
+unless they're the PPU's.
+
+  emu.frameadvance()                  let a frame go by, from main code only
+  emu.framecount()                    frames shown so far
+  emu.print(...), print(...)          print
+  emu.message(text)                   show text on the screen for a while
+  emu.pause()                         stop in the debugger, if there is one
+  emu.exit([code])                    quit
+  emu.emulating()                     true
+  emu.getscreenpixel(x, y)            r, g, b of the last frame shown
+  emu.registerbefore(fn)              call fn before each frame
+  emu.registerafter(fn)               call fn after each frame
+  emu.registerexit(fn)                call fn when the script stops
+  emu.registerscanline(line, [dot,] fn)
+                                      call fn when the PPU reaches a dot;
+                                      line 261, or -1, is the pre-render line
+  emu.registernmi(fn), emu.registerirq(fn)
+                                      call fn on entering the handler
+
+  memory.readbyte(addr), memory.readbytesigned(addr)
+  memory.readword(addr[, addrhigh]), memory.readwordsigned(...)
+  memory.readbyterange(addr, length)  a string of bytes
+                                      reading has no side effects
+  memory.writebyte(addr, value)       write through the CPU bus
+  memory.getregister(name)            a, x, y, s, p or pc
+  memory.setregister(name, value)
+  memory.registerwrite(addr, [size,] fn)
+  memory.registerread(addr, [size,] fn)
+  memory.registerexecute(addr, [size,] fn)
+                                      call fn(addr, size, value) as the CPU
+                                      writes, reads or runs addr to
+                                      addr+size-1; a number returned from a
+                                      read callback changes what the CPU
+                                      gets. fn nil removes the callback
+
+  ppu.readbyte(addr), ppu.readbyterange(addr, length)
+  ppu.writebyte(addr, value)          change the PPU's address space quietly
+  ppu.position()                      the scanline and dot the PPU is at
+
+  joypad.get(1), joypad.read(1)       a table of A, B, select, start, up,
+                                      down, left and right, true if held
+  joypad.set(1, buttons)              for the next frame, press the buttons
+                                      that are true and release those that
+                                      are false
+
+  gui.text(x, y, text[, color[, background]])
+  gui.box(x1, y1, x2, y2[, fill[, outline]])
+  gui.line(x1, y1, x2, y2[, color])
+  gui.pixel(x, y, color)              draw on the next frame shown, with
+                                      drawbox, drawline, drawpixel and
+                                      drawtext the same
+  gui.register(fn)                    call fn as each frame is shown
+  gui.savescreenshotas(file)          save the next frame shown as a png,
+                                      with what's been drawn on it
+
+Colors are names like "red" or "clear", "#RRGGBB" or "#RRGGBBAA" strings,
+0xRRGGBBAA numbers or {r=, g=, b=, a=} tables. AND, OR, XOR, SHIFT and BIT
+are FCEUX's bit functions, and the bit library is LuaBitOp's.
+`
+
+// SCRIPT_MAX_STEPS is how many loop iterations and calls a script can make
+// for one event before it's taken to be stuck.
+const SCRIPT_MAX_STEPS = 1000000
+
+// SCRIPT_MESSAGE_FRAMES is how long emu.message shows its text for.
+const SCRIPT_MESSAGE_FRAMES = 180
+
+// A Script is a Lua program that runs on hooks, to automate the machine.
+type Script struct {
+    m        *Machine
+    L        *lua.State
+    out      io.Writer
+    main     *lua.Coroutine
+    buttons  []int //for each button, 1 to press it and 0 to release it next frame, or -1
+    overlays []func(screen []int)
+    screen   []int //the last frame shown
+    message  string
+    shown    int //frames left to show message for
+    before   lua.Value
+    after    lua.Value
+    gui      lua.Value
+    exit     lua.Value
+    hooks    []int
+    handlers map[string]int //hooks set by the register functions, by what they're for
+    stopped  bool
+}
+
+// LoadScript compiles a script, runs its main code up to its first
+// emu.frameadvance and sets its callbacks going. Output goes to out. It
+// has to be called before Run, or on the emulation goroutine, like the
+// hooks it adds.
+func (m *Machine) LoadScript(fname string, out io.Writer) (*Script, os.Error) {
+    L := lua.NewState()
+    L.Out = out
+    L.MaxSteps = SCRIPT_MAX_STEPS
+    fn, err := L.LoadFile(fname)
+    if err != nil {
+        return nil, err
+    }
+    s := &Script{m: m, L: L, out: out, handlers: make(map[string]int)}
+    s.open()
+    s.main = L.NewCoroutine(fn)
+    s.hooks = append(s.hooks, m.OnFrameDraw(func(screen []int) { s.draw(screen) }),
+        m.OnWrite(0x4016, 0x4016, func(addr uint16, val byte) { s.strobe(val) }))
+    L.Steps = 0
+    if _, err = L.Resume(s.main); err != nil {
+        s.Stop()
+        return nil, err
+    }
+    return s, nil
+}
+
+// Stop calls the script's exit callback, removes its hooks, ends its
+// coroutines, main code included, and lets go of the joypad.
+func (s *Script) Stop() {
+    if s.stopped {
+        return
+    }
+    if s.exit != nil {
+        s.call(s.exit)
+    }
+    s.stopped = true
+    for _, id := range s.hooks {
+        s.m.RemoveHook(id)
+    }
+    for _, id := range s.handlers {
+        if id != 0 {
+            s.m.RemoveHook(id)
+        }
+    }
+    s.hooks, s.handlers, s.buttons = nil, nil, nil
+    s.L.Close()
+}
+
+// call calls a Lua function, stopping the script if it raises an error.
+func (s *Script) call(fn lua.Value, args ...lua.Value) []lua.Value {
+    if s.stopped {
+        return nil
+    }
+    s.L.Steps = 0
+    vals, err := s.L.Call(fn, args...)
+    if err != nil {
+        s.fail(err)
+    }
+    return vals
+}
+
+func (s *Script) fail(err os.Error) {
+    fmt.Fprintf(s.out, "script: %v\n", err)
+    s.Stop()
+}
+
+// draw ends a frame: it runs the callbacks and the main code's next frame,
+// and then draws what the script has asked for.
+func (s *Script) draw(screen []int) {
+    s.screen = screen
+    s.buttons = nil
+    if s.after != nil {
+        s.call(s.after)
+    }
+    if !s.stopped && !s.main.Dead() {
+        s.L.Steps = 0
+        if _, err := s.L.Resume(s.main); err != nil {
+            s.fail(err)
+        }
+    }
+    if s.gui != nil {
+        s.call(s.gui)
+    }
+    if s.shown > 0 {
+        s.shown--
+        drawText(screen, 2, 232, s.message, 0xffffffff, 0x000000ff)
+    }
+    for _, o := range s.overlays {
+        o(screen)
+    }
+    s.overlays = s.overlays[:0]
+    if s.before != nil {
+        s.call(s.before)
+    }
+}
+
+// strobe changes the buttons the game latches from the controller to the
+// ones the script has set.
+func (s *Script) strobe(val byte) {
+    if s.buttons == nil || val&1 == 0 {
+        return
+    }
+    keys := make([]byte, len(s.m.keys))
+    copy(keys, s.m.keys)
+    for i, b := range s.buttons {
+        if b >= 0 {
+            keys[i] = byte(b)
+        }
+    }
+    s.m.keys = keys
+}
+
+// register sets fn as the callback for what, replacing the one before, or
+// removes it if fn is nil. add hooks fn up and gives the hook's id.
+func (s *Script) register(what string, fn lua.Value, add func() int) {
+    if id := s.handlers[what]; id != 0 {
+        s.m.RemoveHook(id)
+        s.handlers[what] = 0
+    }
+    if fn != nil {
+        s.handlers[what] = add()
+    }
+}
+
+// number gives a Go number as a Lua one.
+func number(n int) lua.Value {
+    return float64(n)
+}
+
+// scriptButtons are FCEUX's names for the joypad's buttons, in the order
+// the controller reports them.
+var scriptButtons = []string{"A", "B", "select", "start", "up", "down", "left", "right"}
+
+// open sets up the emulator's libraries.
+func (s *Script) open() {
+    m := s.m
+    L := s.L
+    L.Library("emu", map[string]func(L *lua.State, args []lua.Value) []lua.Value{
+        "frameadvance": func(L *lua.State, args []lua.Value) []lua.Value {
+            if L.Running() != s.main {
+                L.Error("emu.frameadvance can only be called from the script's main code")
+            }
+            return L.Yield(nil)
+        },
+        "framecount": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(m.ppu.frameCounter))}
+        },
+        "print": func(L *lua.State, args []lua.Value) []lua.Value {
+            text := make([]string, len(args))
+            for i, v := range args {
+                text[i] = L.ToStringMeta(v)
+            }
+            fmt.Fprintln(s.out, strings.Join(text, " "))
+            return nil
+        },
+        "message": func(L *lua.State, args []lua.Value) []lua.Value {
+            s.message, s.shown = L.CheckString(args, 1), SCRIPT_MESSAGE_FRAMES
+            return nil
+        },
+        "pause": func(L *lua.State, args []lua.Value) []lua.Value {
+            if m.debugger == nil {
+                L.Error("emu.pause needs the debugger")
+            }
+            m.debugger.hit = "script paused"
+            return nil
+        },
+        "exit": func(L *lua.State, args []lua.Value) []lua.Value {
+            m.StopTrace()
+            os.Exit(L.OptInt(args, 1, 0))
+            return nil
+        },
+        "emulating": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{true}
+        },
+        "getscreenpixel": func(L *lua.State, args []lua.Value) []lua.Value {
+            x, y := L.CheckInt(args, 1), L.CheckInt(args, 2)
+            if s.screen == nil || x < 0 || x >= 256 || y < 0 || y >= 240 {
+                return []lua.Value{number(0), number(0), number(0), number(0)}
+            }
+            c := s.screen[y*256+x]
+            return []lua.Value{number(c >> 16 & 0xff), number(c >> 8 & 0xff), number(c & 0xff), number(0)}
+        },
+        "registerbefore": func(L *lua.State, args []lua.Value) []lua.Value {
+            s.before = L.CheckFunction(args, 1, true)
+            return nil
+        },
+        "registerafter": func(L *lua.State, args []lua.Value) []lua.Value {
+            s.after = L.CheckFunction(args, 1, true)
+            return nil
+        },
+        "registerexit": func(L *lua.State, args []lua.Value) []lua.Value {
+            s.exit = L.CheckFunction(args, 1, true)
+            return nil
+        },
+        "registerscanline": func(L *lua.State, args []lua.Value) []lua.Value {
+            scanline, dot, n := L.CheckInt(args, 1), 0, 2
+            if _, ok := lua.Arg(args, 2).(float64); ok {
+                dot, n = L.CheckInt(args, 2), 3
+            }
+            fn := L.CheckFunction(args, n, true)
+            s.register(fmt.Sprintf("scanline %d %d", scanline, dot), fn, func() int {
+                return m.OnScanline(scanline, dot, func() { s.call(fn) })
+            })
+            return nil
+        },
+        "registernmi": func(L *lua.State, args []lua.Value) []lua.Value {
+            fn := L.CheckFunction(args, 1, true)
+            s.register("nmi", fn, func() int { return m.OnNMI(func() { s.call(fn) }) })
+            return nil
+        },
+        "registerirq": func(L *lua.State, args []lua.Value) []lua.Value {
+            fn := L.CheckFunction(args, 1, true)
+            s.register("irq", fn, func() int { return m.OnIRQ(func() { s.call(fn) }) })
+            return nil
+        },
+    })
+
+    readword := func(L *lua.State, args []lua.Value) int {
+        lo := L.CheckInt(args, 1)
+        hi := L.OptInt(args, 2, lo+1)
+        return int(m.peekMem(word(lo))) | int(m.peekMem(word(hi)))<<8
+    }
+    //registerAccess makes memory.registerwrite and the like, which take
+    //an address, an optional size and a function
+    registerAccess := func(kind string) func(L *lua.State, args []lua.Value) []lua.Value {
+        return func(L *lua.State, args []lua.Value) []lua.Value {
+            lo, size, n := L.CheckInt(args, 1), 1, 2
+            if _, ok := lua.Arg(args, 2).(float64); ok {
+                size, n = L.CheckInt(args, 2), 3
+            }
+            if lo < 0 || size < 1 || lo+size > 0x10000 {
+                L.ArgError(1, "address out of range")
+            }
+            fn := L.CheckFunction(args, n, true)
+            lo16, hi16 := uint16(lo), uint16(lo+size-1)
+            s.register(fmt.Sprintf("%s %d %d", kind, lo, size), fn, func() int {
+                switch kind {
+                case "read":
+                    return m.OnRead(lo16, hi16, func(addr uint16, val byte) byte {
+                        vals := s.call(fn, number(int(addr)), number(1), number(int(val)))
+                        if len(vals) > 0 {
+                            if n, ok := lua.ToNumber(vals[0]); ok {
+                                return byte(int(n))
+                            }
+                        }
+                        return val
+                    })
+                case "write":
+                    return m.OnWrite(lo16, hi16, func(addr uint16, val byte) {
+                        s.call(fn, number(int(addr)), number(1), number(int(val)))
+                    })
+                }
+                return m.OnExec(lo16, hi16, func(pc uint16) { s.call(fn, number(int(pc)), number(1)) })
+            })
+            return nil
+        }
+    }
+    c := m.cpu
+    L.Library("memory", map[string]func(L *lua.State, args []lua.Value) []lua.Value{
+        "readbyte": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(m.peekMem(word(L.CheckInt(args, 1)))))}
+        },
+        "readbyteunsigned": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(m.peekMem(word(L.CheckInt(args, 1)))))}
+        },
+        "readbytesigned": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(int8(m.peekMem(word(L.CheckInt(args, 1))))))}
+        },
+        "readword": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(readword(L, args))}
+        },
+        "readwordunsigned": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(readword(L, args))}
+        },
+        "readwordsigned": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(int16(readword(L, args))))}
+        },
+        "readbyterange": func(L *lua.State, args []lua.Value) []lua.Value {
+            addr, n := L.CheckInt(args, 1), L.CheckInt(args, 2)
+            b := make([]byte, n)
+            for i := range b {
+                b[i] = m.peekMem(word(addr + i))
+            }
+            return []lua.Value{string(b)}
+        },
+        "writebyte": func(L *lua.State, args []lua.Value) []lua.Value {
+            m.setMem(word(L.CheckInt(args, 1)), byte(L.CheckInt(args, 2)))
+            return nil
+        },
+        "getregister": func(L *lua.State, args []lua.Value) []lua.Value {
+            switch strings.ToLower(L.CheckString(args, 1)) {
+            case "a":
+                return []lua.Value{number(int(c.a))}
+            case "x":
+                return []lua.Value{number(int(c.x))}
+            case "y":
+                return []lua.Value{number(int(c.y))}
+            case "s":
+                return []lua.Value{number(int(c.s))}
+            case "p":
+                return []lua.Value{number(int(c.p))}
+            case "pc":
+                return []lua.Value{number(int(c.pc))}
+            }
+            L.ArgError(1, "no such register")
+            return nil
+        },
+        "setregister": func(L *lua.State, args []lua.Value) []lua.Value {
+            val := L.CheckInt(args, 2)
+            switch strings.ToLower(L.CheckString(args, 1)) {
+            case "a":
+                c.a = byte(val)
+            case "x":
+                c.x = byte(val)
+            case "y":
+                c.y = byte(val)
+            case "s":
+                c.s = byte(val)
+            case "p":
+                c.p = byte(val)
+            case "pc":
+                c.pc = word(val)
+            default:
+                L.ArgError(1, "no such register")
+            }
+            return nil
+        },
+        "registerwrite":   registerAccess("write"),
+        "registerread":    registerAccess("read"),
+        "registerexecute": registerAccess("exec"),
+        "registerexec":    registerAccess("exec"),
+    })
+
+    L.Library("ppu", map[string]func(L *lua.State, args []lua.Value) []lua.Value{
+        "readbyte": func(L *lua.State, args []lua.Value) []lua.Value {
+            return []lua.Value{number(int(m.ppu.peekMem(word(L.CheckInt(args, 1)))))}
+        },
+        "readbyterange": func(L *lua.State, args []lua.Value) []lua.Value {
+            addr, n := L.CheckInt(args, 1), L.CheckInt(args, 2)
+            b := make([]byte, n)
+            for i := range b {
+                b[i] = m.ppu.peekMem(word(addr + i))
+            }
+            return []lua.Value{string(b)}
+        },
+        "writebyte": func(L *lua.State, args []lua.Value) []lua.Value {
+            if err := m.ppu.pokeMem(word(L.CheckInt(args, 1)), byte(L.CheckInt(args, 2))); err != nil {
+                L.Error("%v", err)
+            }
+            return nil
+        },
+        "position": func(L *lua.State, args []lua.Value) []lua.Value {
+            sl, dot := m.ppu.position()
+            return []lua.Value{number(sl), number(dot)}
+        },
+    })
+
+    joypadGet := func(L *lua.State, args []lua.Value) []lua.Value {
+        s.player(L, args)
+        t := lua.NewTable()
+        for i, name := range scriptButtons {
+            t.Set(name, m.keys[i] != 0)
+        }
+        return []lua.Value{t}
+    }
+    joypadSet := func(L *lua.State, args []lua.Value) []lua.Value {
+        s.player(L, args)
+        t := L.CheckTable(args, 2)
+        if s.buttons == nil {
+            s.buttons = []int{-1, -1, -1, -1, -1, -1, -1, -1}
+        }
+        for i, name := range scriptButtons {
+            switch v := t.GetString(name).(type) {
+            case bool:
+                s.buttons[i] = 0
+                if v {
+                    s.buttons[i] = 1
+                }
+            case nil:
+            default:
+                //FCEUX takes any other value to mean pressed
+                s.buttons[i] = 1
+            }
+        }
+        return nil
+    }
+    L.Library("joypad", map[string]func(L *lua.State, args []lua.Value) []lua.Value{
+        "get":   joypadGet,
+        "read":  joypadGet,
+        "set":   joypadSet,
+        "write": joypadSet,
+    })
+
+    text := func(L *lua.State, args []lua.Value) []lua.Value {
+        x, y, str := L.CheckInt(args, 1), L.CheckInt(args, 2), L.ToStringMeta(lua.Arg(args, 3))
+        fg, bg := s.color(L, args, 4, 0xffffffff), s.color(L, args, 5, 0x000000ff)
+        s.overlays = append(s.overlays, func(screen []int) { drawText(screen, x, y, str, fg, bg) })
+        return nil
+    }
+    box := func(L *lua.State, args []lua.Value) []lua.Value {
+        x1, y1, x2, y2 := L.CheckInt(args, 1), L.CheckInt(args, 2), L.CheckInt(args, 3), L.CheckInt(args, 4)
+        fill := s.color(L, args, 5, 0xffffff3f)
+        outline := s.color(L, args, 6, fill|0xff)
+        s.overlays = append(s.overlays, func(screen []int) { drawBox(screen, x1, y1, x2, y2, fill, outline) })
+        return nil
+    }
+    line := func(L *lua.State, args []lua.Value) []lua.Value {
+        x1, y1, x2, y2 := L.CheckInt(args, 1), L.CheckInt(args, 2), L.CheckInt(args, 3), L.CheckInt(args, 4)
+        color := s.color(L, args, 5, 0xffffffff)
+        s.overlays = append(s.overlays, func(screen []int) { drawLine(screen, x1, y1, x2, y2, color) })
+        return nil
+    }
+    pixel := func(L *lua.State, args []lua.Value) []lua.Value {
+        x, y := L.CheckInt(args, 1), L.CheckInt(args, 2)
+        color := s.color(L, args, 3, 0xffffffff)
+        s.overlays = append(s.overlays, func(screen []int) { blend(screen, x, y, color) })
+        return nil
+    }
+    L.Library("gui", map[string]func(L *lua.State, args []lua.Value) []lua.Value{
+        "text":      text,
+        "drawtext":  text,
+        "box":       box,
+        "drawbox":   box,
+        "rect":      box,
+        "drawrect":  box,
+        "line":      line,
+        "drawline":  line,
+        "pixel":     pixel,
+        "drawpixel": pixel,
+        "setpixel":  pixel,
+        "register": func(L *lua.State, args []lua.Value) []lua.Value {
+            s.gui = L.CheckFunction(args, 1, true)
+            return nil
+        },
+        "savescreenshotas": func(L *lua.State, args []lua.Value) []lua.Value {
+            fname := L.CheckString(args, 1)
+            s.overlays = append(s.overlays, func(screen []int) { SaveImage(fname, screen) })
+            return nil
+        },
+    })
+
+    //FCEUX's bit functions, from before it had the bit library
+    bits := func(fn func(a uint32, b uint32) uint32) func(L *lua.State, args []lua.Value) []lua.Value {
+        return func(L *lua.State, args []lua.Value) []lua.Value {
+            r := uint32(0)
+            for i := range args {
+                if i == 0 {
+                    r = uint32(int64(L.CheckNumber(args, 1)))
+                } else {
+                    r = fn(r, uint32(int64(L.CheckNumber(args, i+1))))
+                }
+            }
+            return []lua.Value{float64(r)}
+        }
+    }
+    g := L.Globals
+    L.Register(g, "AND", bits(func(a uint32, b uint32) uint32 { return a & b }))
+    L.Register(g, "OR", bits(func(a uint32, b uint32) uint32 { return a | b }))
+    L.Register(g, "XOR", bits(func(a uint32, b uint32) uint32 { return a ^ b }))
+    L.Register(g, "SHIFT", func(L *lua.State, args []lua.Value) []lua.Value {
+        n, shift := uint32(int64(L.CheckNumber(args, 1))), L.CheckInt(args, 2)
+        if shift >= 0 {
+            n >>= uint(shift)
+        } else {
+            n <<= uint(-shift)
+        }
+        return []lua.Value{float64(n)}
+    })
+    L.Register(g, "BIT", func(L *lua.State, args []lua.Value) []lua.Value {
+        r := uint32(0)
+        for i := range args {
+            r |= 1 << uint(L.CheckInt(args, i+1))
+        }
+        return []lua.Value{float64(r)}
+    })
+}
+
+// player checks a joypad function's player is 1, the only controller the
+// machine has.
+func (s *Script) player(L *lua.State, args []lua.Value) {
+    if L.CheckInt(args, 1) != 1 {
+        L.ArgError(1, "only controller 1 is connected")
+    }
+}
+
+// scriptColors are the color names gui functions take, as 0xRRGGBBAA.
+var scriptColors = map[string]uint32{
+    "white": 0xffffffff, "black": 0x000000ff, "clear": 0, "gray": 0x7f7f7fff, "grey": 0x7f7f7fff,
+    "red": 0xff0000ff, "orange": 0xff7f00ff, "yellow": 0xffff00ff, "chartreuse": 0x7fff00ff,
+    "green": 0x00ff00ff, "teal": 0x00ff7fff, "cyan": 0x00ffffff, "blue": 0x0000ffff,
+    "purple": 0x7f00ffff, "magenta": 0xff00ffff,
+}
+
+// color gives argument i as a 0xRRGGBBAA color, or def if it's nil.
+func (s *Script) color(L *lua.State, args []lua.Value, i int, def uint32) uint32 {
+    switch v := lua.Arg(args, i).(type) {
+    case nil:
+        return def
+    case float64:
+        return uint32(int64(v))
+    case string:
+        if c, ok := scriptColors[strings.ToLower(v)]; ok {
+            return c
+        }
+        if len(v) == 7 || len(v) == 9 {
+            if c, err := strconv.Btoui64(v[1:], 16); err == nil && v[0] == '#' {
+                if len(v) == 7 {
+                    return uint32(c)<<8 | 0xff
+                }
+                return uint32(c)
+            }
+        }
+        L.ArgError(i, "unknown color "+v)
+    case *lua.Table:
+        c := uint32(0)
+        for j, name := range []string{"r", "g", "b", "a"} {
+            part := v.GetString(name)
+            if part == nil {
+                part = v.Get(float64(j + 1))
+            }
+            n, ok := lua.ToNumber(part)
+            if !ok && name == "a" {
+                n, ok = 255, true
+            }
+            if !ok {
+                L.ArgError(i, "color table needs r, g and b")
+            }
+            c = c<<8 | uint32(n)&0xff
+        }
+        return c
+    }
+    L.TypeError(args, i, "color")
+    return 0
+}
+
+// blend draws a 0xRRGGBBAA color over a pixel on a 256x240 screen,
+// clipping it.
+func blend(screen []int, x int, y int, color uint32) {
+    if x < 0 || x >= 256 || y < 0 || y >= 240 {
+        return
+    }
+    a := int(color & 0xff)
+    switch a {
+    case 0:
+        return
+    case 0xff:
+        screen[y*256+x] = int(color >> 8)
+        return
+    }
+    old, c := screen[y*256+x], int(color>>8)
+    mixed := 0
+    for shift := uint(0); shift < 24; shift += 8 {
+        mixed |= ((c>>shift&0xff)*a + (old>>shift&0xff)*(255-a)) / 255 << shift
+    }
+    screen[y*256+x] = mixed
+}
+
+// drawBox fills a box and outlines it, corners given either way round.
+func drawBox(screen []int, x1 int, y1 int, x2 int, y2 int, fill uint32, outline uint32) {
+    if x1 > x2 {
+        x1, x2 = x2, x1
+    }
+    if y1 > y2 {
+        y1, y2 = y2, y1
+    }
+    for y := y1; y <= y2; y++ {
+        for x := x1; x <= x2; x++ {
+            if y == y1 || y == y2 || x == x1 || x == x2 {
+                blend(screen, x, y, outline)
+            } else {
+                blend(screen, x, y, fill)
+            }
+        }
+    }
+}
+
+// drawLine draws a line with Bresenham's algorithm.
+func drawLine(screen []int, x1 int, y1 int, x2 int, y2 int, color uint32) {
+    dx, dy := x2-x1, y2-y1
+    sx, sy := 1, 1
+    if dx < 0 {
+        dx, sx = -dx, -1
+    }
+    if dy < 0 {
+        dy, sy = -dy, -1
+    }
+    err := dx - dy
+    for {
+        blend(screen, x1, y1, color)
+        if x1 == x2 && y1 == y2 {
+            return
+        }
+        e2 := 2 * err
+        if e2 > -dy {
+            err -= dy
+            x1 += sx
+        }
+        if e2 < dx {
+            err += dx
+            y1 += sy
+        }
+    }
+}
+
+// drawText writes text in a 3x5 font on a box of background color, so it
+// shows on anything.
+func drawText(screen []int, x int, y int, text string, color uint32, background uint32) {
+    for j := y - 1; j < y+6; j++ {
+        for i := x - 1; i < x+4*len(text); i++ {
+            blend(screen, i, j, background)
+        }
+    }
+    for n := 0; n < len(text); n++ {
+        glyph, ok := scriptFont[strings.ToUpper(text[n:n+1])[0]]
+        if !ok {
+            glyph = scriptFont['?']
+        }
+        for row := 0; row < 5; row++ {
+            for col := 0; col < 3; col++ {
+                if glyph[row]>>uint(2-col)&1 != 0 {
+                    blend(screen, x+4*n+col, y+row, color)
+                }
+            }
+        }
+    }
+}
+
+// scriptFont is a 3x5 font, a row of bits to a byte.
+var scriptFont = map[byte][5]byte{
+    ' ': {0, 0, 0, 0, 0},
+    '0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 7, 1, 7},
+    '4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 1, 1},
+    '8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7},
+    'A': {2, 5, 7, 5, 5}, 'B': {6, 5, 6, 5, 6}, 'C': {3, 4, 4, 4, 3}, 'D': {6, 5, 5, 5, 6},
+    'E': {7, 4, 6, 4, 7}, 'F': {7, 4, 6, 4, 4}, 'G': {3, 4, 5, 5, 3}, 'H': {5, 5, 7, 5, 5},
+    'I': {7, 2, 2, 2, 7}, 'J': {1, 1, 1, 5, 2}, 'K': {5, 5, 6, 5, 5}, 'L': {4, 4, 4, 4, 7},
+    'M': {5, 7, 7, 5, 5}, 'N': {6, 5, 5, 5, 5}, 'O': {2, 5, 5, 5, 2}, 'P': {6, 5, 6, 4, 4},
+    'Q': {2, 5, 5, 6, 3}, 'R': {6, 5, 6, 5, 5}, 'S': {3, 4, 2, 1, 6}, 'T': {7, 2, 2, 2, 2},
+    'U': {5, 5, 5, 5, 7}, 'V': {5, 5, 5, 5, 2}, 'W': {5, 5, 7, 7, 5}, 'X': {5, 5, 2, 5, 5},
+    'Y': {5, 5, 2, 2, 2}, 'Z': {7, 1, 2, 4, 7},
+    '-': {0, 0, 7, 0, 0}, '+': {0, 2, 7, 2, 0}, '=': {0, 7, 0, 7, 0}, ':': {0, 2, 0, 2, 0},
+    '.': {0, 0, 0, 0, 2}, ',': {0, 0, 0, 2, 4}, '!': {2, 2, 2, 0, 2}, '?': {7, 1, 2, 0, 2},
+    '$': {3, 6, 2, 3, 6}, '#': {5, 7, 5, 7, 5}, '%': {5, 1, 2, 4, 5}, '/': {1, 1, 2, 4, 4},
+    '(': {1, 2, 2, 2, 1}, ')': {4, 2, 2, 2, 4}, '[': {6, 4, 4, 4, 6}, ']': {3, 1, 1, 1, 3},
+    '<': {1, 2, 4, 2, 1}, '>': {4, 2, 1, 2, 4}, '_': {0, 0, 0, 0, 7}, '*': {0, 5, 2, 5, 0},
+}
@@ -0,0 +1,363 @@
+package gones
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// A SourceLine is a line of the source an instruction was assembled from.
+type SourceLine struct {
+    File string
+    Line int
+}
+
+func (l SourceLine) String() string {
+    return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// A symbol is a name for an address. Code and data in PRG ROM are named by
+// their offset in the ROM, so they resolve to the right bank whatever the
+// mapper has switched in; everything else is named by its CPU address.
+// Labels given only as a CPU address at $8000 and up, like a Mesen G label,
+// name whatever bank is mapped there.
+type symbol struct {
+    name   string
+    addr   int //CPU address, or -1 if only the ROM offset is known
+    offset int //PRG ROM offset, or -1 if not in ROM
+}
+
+// Symbols holds names and source lines loaded from ca65's .dbg files and
+// FCEUX's .nl and Mesen's .mlb label files.
+type Symbols struct {
+    names map[string]*symbol
+    rom   map[int]*symbol
+    ram   map[int]*symbol
+    lines map[int]SourceLine //by PRG ROM offset
+}
+
+// NewSymbols returns an empty set of symbols to Load into.
+func NewSymbols() *Symbols {
+    return &Symbols{make(map[string]*symbol), make(map[int]*symbol), make(map[int]*symbol),
+        make(map[int]SourceLine)}
+}
+
+// add names an address. An address keeps the first name it's given, except
+// that ca65's cheap local @labels give way to any other.
+func (s *Symbols) add(name string, addr int, offset int) {
+    if name == "" {
+        return
+    }
+    sym := &symbol{name, addr, offset}
+    if _, ok := s.names[name]; !ok {
+        s.names[name] = sym
+    }
+    byAddr, key := s.ram, addr
+    if offset >= 0 {
+        byAddr, key = s.rom, offset
+    }
+    if old, ok := byAddr[key]; !ok || old.name[0] == '@' && name[0] != '@' {
+        byAddr[key] = sym
+    }
+}
+
+// Load reads a .dbg, .nl or .mlb file, going by its name. FCEUX names its
+// label files after the ROM, like game.nes.0.nl for the first 16KB PRG
+// bank and game.nes.ram.nl for RAM.
+func (s *Symbols) Load(fname string) os.Error {
+    f, err := os.Open(fname)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    var lines []string
+    r := bufio.NewReader(f)
+    for true {
+        line, err := r.ReadString('\n')
+        if line = strings.TrimRight(line, "\r\n"); line != "" {
+            lines = append(lines, line)
+        }
+        if err == os.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+    }
+    switch strings.ToLower(filepath.Ext(fname)) {
+    case ".dbg":
+        err = s.loadDbg(lines)
+    case ".nl":
+        err = s.loadNL(fname, lines)
+    case ".mlb":
+        err = s.loadMLB(lines)
+    default:
+        err = os.NewError("symbols must be a .dbg, .nl or .mlb file")
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %v", fname, err)
+    }
+    return nil
+}
+
+// dbgFields splits the key=value,key=value part of a .dbg line, minding
+// quoted strings.
+func dbgFields(s string) map[string]string {
+    f := make(map[string]string)
+    for s != "" {
+        i := 0
+        quoted := false
+        for ; i < len(s) && (quoted || s[i] != ','); i++ {
+            if s[i] == '"' {
+                quoted = !quoted
+            }
+        }
+        kv := s[:i]
+        if i < len(s) {
+            i++
+        }
+        s = s[i:]
+        if eq := strings.Index(kv, "="); eq >= 0 {
+            v := kv[eq+1:]
+            if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+                v = v[1 : len(v)-1]
+            }
+            f[kv[:eq]] = v
+        }
+    }
+    return f
+}
+
+// dbgNumber parses a .dbg number, which is decimal or 0x hex.
+func dbgNumber(s string) int {
+    n, err := strconv.Btoui64(s, 0)
+    if err != nil {
+        return -1
+    }
+    return int(n)
+}
+
+// loadDbg reads ld65's debug info. Segments written to the output file have
+// an offset in it, which past the 16 byte iNES header gives a PRG ROM offset
+// for every label and line in them. Labels in other segments are in RAM.
+func (s *Symbols) loadDbg(lines []string) os.Error {
+    type segment struct{ start, offset int }
+    type lineInfo struct {
+        file, line, kind int
+        spans            []string
+    }
+    type span struct {
+        seg         string
+        start, size int
+    }
+    segs := make(map[string]segment)
+    spans := make(map[string]span)
+    files := make(map[int]string)
+    var syms []map[string]string
+    var infos []lineInfo
+    for _, l := range lines {
+        kind, rest := l, ""
+        if i := strings.IndexAny(l, " \t"); i >= 0 {
+            kind, rest = l[:i], strings.TrimSpace(l[i:])
+        }
+        f := dbgFields(rest)
+        switch kind {
+        case "version":
+            if major := dbgNumber(f["major"]); major != 2 {
+                return fmt.Errorf("unsupported .dbg version %s", f["major"])
+            }
+        case "seg":
+            seg := segment{dbgNumber(f["start"]), -1}
+            if _, ok := f["ooffs"]; ok {
+                seg.offset = dbgNumber(f["ooffs"]) - 16
+            }
+            segs[f["id"]] = seg
+        case "span":
+            spans[f["id"]] = span{f["seg"], dbgNumber(f["start"]), dbgNumber(f["size"])}
+        case "file":
+            files[dbgNumber(f["id"])] = f["name"]
+        case "line":
+            if f["span"] != "" {
+                t := 0
+                if f["type"] != "" {
+                    t = dbgNumber(f["type"])
+                }
+                infos = append(infos, lineInfo{dbgNumber(f["file"]), dbgNumber(f["line"]),
+                    t, strings.Split(f["span"], "+")})
+            }
+        case "sym":
+            if f["type"] == "lab" {
+                syms = append(syms, f)
+            }
+        }
+    }
+    for _, f := range syms {
+        val := dbgNumber(f["val"])
+        if val < 0 || val > 0xffff {
+            continue
+        }
+        offset := -1
+        if seg, ok := segs[f["seg"]]; ok && seg.offset >= 0 {
+            offset = seg.offset + val - seg.start
+        }
+        s.add(f["name"], val, offset)
+    }
+    //C source lines (type 1) win over assembler lines (0), which win over
+    //lines inside macros (2).
+    rank := map[int]int{1: 3, 0: 2, 2: 1}
+    ranks := make(map[int]int)
+    for _, info := range infos {
+        for _, id := range info.spans {
+            sp, ok := spans[id]
+            seg, segOK := segs[sp.seg]
+            if !ok || !segOK || seg.offset < 0 {
+                continue
+            }
+            for i := 0; i < sp.size; i++ {
+                offset := seg.offset + sp.start + i
+                if rank[info.kind] > ranks[offset] {
+                    ranks[offset] = rank[info.kind]
+                    s.lines[offset] = SourceLine{files[info.file], info.line}
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// loadNL reads an FCEUX label file. Lines are like $C000#name#comment, with
+// an optional /size after the address for arrays.
+func (s *Symbols) loadNL(fname string, lines []string) os.Error {
+    bank := -1
+    parts := strings.Split(strings.ToLower(filepath.Base(fname)), ".")
+    if n := len(parts); n >= 2 && parts[n-2] != "ram" {
+        b, err := strconv.Btoui64(parts[n-2], 16)
+        if err != nil {
+            return os.NewError("label file isn't named like game.nes.ram.nl or game.nes.0.nl")
+        }
+        bank = int(b)
+    }
+    for _, l := range lines {
+        f := strings.SplitN(l, "#", 3)
+        if len(f) < 2 || !strings.HasPrefix(f[0], "$") {
+            continue
+        }
+        a := f[0][1:]
+        if i := strings.Index(a, "/"); i >= 0 {
+            a = a[:i]
+        }
+        addr, err := strconv.Btoui64(a, 16)
+        if err != nil || addr > 0xffff {
+            return fmt.Errorf("bad address in %q", l)
+        }
+        offset := -1
+        if bank >= 0 && addr >= 0x8000 {
+            offset = bank*0x4000 + int(addr&0x3fff)
+        }
+        s.add(f[1], int(addr), offset)
+    }
+    return nil
+}
+
+// loadMLB reads a Mesen label file. Lines are like P:1234:name:comment,
+// where the letter picks what the hex offset is into: P for PRG ROM, R for
+// internal RAM, S and W for save and work RAM at $6000 and G for the CPU's
+// address space. Mesen 2 spells them NesPrgRom, NesInternalRam and so on.
+func (s *Symbols) loadMLB(lines []string) os.Error {
+    for _, l := range lines {
+        f := strings.SplitN(l, ":", 4)
+        if len(f) < 3 {
+            continue
+        }
+        a := f[1]
+        if i := strings.Index(a, "-"); i >= 0 {
+            a = a[:i]
+        }
+        n, err := strconv.Btoui64(a, 16)
+        if err != nil {
+            return fmt.Errorf("bad offset in %q", l)
+        }
+        v := int(n)
+        switch f[0] {
+        case "P", "NesPrgRom":
+            s.add(f[2], -1, v)
+        case "R", "NesInternalRam":
+            s.add(f[2], v, -1)
+        case "S", "W", "NesSaveRam", "NesWorkRam":
+            s.add(f[2], 0x6000+v, -1)
+        case "G", "NesMemory":
+            s.add(f[2], v, -1)
+        }
+    }
+    return nil
+}
+
+// lookup finds the symbol called name.
+func (s *Symbols) lookup(name string) (*symbol, bool) {
+    sym, ok := s.names[name]
+    return sym, ok
+}
+
+// SetSymbols names addresses in traces, the debugger and profiles, and
+// gives their source lines.
+func (m *Machine) SetSymbols(s *Symbols) {
+    m.symbols = s
+}
+
+// symbolAt names the CPU address addr, looking in whatever PRG bank is
+// mapped there.
+func (m *Machine) symbolAt(addr word) (string, bool) {
+    if m.symbols == nil {
+        return "", false
+    }
+    var sym *symbol
+    ok := false
+    if addr >= 0x8000 {
+        sym, ok = m.symbols.rom[m.rom.prgOffset(addr)]
+    }
+    if !ok {
+        sym, ok = m.symbols.ram[int(addr)]
+    }
+    if !ok {
+        return "", false
+    }
+    return sym.name, true
+}
+
+// sourceAt gives the source line of the code at a bank-qualified address,
+// like bankPC returns.
+func (m *Machine) sourceAt(addr uint32) (SourceLine, bool) {
+    if m.symbols == nil || addr>>16 == 0xffff {
+        return SourceLine{}, false
+    }
+    shift := m.rom.prg_bank_shift
+    offset := int(addr>>16)<<shift | int(addr)&(1<<shift-1)
+    l, ok := m.symbols.lines[offset]
+    return l, ok
+}
+
+// operandNames is symbolAt for Instruction.TextWith.
+func (m *Machine) operandNames() func(addr uint16) (string, bool) {
+    if m.symbols == nil {
+        return nil
+    }
+    return func(addr uint16) (string, bool) { return m.symbolAt(word(addr)) }
+}
+
+// symbolAddr gives the CPU address of a symbol. One in PRG ROM is wherever
+// its bank is mapped now, if it is.
+func (m *Machine) symbolAddr(sym *symbol) (word, bool) {
+    if sym.offset < 0 {
+        return word(sym.addr), true
+    }
+    size := 1 << m.rom.prg_bank_shift
+    for slot := 0; slot < m.rom.PRGSlots(); slot++ {
+        if bank := m.rom.PRGBank(slot); sym.offset>>m.rom.prg_bank_shift == bank {
+            return word(0x8000 + slot*size + sym.offset&(size-1)), true
+        }
+    }
+    return 0, false
+}
@@ -4,8 +4,11 @@ import (
 	"os"
 	"fmt"
 	"bytes"
+	"bufio"
 	"big"
+	"net"
 	"strconv"
+	"strings"
 	"./gones"
 )
 
@@ -49,7 +52,7 @@ func test(tfile string) {
 	romname := lines[0]
 	frames := make(chan []int)
 	currentInput := make([]byte, 8)
-	m := gones.MakeMachine(string(romname), frames,
+	m, err := gones.MakeMachine(string(romname), frames,
 		func() chan []byte {
 			c := make(chan []byte)
 			go func() {
@@ -59,22 +62,73 @@ func test(tfile string) {
 			}()
 			return c
 		}())
-	go m.Run(false)
+	if err != nil {
+		fmt.Printf("%s: fail %v\n", romname, err)
+		return
+	}
+	m.SetExitOnTestDone(false)
+	jam := make(chan os.Error, 1)
+	running := false
+	//start runs the machine once the commands setting it up are done, so
+	//they don't race it
+	start := func() {
+		if !running {
+			running = true
+			go func() {
+				jam <- m.Run(false)
+			}()
+		}
+	}
+	//nextFrame gives up on the test if the cpu jams instead
+	nextFrame := func() []int {
+		start()
+		select {
+		case frame := <-frames:
+			return frame
+		case err := <-jam:
+			fmt.Printf("%s: fail %v\n", romname, err)
+		}
+		return nil
+	}
+	var gdb net.Conn
+	var gdbReader *bufio.Reader
+	//output collects what cheats, the RAM search and scripts print
+	var output bytes.Buffer
+	var cheats, ramSearch chan string
+	var symbols *gones.Symbols
+	//send gives the cheats or RAM search a command, which they take
+	//between frames, and lets two frames go by so it's surely been run
+	send := func(c chan string, command string) bool {
+		output.Reset()
+		c <- command
+		return nextFrame() != nil && nextFrame() != nil
+	}
 	for line := range lines[1:] {
 		fs := bytes.Fields(lines[line])
+		if len(fs) == 0 {
+			continue
+		}
 		switch string(fs[0]) {
 		case "wait":
 			length, _ := strconv.Atoi(string(fs[1]))
 			//fmt.Printf("waiting %v\n", length)
 			for i := 0; i < length; i++ {
-				<-frames
+				if nextFrame() == nil {
+					return
+				}
 			}
 		case "screen":
 			//fmt.Printf("screenshot\n")
-			frame := <-frames
+			frame := nextFrame()
+			if frame == nil {
+				return
+			}
 			gones.SaveImage("test/test.png", frame)
 		case "test_image":
-			frame := <-frames
+			frame := nextFrame()
+			if frame == nil {
+				return
+			}
 			hash := big.NewInt(0)
 			hash.SetBytes(gones.HashImage(frame))
 			if bytes.Compare(fs[1], []byte(fmt.Sprintf("%x", hash))) != 0 {
@@ -83,21 +137,228 @@ func test(tfile string) {
 			} else {
 				fmt.Printf("%s %s: pass\n", romname, string(fs[2]))
 			}
-		/*case "blargg_string":
-		  str, status, code = gones.GetBlarggOutput()
-		  if code != 1 {
-		      fmt.Printf("fail")
-		  } else {
-		      fmt.Printf("pass")
-		  }*/
+		case "blargg":
+			//wait up to n frames for the rom to report a result
+			limit, _ := strconv.Atoi(string(fs[1]))
+			status, text := byte(0x80), ""
+			for i := 0; i < limit && status >= 0x80; i++ {
+				if nextFrame() == nil {
+					return
+				}
+				status, text = m.TestStatus()
+			}
+			switch {
+			case status == 0:
+				fmt.Printf("%s %s: pass\n", romname, string(fs[2]))
+			case status >= 0x80:
+				fmt.Printf("%s %s: fail timed out\n", romname, string(fs[2]))
+			default:
+				fmt.Printf("%s %s: fail %d %s\n", romname, string(fs[2]), status, text)
+			}
+		case "compare_trace":
+			//run the rom in nestest's automation mode against a log
+			compareNestest(string(romname), string(fs[1]))
+		case "mmc3_revision":
+			switch string(fs[1]) {
+			case "sharp":
+				m.SetMMC3Revision(gones.MMC3_SHARP)
+			case "nec":
+				m.SetMMC3Revision(gones.MMC3_NEC)
+			}
+		case "gdb":
+			//serve gdb on an address and connect to it
+			err := m.ServeGDB(string(fs[1]))
+			if err == nil {
+				gdb, err = net.Dial("tcp", string(fs[1]))
+			}
+			if err != nil {
+				fmt.Printf("%s gdb: fail %v\n", romname, err)
+				return
+			}
+			defer gdb.Close()
+			gdbReader = bufio.NewReader(gdb)
+		case "gdb_send":
+			//send a packet and check the reply; the machine stops as
+			//soon as it starts, since the client is attached
+			start()
+			reply, err := gdbSend(gdb, gdbReader, string(fs[1]))
+			switch true {
+			case err != nil:
+				fmt.Printf("%s gdb %s: fail %v\n", romname, string(fs[1]), err)
+				return
+			case len(fs) > 2 && reply != string(fs[2]):
+				fmt.Printf("%s gdb %s: fail %s\n", romname, string(fs[1]), reply)
+			default:
+				fmt.Printf("%s gdb %s: pass\n", romname, string(fs[1]))
+			}
 		case "press":
 			key := buttonmap[fs[1][0]]
 			//fmt.Printf("pressing key %v\n", key)
 			currentInput[key] = 1
-			<-frames
-			<-frames
+			if nextFrame() == nil || nextFrame() == nil {
+				return
+			}
 			currentInput[key] = 0
+		case "symbols":
+			//load a .dbg, .nl or .mlb file, before the machine starts
+			if symbols == nil {
+				symbols = gones.NewSymbols()
+				m.SetSymbols(symbols)
+			}
+			if err := symbols.Load(string(fs[1])); err != nil {
+				fmt.Printf("%s symbols: fail %v\n", romname, err)
+				return
+			}
+		case "cheat", "cheats":
+			//cheats FILE loads the cheats from an FCEUX .cht file in
+			//place of the ROM's and lists them
+			if cheats == nil {
+				fname := gones.CheatFile(string(romname))
+				if string(fs[0]) == "cheats" {
+					fname = string(fs[1])
+				}
+				cheats = make(chan string, 1)
+				if _, err := m.StartCheats(fname, cheats, &output); err != nil {
+					fmt.Printf("%s cheat: fail %v\n", romname, err)
+					return
+				}
+			}
+			if string(fs[0]) == "cheats" {
+				fs = [][]byte{[]byte("cheat"), []byte("list")}
+			}
+			if !send(cheats, string(bytes.Join(fs, []byte{' '}))) {
+				return
+			}
+		case "ramsearch":
+			if ramSearch == nil {
+				ramSearch = make(chan string, 1)
+				m.StartRAMSearch(ramSearch, &output)
+			}
+			if !send(ramSearch, string(bytes.Join(fs[1:], []byte{' '}))) {
+				return
+			}
+		case "script":
+			//load a script before the machine starts, or with more on
+			//the line, check it fails with an error saying that
+			_, err := m.LoadScript(string(fs[1]), &output)
+			want := string(bytes.Join(fs[2:], []byte{' '}))
+			switch true {
+			case want == "" && err != nil:
+				fmt.Printf("%s script %s: fail %v\n", romname, string(fs[1]), err)
+				return
+			case want == "":
+			case err == nil:
+				fmt.Printf("%s script %s: fail loaded\n", romname, string(fs[1]))
+			case strings.Index(err.String(), want) < 0:
+				fmt.Printf("%s script %s: fail %v\n", romname, string(fs[1]), err)
+			default:
+				fmt.Printf("%s script %s: pass\n", romname, string(fs[1]))
+			}
+		case "output":
+			//check what the last command has printed, or a script since it
+			//loaded, ignoring how it's spaced
+			want := string(bytes.Join(fs[1:], []byte{' '}))
+			got := strings.Join(strings.Fields(output.String()), " ")
+			if strings.Index(got, want) < 0 {
+				fmt.Printf("%s %s: fail %s\n", romname, want, got)
+			} else {
+				fmt.Printf("%s %s: pass\n", romname, want)
+			}
+		case "peek", "poke":
+			//check or change a byte of memory, in hex, with ppu: in
+			//front of PPU addresses
+			a, ppu := string(fs[1]), false
+			if strings.HasPrefix(a, "ppu:") {
+				a, ppu = a[4:], true
+			}
+			addr, _ := strconv.Btoui64(a, 16)
+			val, _ := strconv.Btoui64(string(fs[2]), 16)
+			switch true {
+			case string(fs[0]) == "poke":
+				var err os.Error
+				if ppu {
+					err = m.PokePPU(uint16(addr), byte(val))
+				} else {
+					err = m.Poke(uint16(addr), byte(val))
+				}
+				if err != nil {
+					fmt.Printf("%s poke %s: fail %v\n", romname, string(fs[1]), err)
+				}
+			default:
+				got := m.Peek(uint16(addr))
+				if ppu {
+					got = m.PeekPPU(uint16(addr))
+				}
+				if got != byte(val) {
+					fmt.Printf("%s peek %s: fail %02x\n", romname, string(fs[1]), got)
+				} else {
+					fmt.Printf("%s peek %s: pass\n", romname, string(fs[1]))
+				}
+			}
 			//case "test":
 		}
 	}
 }
+
+// gdbSend sends a GDB remote protocol packet and waits for the reply.
+func gdbSend(conn net.Conn, r *bufio.Reader, packet string) (string, os.Error) {
+	sum := byte(0)
+	for i := 0; i < len(packet); i++ {
+		sum += packet[i]
+	}
+	if _, err := conn.Write([]byte(fmt.Sprintf("$%s#%02x", packet, sum))); err != nil {
+		return "", err
+	}
+	//skip acknowledgements
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == '$' {
+			break
+		}
+	}
+	reply, err := r.ReadString('#')
+	if err != nil {
+		return "", err
+	}
+	r.ReadByte()
+	r.ReadByte()
+	conn.Write([]byte("+"))
+	return reply[:len(reply)-1], nil
+}
+
+// compareNestest runs nestest in automation mode, which starts at $C000 and
+// needs no input or video, and checks it against a reference trace.
+func compareNestest(romfile string, logfile string) {
+	frames := make(chan []int)
+	go func() {
+		for {
+			<-frames
+		}
+	}()
+	input := make(chan []byte)
+	go func() {
+		buttons := make([]byte, 8)
+		for {
+			input <- buttons
+		}
+	}()
+	m, err := gones.MakeMachine(romfile, frames, input)
+	if err != nil {
+		fmt.Printf("%s: fail %v\n", romfile, err)
+		return
+	}
+	f, e := os.Open(logfile)
+	if f == nil {
+		fmt.Printf("Error opening trace: %v\n", e)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err = m.CompareTrace(f, 0xc000); err != nil {
+		fmt.Printf("%s %s: fail %v\n", romfile, logfile, err)
+	} else {
+		fmt.Printf("%s %s: pass\n", romfile, logfile)
+	}
+}
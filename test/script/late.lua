@@ -0,0 +1,3 @@
+-- a script that stops with an error once it's running
+emu.frameadvance()
+error("stopped")
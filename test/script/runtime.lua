@@ -0,0 +1,3 @@
+-- a script that stops with an error as it starts
+local joypads = nil
+print(joypads[1])
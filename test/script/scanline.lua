@@ -0,0 +1,22 @@
+-- Scanline callbacks run as the CPU cycle that reaches their dot ends, so
+-- the PPU is at most two dots past it. Each is checked over three frames.
+local function check(line, dot)
+    local calls, frame, wrong = 0, -1, nil
+    emu.registerscanline(line, dot, function()
+        local l, d = ppu.position()
+        if l ~= line % 262 or d < dot or d > dot + 2 then
+            wrong = "at " .. l .. " " .. d
+        elseif emu.framecount() == frame then
+            wrong = "twice in a frame"
+        end
+        calls, frame = calls + 1, emu.framecount()
+        if calls == 3 then
+            emu.registerscanline(line, dot, nil)
+            print("scanline " .. line .. " dot " .. dot .. ": " .. (wrong or "ok"))
+        end
+    end)
+end
+
+check(100, 200)
+check(0, 0)
+check(-1, 5)
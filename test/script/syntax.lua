@@ -0,0 +1,3 @@
+-- a script that doesn't compile
+if emu.framecount() == 0 then
+    print("no end")
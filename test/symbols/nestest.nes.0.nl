@@ -0,0 +1,2 @@
+$C5F5#main#
+$0300/4#buffer#
@@ -0,0 +1 @@
+$0011#lives#number of lives left
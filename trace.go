@@ -0,0 +1,420 @@
+package gones
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+//PPU dots in a frame, with rendering off so there's no skipped dot
+const FRAME_DOTS = 341 * 262
+
+// traceLine describes the instruction at pc in the format of nestest.log:
+// PC, bytes, disassembly, registers, PPU scanline and dot, and CPU cycles.
+// If names is set operands are named when there are symbols.
+func (m *Machine) traceLine(names bool) string {
+    c := m.cpu
+    sl, dot := m.ppu.position()
+    inst := c.decode(c.pc)
+    text := inst.Text()
+    if names {
+        text = inst.TextWith(m.operandNames())
+    }
+    return fmt.Sprintf("%04X  %s %sPPU:%3d,%3d CYC:%d", c.pc, inst.listing(text), c.regs(),
+        sl, dot, c.cycleCount)
+}
+
+// traceState is what a line of a reference trace says about the CPU before
+// an instruction runs.
+type traceState struct {
+    pc            uint16
+    code          []byte
+    a, x, y, p, s byte
+    dot           int64 //PPU dot within the frame, or -1 if the log doesn't say
+    cycles        int64 //CPU cycles, or -1 if the log doesn't say
+}
+
+// traceField returns the text after key in line, up to the next space or
+// comma.
+func traceField(line string, key string) (string, bool) {
+    i := strings.Index(line, key)
+    if i < 0 {
+        return "", false
+    }
+    rest := strings.TrimLeft(line[i+len(key):], " ")
+    if end := strings.IndexAny(rest, " ,"); end >= 0 {
+        rest = rest[:end]
+    }
+    return rest, true
+}
+
+func traceHex(line string, key string) (byte, os.Error) {
+    s, ok := traceField(line, key)
+    if !ok {
+        return 0, fmt.Errorf("no %s in trace line", strings.TrimSpace(key))
+    }
+    v, err := strconv.Btoui64(s, 16)
+    if err != nil {
+        return 0, err
+    }
+    return byte(v), nil
+}
+
+// parseTraceLine reads a line of nestest.log. Both the original layout,
+// which ends "CYC:dot SL:scanline", and Nintendulator's, which ends
+// "PPU:scanline,dot CYC:cycles", are understood.
+func parseTraceLine(line string) (traceState, os.Error) {
+    t := traceState{dot: -1, cycles: -1}
+    if len(line) < 16 {
+        return t, fmt.Errorf("short trace line %q", line)
+    }
+    pc, err := strconv.Btoui64(line[:4], 16)
+    if err != nil {
+        return t, err
+    }
+    t.pc = uint16(pc)
+    for _, f := range strings.Fields(line[6:15]) {
+        b, err := strconv.Btoui64(f, 16)
+        if err != nil {
+            return t, err
+        }
+        t.code = append(t.code, byte(b))
+    }
+    regs := []*byte{&t.a, &t.x, &t.y, &t.p, &t.s}
+    for i, key := range []string{" A:", " X:", " Y:", " P:", " SP:"} {
+        if *regs[i], err = traceHex(line, key); err != nil {
+            return t, err
+        }
+    }
+    sl, dot := -1, -1
+    if s, ok := traceField(line, "PPU:"); ok {
+        sl, _ = strconv.Atoi(s)
+        d, _ := traceField(line[strings.Index(line, "PPU:"):], ",")
+        dot, _ = strconv.Atoi(d)
+        if s, ok := traceField(line, "CYC:"); ok {
+            cycles, _ := strconv.Atoi(s)
+            t.cycles = int64(cycles)
+        }
+    } else if s, ok := traceField(line, "SL:"); ok {
+        sl, _ = strconv.Atoi(s)
+        d, _ := traceField(line, "CYC:")
+        dot, _ = strconv.Atoi(d)
+    }
+    if sl >= -1 && dot >= 0 {
+        if sl == -1 {
+            sl = 261
+        }
+        t.dot = int64(sl*341 + dot)
+    }
+    return t, nil
+}
+
+// traceState gives the state of the CPU, and where the PPU is, in the form
+// parseTraceLine reads a reference trace into.
+func (m *Machine) traceState() traceState {
+    c := m.cpu
+    sl, dot := m.ppu.position()
+    return traceState{uint16(c.pc), c.decode(c.pc).Bytes(), c.a, c.x, c.y, c.p, c.s,
+        int64(sl*341 + dot), int64(c.cycleCount)}
+}
+
+// CompareTrace starts the CPU at pc, the way nestest's automation mode is
+// run, and checks each instruction against a reference trace such as
+// nestest.log. PC, instruction bytes and registers have to match exactly.
+// The PPU position and cycle count are checked relative to the first line,
+// since logs don't agree on where they start counting. It returns nil if the
+// whole trace matches, or an error describing the first line that doesn't,
+// with the lines that led up to it.
+func (m *Machine) CompareTrace(log io.Reader, pc uint16) os.Error {
+    m.cpu.reset()
+    m.cpu.pc = word(pc)
+    //the cycles reset takes
+    for i := 0; i < 7; i++ {
+        m.tick()
+    }
+    r := bufio.NewReader(log)
+    var context []string
+    var first, start traceState
+    for n := 1; ; n++ {
+        line, err := r.ReadString('\n')
+        line = strings.TrimRight(line, "\r\n")
+        if line == "" {
+            if err == os.EOF {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            continue
+        }
+        want, perr := parseTraceLine(line)
+        if perr != nil {
+            return fmt.Errorf("line %d: %v", n, perr)
+        }
+        if n == 1 {
+            first, start = want, m.traceState()
+        }
+        if !m.matchTrace(want, first, start) {
+            text := fmt.Sprintf("trace differs at line %d\n", n)
+            for _, l := range context {
+                text += "         " + l + "\n"
+            }
+            text += "expected " + line + "\n"
+            text += "got      " + m.traceLine(false)
+            return os.NewError(text)
+        }
+        context = append(context, line)
+        if len(context) > 5 {
+            context = context[1:]
+        }
+        if err = m.step(); err != nil {
+            return fmt.Errorf("line %d: %v", n, err)
+        }
+    }
+    return nil
+}
+
+// matchTrace checks the CPU against want. first is the trace's first line
+// and start the machine's state when it was there.
+func (m *Machine) matchTrace(want traceState, first traceState, start traceState) bool {
+    got := m.traceState()
+    if want.pc != got.pc || !bytes.Equal(want.code, got.code) {
+        return false
+    }
+    if want.a != got.a || want.x != got.x || want.y != got.y || want.p != got.p || want.s != got.s {
+        return false
+    }
+    if want.cycles >= 0 && first.cycles >= 0 && want.cycles-first.cycles != got.cycles-start.cycles {
+        return false
+    }
+    if want.dot >= 0 && first.dot >= 0 {
+        dots := (want.dot - first.dot + FRAME_DOTS) % FRAME_DOTS
+        if dots != (got.dot-start.dot+FRAME_DOTS)%FRAME_DOTS {
+            return false
+        }
+    }
+    return true
+}
+
+// Trace log layouts.
+const (
+    TRACE_NESTEST = iota //nestest.log, which -d prints too
+    TRACE_FCEUX          //FCEUX's trace logger
+    TRACE_MESEN          //Mesen's default trace logger format
+)
+
+// TraceOptions picks what a trace log records and when. Logging starts at
+// the first of StartFrame and StartPC that's set, or straight away if
+// neither is, and stops for good at the first of StopFrame and StopPC.
+type TraceOptions struct {
+    Format     int
+    PCLow      uint16 //only log instructions from PCLow to PCHigh,
+    PCHigh     uint16 //or everywhere if both are 0
+    StartFrame uint64 //start logging at this frame, if it isn't 0
+    StartPC    uint16 //start logging when the CPU gets here,
+    StartAtPC  bool   //if this is set
+    StopFrame  uint64 //stop logging at this frame, if it isn't 0
+    StopPC     uint16 //stop logging when the CPU gets here,
+    StopAtPC   bool   //if this is set
+    Paused     bool   //wait for ToggleTrace before logging anything
+    PPU        bool   //add the PPU scanline and dot, or frame and cycle counts for FCEUX
+    Banks      bool   //add the PRG banks mapped at $8000-$FFFF
+    Memory     bool   //add the reads and writes each instruction made
+    Symbols    bool   //add label lines and name operands, which other tools' logs don't
+}
+
+type memAccess struct {
+    addr  word
+    val   byte
+    write bool
+}
+
+// Where a trace log is between its triggers.
+const (
+    TRACE_WAITING = iota
+    TRACE_LOGGING
+    TRACE_STOPPED
+)
+
+type tracer struct {
+    lock     sync.Mutex //guards w, which StopTrace can close from any goroutine
+    w        *bufio.Writer
+    opts     TraceOptions
+    state    int
+    paused   bool
+    line     string      //the instruction being logged, if any
+    accesses []memAccess //the bus accesses it has made
+}
+
+// StartTrace logs each instruction the CPU runs to w as opts says. Output is
+// buffered, so call StopTrace to flush it.
+func (m *Machine) StartTrace(w io.Writer, opts TraceOptions) os.Error {
+    bw, err := bufio.NewWriterSize(w, 1<<16)
+    if err != nil {
+        return err
+    }
+    m.tracer = &tracer{w: bw, opts: opts, paused: opts.Paused}
+    return nil
+}
+
+// StopTrace ends the trace log started by StartTrace and flushes it. It's
+// safe to call from any goroutine.
+func (m *Machine) StopTrace() os.Error {
+    t := m.tracer
+    if t == nil {
+        return nil
+    }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if t.w == nil {
+        return nil
+    }
+    err := t.w.Flush()
+    t.w = nil
+    return err
+}
+
+// ToggleTrace pauses or resumes the trace log, for a hotkey. It's safe to
+// call from any goroutine; the CPU picks the request up before its next
+// instruction.
+func (m *Machine) ToggleTrace() {
+    select {
+    case m.traceToggle <- true:
+    default:
+        //one is already waiting
+    }
+}
+
+func flagString(p byte) string {
+    flags := []byte("nvubdizc")
+    for i := range flags {
+        if p&(0x80>>uint(i)) != 0 {
+            flags[i] -= 'a' - 'A'
+        }
+    }
+    return string(flags)
+}
+
+// begin starts the log line for the instruction the CPU is about to run, if
+// it should be logged.
+func (t *tracer) begin(m *Machine) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    t.line = ""
+    t.accesses = t.accesses[:0]
+    select {
+    case <-m.traceToggle:
+        t.paused = !t.paused
+    default:
+    }
+    o := &t.opts
+    c := m.cpu
+    frame := m.ppu.frameCounter
+    t.trigger(frame, uint16(c.pc))
+    switch true {
+    case t.w == nil, t.paused, t.state != TRACE_LOGGING:
+        return
+    case (o.PCLow != 0 || o.PCHigh != 0) && (uint16(c.pc) < o.PCLow || uint16(c.pc) > o.PCHigh):
+        return
+    }
+    inst := c.decode(c.pc)
+    text := inst.Text()
+    sl, dot := m.ppu.position()
+    line := ""
+    if o.Symbols {
+        text = inst.TextWith(m.operandNames())
+        if name, ok := m.symbolAt(c.pc); ok {
+            line = name + ":\n"
+        }
+    }
+    switch o.Format {
+    case TRACE_FCEUX:
+        if o.PPU {
+            line += fmt.Sprintf("f%-6d c%-11d ", frame, c.cycleCount)
+        }
+        code := ""
+        for _, b := range inst.Bytes() {
+            code += fmt.Sprintf("%02X ", b)
+        }
+        line += fmt.Sprintf("A:%02X X:%02X Y:%02X S:%02X P:%s  $%04X:%-9s %s", c.a, c.x, c.y, c.s, flagString(c.p), c.pc, code, text)
+    case TRACE_MESEN:
+        code := ""
+        for _, b := range inst.Bytes() {
+            code += fmt.Sprintf("$%02X ", b)
+        }
+        line += fmt.Sprintf("%04X  %-12s %-31s A:%02X X:%02X Y:%02X P:%s SP:%02X", c.pc, code, text, c.a, c.x, c.y, flagString(c.p), c.s)
+        if o.PPU {
+            line += fmt.Sprintf(" CYC:%3d SL:%3d FC:%d CPU Cycle:%d", dot, sl, frame, c.cycleCount)
+        }
+    default:
+        line += fmt.Sprintf("%04X  %s %s", c.pc, inst.listing(text), c.regs())
+        if o.PPU {
+            line += fmt.Sprintf("PPU:%3d,%3d CYC:%d", sl, dot, c.cycleCount)
+        }
+    }
+    if o.Banks {
+        line += " PRG:"
+        for i := 0; i < m.rom.PRGSlots(); i++ {
+            line += fmt.Sprintf(" %02X", m.rom.PRGBank(i))
+        }
+    }
+    if !o.Memory {
+        t.w.WriteString(line + "\n")
+        return
+    }
+    t.line = line
+}
+
+// trigger starts or stops the log when the CPU reaches pc in frame.
+func (t *tracer) trigger(frame uint64, pc uint16) {
+    o := &t.opts
+    if t.state == TRACE_WAITING {
+        switch true {
+        case o.StartFrame == 0 && !o.StartAtPC,
+            o.StartFrame != 0 && frame >= o.StartFrame,
+            o.StartAtPC && pc == o.StartPC:
+            t.state = TRACE_LOGGING
+        }
+    }
+    if t.state == TRACE_LOGGING {
+        switch true {
+        case o.StopFrame != 0 && frame >= o.StopFrame,
+            o.StopAtPC && pc == o.StopPC:
+            t.state = TRACE_STOPPED
+        }
+    }
+}
+
+// access records a bus access made by the instruction being logged.
+func (t *tracer) access(addr word, val byte, write bool) {
+    if t.line != "" {
+        t.accesses = append(t.accesses, memAccess{addr, val, write})
+    }
+}
+
+// end finishes the log line begun for the instruction that just ran.
+func (t *tracer) end() {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if t.line == "" || t.w == nil {
+        return
+    }
+    line := t.line + " ["
+    for i, a := range t.accesses {
+        if i > 0 {
+            line += " "
+        }
+        kind := 'R'
+        if a.write {
+            kind = 'W'
+        }
+        line += fmt.Sprintf("%c $%04X=%02X", kind, a.addr, a.val)
+    }
+    t.w.WriteString(line + "]\n")
+    t.line = ""
+}
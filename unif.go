@@ -0,0 +1,148 @@
+package gones
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// unifBoards maps UNIF board names, without their NES-/HVC-/UNL- prefix,
+// to the iNES mapper that implements them.
+var unifBoards = map[string]int{
+    "NROM":     0,
+    "NROM-128": 0,
+    "NROM-256": 0,
+    "RROM":     0,
+    "RROM-128": 0,
+    "SAROM":    1,
+    "SBROM":    1,
+    "SCROM":    1,
+    "SEROM":    1,
+    "SGROM":    1,
+    "SKROM":    1,
+    "SLROM":    1,
+    "SL1ROM":   1,
+    "SNROM":    1,
+    "SOROM":    1,
+    "SUROM":    1,
+    "SXROM":    1,
+    "UNROM":    2,
+    "UOROM":    2,
+    "CNROM":    3,
+    "TBROM":    4,
+    "TEROM":    4,
+    "TFROM":    4,
+    "TGROM":    4,
+    "TKROM":    4,
+    "TLROM":    4,
+    "TL1ROM":   4,
+    "TR1ROM":   4,
+    "TSROM":    4,
+    "TVROM":    4,
+    "ANROM":    7,
+    "AN1ROM":   7,
+    "AMROM":    7,
+    "AOROM":    7,
+    "TKSROM":   118,
+    "TLSROM":   118,
+    "TQROM":    119,
+}
+
+// unifMapper returns the mapper number for a UNIF board name.
+func unifMapper(board string) (int, os.Error) {
+    name := board
+    for _, prefix := range []string{"NES-", "HVC-", "UNL-"} {
+        if strings.HasPrefix(name, prefix) {
+            name = name[len(prefix):]
+            break
+        }
+    }
+    num, ok := unifBoards[strings.ToUpper(name)]
+    if !ok {
+        return 0, fmt.Errorf("unsupported UNIF board %q", board)
+    }
+    return num, nil
+}
+
+// loadUnif reads the chunks of a UNIF file whose 32 byte header has already
+// been consumed and fills in the ROM the same way loadRom does for iNES.
+func (r *ROM) loadUnif(f io.Reader) os.Error {
+    var prg, chr [16][]byte
+    board := ""
+    r.mirror = HORIZONTAL
+    chunk := make([]byte, 8)
+    for {
+        _, err := io.ReadFull(f, chunk)
+        if err == os.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+        id := string(chunk[:4])
+        data := make([]byte, binary.LittleEndian.Uint32(chunk[4:]))
+        if _, err = io.ReadFull(f, data); err != nil {
+            return fmt.Errorf("truncated UNIF chunk %s", id)
+        }
+        switch {
+        case id == "MAPR":
+            board = string(data)
+            if i := strings.Index(board, "\x00"); i >= 0 {
+                board = board[:i]
+            }
+        case strings.HasPrefix(id, "PRG") || strings.HasPrefix(id, "CHR"):
+            n := strings.Index("0123456789ABCDEF", id[3:])
+            if n < 0 {
+                break
+            }
+            if id[0] == 'P' {
+                prg[n] = data
+            } else {
+                chr[n] = data
+            }
+        case id == "MIRR" && len(data) > 0:
+            switch data[0] {
+            case 0:
+                r.mirror = HORIZONTAL
+            case 1:
+                r.mirror = VERTICAL
+            case 2:
+                r.mirror = SINGLE_LOWER
+            case 3:
+                r.mirror = SINGLE_UPPER
+            case 4:
+                r.mirror = FOUR_SCREEN
+            }
+        case id == "BATR" && len(data) > 0:
+            r.battery = data[0] != 0
+        }
+    }
+    fmt.Fprintf(os.Stderr, "UNIF board %s\n", board)
+    num, err := unifMapper(board)
+    if err != nil {
+        return err
+    }
+    r.mapper_num = byte(num)
+    for i := 0; i < 16; i++ {
+        r.prg_banks = append(r.prg_banks, prg[i]...)
+        r.chr_banks = append(r.chr_banks, chr[i]...)
+    }
+    if len(r.prg_banks) == 0 {
+        return os.NewError("UNIF file has no PRG chunks")
+    }
+    //boards with less than 16KB see it mirrored
+    for len(r.prg_banks) < 0x4000 {
+        r.prg_banks = append(r.prg_banks, r.prg_banks...)
+    }
+    if len(r.prg_banks)%0x4000 != 0 {
+        r.prg_banks = append(r.prg_banks, make([]byte, 0x4000-len(r.prg_banks)%0x4000)...)
+    }
+    r.prg_size = byte(len(r.prg_banks) / 0x4000)
+    r.chr_size = byte(len(r.chr_banks) / 0x2000)
+    if len(r.chr_banks) == 0 {
+        r.chr_banks = make([]byte, 0x2000)
+        r.chr_ram = true
+    }
+    return nil
+}